@@ -0,0 +1,724 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"s3-exporter/rollup"
+	"s3-exporter/sfm"
+	"s3-exporter/src"
+)
+
+// AutoRollupMarkerName is the name of the object written next to the
+// manifest of a segment once its records are rolled up into the first tier.
+// It records how far they have been rolled up.
+const AutoRollupMarkerName = "autorollup.json"
+
+// tierTimeLayout names tier objects after the start of their window, so
+// that their keys sort by time
+const tierTimeLayout = "20060102T150405Z"
+
+// RollupTier is one tier of automatic rollups
+type RollupTier struct {
+	Interval  rollup.Interval
+	Prefix    string
+	Retention time.Duration // 0 to keep windows forever
+}
+
+// AutoRollupReport counts what an automatic rollup run did
+type AutoRollupReport struct {
+	SegmentsRead    int
+	SegmentsDeleted int
+	Windows         map[string]int // windows written, by tier interval
+	WindowsDeleted  map[string]int // windows deleted, by tier interval
+	FoldedSeries    map[string]int // series folded into __other__, by tier interval
+	// LateSegments lists the segments holding records whose window had
+	// already been written, which are left out of it. These segments are
+	// kept past raw_retention.
+	LateSegments []string
+	LateRecords  int
+}
+
+// autoRollupMarker is the content of a segment's rollup marker
+type autoRollupMarker struct {
+	Tier       string    `json:"tier"`
+	RolledUpAt time.Time `json:"rolled_up_at"`
+	// Through is the end of the first tier windows the records of the
+	// segment have been rolled up into
+	Through time.Time `json:"through,omitempty"`
+	// Pending is set while some records are in windows that are still open
+	Pending bool `json:"pending,omitempty"`
+	// LateRecords counts the records whose window had already been written
+	LateRecords int `json:"late_records,omitempty"`
+}
+
+// segmentRollup selects the records of a segment rolled up by a run: those
+// in the closed first tier windows from from up to cutoff. Records in a
+// window that any tier had written before the run are late.
+type segmentRollup struct {
+	tiers        []RollupTier
+	written      []map[int64]bool // window starts held by each tier before the run
+	from, cutoff time.Time
+	pending      bool // some records are in windows after cutoff
+	late         int
+}
+
+// accept reports whether the record at t is rolled up, counting late records
+func (s *segmentRollup) accept(t time.Time) bool {
+	start := s.tiers[0].Interval.Start(t)
+	if start.Before(s.from) {
+		return false
+	}
+	if !start.Before(s.cutoff) {
+		s.pending = true
+		return false
+	}
+	for i, tier := range s.tiers {
+		if s.written[i][tier.Interval.Start(t).Unix()] {
+			s.late++
+			return false
+		}
+	}
+	return true
+}
+
+// tierWindow is a window object of a tier
+type tierWindow struct {
+	start time.Time
+	key   string
+}
+
+// RollupTiers returns the automatic rollup tiers from the configuration.
+// Every tier is rolled up from the one before it, so its interval must be
+// a multiple of the previous one, and a tier must keep its windows until
+// the next tier has rolled them up.
+func (c *Config) RollupTiers() ([]RollupTier, error) {
+	if len(c.AutoRollup.Tiers) == 0 {
+		return nil, fmt.Errorf("autorollup needs at least one tier")
+	}
+	if c.AutoRollup.Grace < 0 || c.AutoRollup.RawRetention < 0 {
+		return nil, fmt.Errorf("autorollup grace and raw_retention must not be negative")
+	}
+
+	var tiers []RollupTier
+	for i, tierConfig := range c.AutoRollup.Tiers {
+		interval, err := rollup.ParseInterval(tierConfig.Interval)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			previous := tiers[i-1].Interval
+			if interval.Duration <= previous.Duration || interval.Duration%previous.Duration != 0 {
+				return nil, fmt.Errorf("tier interval %s must be a multiple of the previous tier interval %s", interval.Name, previous.Name)
+			}
+		}
+
+		// Tier prefixes must not contain each other, or listing one tier
+		// would return the windows of another
+		prefix := strings.Trim(tierConfig.Prefix, "/")
+		if prefix == "" {
+			return nil, fmt.Errorf("tier %s needs a prefix", interval.Name)
+		}
+		for _, tier := range tiers {
+			if strings.HasPrefix(prefix+"/", tier.Prefix+"/") || strings.HasPrefix(tier.Prefix+"/", prefix+"/") {
+				return nil, fmt.Errorf("tier prefixes %q and %q overlap", tier.Prefix, prefix)
+			}
+		}
+
+		if tierConfig.Retention < 0 {
+			return nil, fmt.Errorf("tier %s retention must not be negative", interval.Name)
+		}
+
+		tiers = append(tiers, RollupTier{Interval: interval, Prefix: prefix, Retention: time.Duration(tierConfig.Retention)})
+	}
+
+	for i := 0; i+1 < len(tiers); i++ {
+		retention, next := tiers[i].Retention, tiers[i+1].Interval
+		if retention > 0 && retention < next.Duration+time.Duration(c.AutoRollup.Grace) {
+			return nil, fmt.Errorf("tier %s retention must be at least the %s interval plus the grace period", tiers[i].Interval.Name, next.Name)
+		}
+	}
+
+	return tiers, nil
+}
+
+// AutoRollup rolls up the segments exported to store into every tier whose
+// windows have closed, then deletes the segments and windows past their
+// retention. A window is closed once the grace period has passed after its
+// end. The first tier is rolled up from the records of the segments, each
+// following tier from the windows of the tier before it.
+//
+// Every window is written once. Records exported after their window has
+// been written are left out of it and counted in the segment's marker, and
+// the segment is reported and kept past its retention instead of being
+// deleted. Runs are idempotent: an interrupted run is completed by the next
+// one, which may report the records of the interrupted run as late.
+func AutoRollup(store src.ObjectStore, config *Config, now time.Time) (*AutoRollupReport, error) {
+	tiers, err := config.RollupTiers()
+	if err != nil {
+		return nil, fmt.Errorf("error in autorollup settings: %w", err)
+	}
+
+	// Tier windows hold every aggregate, sketches included, so that they
+	// can be rolled up again
+	spec, err := config.RollupSpec()
+	if err != nil {
+		return nil, fmt.Errorf("error in rollup settings: %w", err)
+	}
+	spec.Aggregates = rollup.Aggregates
+
+	report := &AutoRollupReport{Windows: map[string]int{}, WindowsDeleted: map[string]int{}, FoldedSeries: map[string]int{}}
+
+	segments, markers, err := findSegments(store, tiers)
+	if err != nil {
+		return report, err
+	}
+
+	// The windows held before the run tell late records apart
+	written := make([]map[int64]bool, len(tiers))
+	for i, tier := range tiers {
+		windows, err := listTierWindows(store, tier)
+		if err != nil {
+			return report, err
+		}
+		written[i] = make(map[int64]bool, len(windows))
+		for _, window := range windows {
+			written[i][window.start.Unix()] = true
+		}
+	}
+
+	for i, tier := range tiers {
+		if i == 0 {
+			err = rollupSegments(store, config, spec, tiers, written, segments, markers, now, report)
+		} else {
+			err = rollupTier(store, config, spec, tiers[i-1], tier, written[i], now, report)
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+
+	// Retention only applies once everything due has been rolled up, and
+	// never to segments with late records
+	if config.AutoRollup.RawRetention > 0 {
+		var expired []string
+		for _, prefix := range segments {
+			if marker := markers[prefix]; marker != nil && !marker.Pending && marker.LateRecords == 0 {
+				expired = append(expired, prefix)
+			}
+		}
+		err = expireSegments(store, expired, time.Duration(config.AutoRollup.RawRetention), now, report)
+		if err != nil {
+			return report, err
+		}
+	}
+	for _, tier := range tiers {
+		err = expireTier(store, tier, now, report)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// findSegments returns the prefixes of the exported segments, which are
+// the top-level prefixes holding a manifest, and the rollup markers of the
+// segments that have one
+func findSegments(store src.ObjectStore, tiers []RollupTier) ([]string, map[string]*autoRollupMarker, error) {
+	prefixes, err := store.ListPrefixes("")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing exported segments: %w", err)
+	}
+
+	var segments []string
+	markers := make(map[string]*autoRollupMarker)
+	for _, prefix := range prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if tierPrefix(tiers, prefix) {
+			continue
+		}
+
+		_, err = store.Head(ManifestKey(prefix))
+		if errors.Is(err, src.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error looking up manifest of %s: %w", prefix, err)
+		}
+		segments = append(segments, prefix)
+
+		marker, err := readAutoRollupMarker(store, prefix)
+		if err != nil {
+			return nil, nil, err
+		}
+		if marker != nil {
+			markers[prefix] = marker
+		}
+	}
+
+	return segments, markers, nil
+}
+
+// readAutoRollupMarker loads the rollup marker of the segment under
+// prefix, or returns nil if it has none
+func readAutoRollupMarker(store src.ObjectStore, prefix string) (*autoRollupMarker, error) {
+	body, err := store.Get(path.Join(prefix, AutoRollupMarkerName))
+	if errors.Is(err, src.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error downloading rollup marker of %s: %w", prefix, err)
+	}
+	defer body.Close()
+
+	marker := &autoRollupMarker{}
+	err = json.NewDecoder(body).Decode(marker)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing rollup marker of %s: %w", prefix, err)
+	}
+	return marker, nil
+}
+
+// tierPrefix reports whether the windows of a tier are stored under prefix
+func tierPrefix(tiers []RollupTier, prefix string) bool {
+	for _, tier := range tiers {
+		if strings.HasPrefix(tier.Prefix+"/", prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// newTierEngine creates an engine rolling up rows holding the timestamp,
+// the tags and the values of spec, in that order, into interval
+func newTierEngine(spec rollup.Spec, interval rollup.Interval) (*rollup.Engine, error) {
+	spec.Intervals = []rollup.Interval{interval}
+
+	columns := []string{spec.Timestamp}
+	types := []sfm.Type{sfm.TypeTime}
+	for _, tag := range spec.Tags {
+		columns = append(columns, tag)
+		types = append(types, sfm.TypeString)
+	}
+	for _, value := range spec.Values {
+		columns = append(columns, value)
+		types = append(types, sfm.TypeFloat)
+	}
+
+	engine, err := rollup.NewEngine(spec, columns, types)
+	if err != nil {
+		return nil, fmt.Errorf("error in rollup settings: %w", err)
+	}
+	return engine, nil
+}
+
+// rollupSegments rolls up the records of every segment not yet completely
+// in the first tier, writes its closed windows and updates the markers of
+// the segments
+func rollupSegments(store src.ObjectStore, config *Config, spec rollup.Spec, tiers []RollupTier, written []map[int64]bool, segments []string, markers map[string]*autoRollupMarker, now time.Time, report *AutoRollupReport) error {
+	tier := tiers[0]
+	engine, err := newTierEngine(spec, tier.Interval)
+	if err != nil {
+		return err
+	}
+
+	// Windows starting before cutoff are closed
+	cutoff := tier.Interval.Start(now.Add(-time.Duration(config.AutoRollup.Grace)))
+
+	// Unreadable segments are retried by the next run
+	var sources []*segmentSource
+	for _, prefix := range segments {
+		marker := markers[prefix]
+		if marker != nil && !marker.Pending {
+			continue
+		}
+		source, err := openSegment(store, config, prefix, spec)
+		if err != nil {
+			log.Printf("Error rolling up segment %s: %v", prefix, err)
+			continue
+		}
+		sources = append(sources, source)
+	}
+
+	// Segments are added in time order rather than by name, so that the
+	// engine sees the records of a series in order
+	sort.SliceStable(sources, func(i, j int) bool {
+		a, b := sources[i].start, sources[j].start
+		return !a.IsZero() && (b.IsZero() || a.Before(b))
+	})
+
+	updated := make(map[string]*autoRollupMarker)
+	for _, source := range sources {
+		prefix := source.prefix
+		marker := markers[prefix]
+
+		segment := &segmentRollup{tiers: tiers, written: written, cutoff: cutoff}
+		if marker != nil {
+			segment.from, segment.late = marker.Through, marker.LateRecords
+		}
+		if segment.cutoff.Before(segment.from) {
+			segment.cutoff = segment.from
+		}
+		late := segment.late
+
+		err := rollupSegment(store, source, engine, segment)
+		if err != nil {
+			log.Printf("Error rolling up segment %s: %v", prefix, err)
+			continue
+		}
+		report.SegmentsRead++
+
+		if segment.late > late {
+			log.Printf("Left %d records of segment %s out of windows that were already written", segment.late-late, prefix)
+			report.LateSegments = append(report.LateSegments, prefix)
+			report.LateRecords += segment.late - late
+		}
+		updated[prefix] = &autoRollupMarker{
+			Tier:        tier.Interval.Name,
+			RolledUpAt:  now,
+			Through:     segment.cutoff,
+			Pending:     segment.pending,
+			LateRecords: segment.late,
+		}
+	}
+	if n := engine.OutOfOrder(); n > 0 {
+		log.Printf("Left %d out-of-order counter samples out of the %s rollups", n, tier.Interval.Name)
+	}
+	report.FoldedSeries[tier.Interval.Name] = engine.Folded()
+
+	err = writeTierWindows(store, config, engine, tier, written[0], now, report)
+	if err != nil {
+		return err
+	}
+
+	// Markers are updated once the windows have been written
+	for _, prefix := range segments {
+		marker, ok := updated[prefix]
+		if !ok {
+			continue
+		}
+		data, err := json.Marshal(marker)
+		if err != nil {
+			return fmt.Errorf("error marshaling rollup marker: %w", err)
+		}
+		err = store.Put(path.Join(prefix, AutoRollupMarkerName), bytes.NewReader(data), src.PutOptions{ContentType: "application/json"})
+		if err != nil {
+			return fmt.Errorf("error uploading rollup marker: %w", err)
+		}
+		markers[prefix] = marker
+	}
+
+	return nil
+}
+
+// errStopReading stops reading a batch early
+var errStopReading = errors.New("stop reading")
+
+// segmentSource is an exported segment whose records are rolled up
+type segmentSource struct {
+	prefix   string
+	manifest *Manifest
+	// columns are the indexes of the engine row columns among the exported ones
+	columns []int
+	// start is the timestamp of the first record, zero if no record has one
+	start time.Time
+}
+
+// openSegment reads the manifest of the segment under prefix and the
+// timestamp of its first record. The columns of spec are found by the names
+// they were exported under.
+func openSegment(store src.ObjectStore, config *Config, prefix string, spec rollup.Spec) (*segmentSource, error) {
+	manifest, err := ReadManifest(store, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.ColumnTypes) != len(manifest.Columns) {
+		return nil, fmt.Errorf("manifest has no column types")
+	}
+
+	// Find the columns of the engine rows among the exported columns
+	indexes := make(map[string]int, len(manifest.Columns))
+	for i, column := range manifest.Columns {
+		indexes[column] = i
+	}
+	names := append(append([]string{spec.Timestamp}, spec.Tags...), spec.Values...)
+	columns := make([]int, len(names))
+	for i, name := range names {
+		exported := name
+		if renamed, ok := config.Columns.Rename[name]; ok {
+			exported = renamed
+		}
+		index, ok := indexes[exported]
+		if !ok {
+			return nil, fmt.Errorf("column %q was not exported", name)
+		}
+		columns[i] = index
+	}
+	if manifest.ColumnTypes[columns[0]] != sfm.TypeTime {
+		return nil, fmt.Errorf("timestamp column %q is of type %s, expected time", spec.Timestamp, manifest.ColumnTypes[columns[0]])
+	}
+
+	source := &segmentSource{prefix: prefix, manifest: manifest, columns: columns}
+
+	// Records are in time order within a segment, so the first one with a
+	// timestamp starts its time range
+	first := func(record []interface{}) error {
+		t, ok := record[columns[0]].(time.Time)
+		if !ok {
+			return nil
+		}
+		source.start = t
+		return errStopReading
+	}
+	for _, batch := range manifest.Batches {
+		err = readBatch(store, batch.Key, manifest.Format, manifest.Columns, manifest.ColumnTypes, first)
+		if errors.Is(err, errStopReading) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return source, nil
+}
+
+// rollupSegment adds the records of source accepted by segment to engine
+func rollupSegment(store src.ObjectStore, source *segmentSource, engine *rollup.Engine, segment *segmentRollup) error {
+	columns := source.columns
+	add := func(record []interface{}) error {
+		// Records without a timestamp are left out, as in export rollups
+		t, ok := record[columns[0]].(time.Time)
+		if !ok || !segment.accept(t) {
+			return nil
+		}
+
+		row := make([]interface{}, len(columns))
+		for i, index := range columns {
+			row[i] = record[index]
+		}
+		return engine.Add(row)
+	}
+
+	manifest := source.manifest
+	for _, batch := range manifest.Batches {
+		err := readBatch(store, batch.Key, manifest.Format, manifest.Columns, manifest.ColumnTypes, add)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rollupTier rolls up the windows of the lower tier into the closed
+// windows of tier that are not done yet
+func rollupTier(store src.ObjectStore, config *Config, spec rollup.Spec, lower, tier RollupTier, done map[int64]bool, now time.Time, report *AutoRollupReport) error {
+	engine, err := newTierEngine(spec, tier.Interval)
+	if err != nil {
+		return err
+	}
+	windows, err := listTierWindows(store, lower)
+	if err != nil {
+		return err
+	}
+
+	columns, types := engine.Columns(), engine.Types()
+	for _, window := range windows {
+		start := tier.Interval.Start(window.start)
+		if done[start.Unix()] || !windowClosed(tier, start, time.Duration(config.AutoRollup.Grace), now) {
+			continue
+		}
+
+		err = readBatch(store, window.key, windowFormat(window.key), columns, types, engine.AddRow)
+		if err != nil {
+			return err
+		}
+	}
+
+	report.FoldedSeries[tier.Interval.Name] = engine.Folded()
+	return writeTierWindows(store, config, engine, tier, done, now, report)
+}
+
+// windowClosed reports whether the grace period after the window of tier
+// starting at start has passed
+func windowClosed(tier RollupTier, start time.Time, grace time.Duration, now time.Time) bool {
+	return !start.Add(tier.Interval.Duration + grace).After(now)
+}
+
+// writeTierWindows uploads every closed window of engine that is not done
+// yet, as one object per window in the output format
+func writeTierWindows(store src.ObjectStore, config *Config, engine *rollup.Engine, tier RollupTier, done map[int64]bool, now time.Time, report *AutoRollupReport) error {
+	// Windows are written whole; the column settings only apply to raw
+	// records
+	encoder, err := newRecordEncoder(engine.Columns(), engine.Types(), &Config{})
+	if err != nil {
+		return err
+	}
+	format, err := newOutputFormat(config, encoder)
+	if err != nil {
+		return err
+	}
+	codec, err := batchCodec(config, format)
+	if err != nil {
+		return err
+	}
+
+	// Rows are ordered by window start
+	rows := engine.Rows(0)
+	for len(rows) > 0 {
+		start := rows[0][0].(time.Time)
+		end := 1
+		for end < len(rows) && rows[end][0].(time.Time).Equal(start) {
+			end++
+		}
+		window := rows[:end]
+		rows = rows[end:]
+
+		if done[start.Unix()] || !windowClosed(tier, start, time.Duration(config.AutoRollup.Grace), now) {
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%s%s", tier.Prefix, start.Format(tierTimeLayout), batchExtension(format, codec))
+		err = writeTierWindow(store, format, codec, key, window)
+		if err != nil {
+			return err
+		}
+		report.Windows[tier.Interval.Name]++
+	}
+
+	return nil
+}
+
+// writeTierWindow uploads the rows of one window under key
+func writeTierWindow(store src.ObjectStore, format outputFormat, codec src.Codec, key string, rows [][]interface{}) error {
+	newBuffer := func(num int) (batchBuffer, error) { return &memoryBuffer{}, nil }
+	writer := newBatchWriter(format, codec, batchLimits{}, 0, newBuffer)
+	for _, row := range rows {
+		_, err := writer.write(row, sfm.Position{})
+		if err != nil {
+			writer.abort()
+			return err
+		}
+	}
+
+	batch, err := writer.close()
+	if err != nil {
+		return err
+	}
+	_, err = uploadBatch(store, key, format, codec, batch)
+	batch.buffer.remove()
+	return err
+}
+
+// windowFormat returns the format a window object was written in, from the
+// extension of its key, so that windows written before a change of the
+// output format are still read
+func windowFormat(key string) string {
+	if codec := src.CodecFor(key); codec != nil {
+		key = strings.TrimSuffix(key, codec.Extension())
+	}
+	switch path.Ext(key) {
+	case ".parquet":
+		return "parquet"
+	case ".csv":
+		return "csv"
+	}
+	return "ndjson"
+}
+
+// listTierWindows returns the windows held by tier, ordered by start
+func listTierWindows(store src.ObjectStore, tier RollupTier) ([]tierWindow, error) {
+	objects, err := store.List(tier.Prefix + "/")
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s rollups: %w", tier.Interval.Name, err)
+	}
+
+	var windows []tierWindow
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, tier.Prefix+"/")
+		if len(name) < len(tierTimeLayout) {
+			continue
+		}
+		start, err := time.Parse(tierTimeLayout, name[:len(tierTimeLayout)])
+		if err != nil {
+			continue
+		}
+		windows = append(windows, tierWindow{start: start, key: object.Key})
+	}
+
+	return windows, nil
+}
+
+// expireSegments deletes the segments exported more than retention before
+// now. The manifest is deleted after the batches, so that the next run
+// finishes an interrupted deletion.
+func expireSegments(store src.ObjectStore, segments []string, retention time.Duration, now time.Time, report *AutoRollupReport) error {
+	for _, prefix := range segments {
+		manifest, err := ReadManifest(store, prefix)
+		if err != nil {
+			return fmt.Errorf("error reading manifest of %s: %w", prefix, err)
+		}
+		if manifest.RunTimestamp.Add(retention).After(now) {
+			continue
+		}
+
+		objects, err := store.List(prefix + "/")
+		if err != nil {
+			return fmt.Errorf("error listing segment %s: %w", prefix, err)
+		}
+		last := []string{ManifestKey(prefix), path.Join(prefix, AutoRollupMarkerName)}
+		for _, object := range objects {
+			if object.Key == last[0] || object.Key == last[1] {
+				continue
+			}
+			err = store.Delete(object.Key)
+			if err != nil {
+				return fmt.Errorf("error deleting %s: %w", object.Key, err)
+			}
+		}
+		for _, key := range last {
+			err = store.Delete(key)
+			if err != nil {
+				return fmt.Errorf("error deleting %s: %w", key, err)
+			}
+		}
+
+		report.SegmentsDeleted++
+	}
+
+	return nil
+}
+
+// expireTier deletes the windows of tier that ended more than its retention
+// before now
+func expireTier(store src.ObjectStore, tier RollupTier, now time.Time, report *AutoRollupReport) error {
+	if tier.Retention == 0 {
+		return nil
+	}
+
+	windows, err := listTierWindows(store, tier)
+	if err != nil {
+		return err
+	}
+	for _, window := range windows {
+		if window.start.Add(tier.Interval.Duration + tier.Retention).After(now) {
+			break
+		}
+		err = store.Delete(window.key)
+		if err != nil {
+			return fmt.Errorf("error deleting %s: %w", window.key, err)
+		}
+		report.WindowsDeleted[tier.Interval.Name]++
+	}
+
+	return nil
+}
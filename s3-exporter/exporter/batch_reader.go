@@ -0,0 +1,272 @@
+package exporter
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+
+	"s3-exporter/sfm"
+	"s3-exporter/src"
+)
+
+// readBatch reads back the records of an uploaded batch written in format
+// and passes them to fn, typed with the given columns and types. Values
+// that do not convert to their column type are read as nulls.
+func readBatch(store src.ObjectStore, key, format string, columns []string, types []sfm.Type, fn func(record []interface{}) error) error {
+	body, err := store.Get(key)
+	if err != nil {
+		return fmt.Errorf("error downloading batch %s: %w", key, err)
+	}
+	defer body.Close()
+
+	// Batches are decompressed by the codec of their extension
+	var reader io.Reader = body
+	if codec := src.CodecFor(key); codec != nil {
+		decompressed, err := codec.NewReader(body)
+		if err != nil {
+			return fmt.Errorf("error decompressing batch %s: %w", key, err)
+		}
+		defer decompressed.Close()
+		reader = decompressed
+	}
+
+	switch format {
+	case "", "ndjson", "json_array":
+		err = readJSONRecords(reader, columns, types, fn)
+	case "csv":
+		err = readCSVRecords(reader, columns, types, fn)
+	case "parquet":
+		err = readParquetRecords(reader, columns, types, fn)
+	default:
+		return fmt.Errorf("batches in the %s format cannot be read back", format)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading batch %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// readJSONRecords reads newline-delimited JSON objects, or the elements of
+// a JSON array, told apart by the first character
+func readJSONRecords(r io.Reader, columns []string, types []sfm.Type, fn func(record []interface{}) error) error {
+	buffered := bufio.NewReader(r)
+	array := false
+	for {
+		c, err := buffered.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			array = c == '['
+			buffered.UnreadByte()
+			break
+		}
+	}
+
+	decoder := json.NewDecoder(buffered)
+	decoder.UseNumber()
+
+	// Skip the opening bracket of an array
+	if array {
+		_, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+	}
+
+	for !array || decoder.More() {
+		object := make(map[string]interface{}, len(columns))
+		err := decoder.Decode(&object)
+		if err == io.EOF && !array {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		record := make([]interface{}, len(columns))
+		for i, column := range columns {
+			record[i] = jsonValue(object[column], types[i])
+		}
+
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// jsonValue converts a decoded JSON value to a value of type t
+func jsonValue(value interface{}, t sfm.Type) interface{} {
+	switch v := value.(type) {
+	case string:
+		return typedValue(v, t)
+	case json.Number:
+		return typedValue(v.String(), t)
+	case bool:
+		return typedValue(strconv.FormatBool(v), t)
+	}
+	return nil
+}
+
+// readCSVRecords reads CSV rows, matching columns by the header row
+func readCSVRecords(r io.Reader, columns []string, types []sfm.Type, fn func(record []interface{}) error) error {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Find every column in the header, -1 if missing
+	indexes := make([]int, len(columns))
+	for i, column := range columns {
+		indexes[i] = -1
+		for j, name := range header {
+			if name == column {
+				indexes[i] = j
+				break
+			}
+		}
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		record := make([]interface{}, len(columns))
+		for i, index := range indexes {
+			if index >= 0 && index < len(row) {
+				record[i] = typedValue(row[index], types[i])
+			}
+		}
+
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parquetReadRows is the number of rows read from every Parquet column at once
+const parquetReadRows = 1024
+
+// readParquetRecords reads the rows of a Parquet file, matching columns by
+// name. The file is read into memory, as its footer comes last.
+func readParquetRecords(r io.Reader, columns []string, types []sfm.Type, fn func(record []interface{}) error) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	parquetReader, err := reader.NewParquetColumnReader(buffer.NewBufferFileFromBytes(data), 1)
+	if err != nil {
+		return err
+	}
+	defer parquetReader.ReadStop()
+
+	// Find every column among the leaves of the schema by its external
+	// name, -1 if missing. The first schema element is the root.
+	indexes := make([]int64, len(columns))
+	for i, column := range columns {
+		indexes[i] = -1
+		for j, info := range parquetReader.SchemaHandler.Infos[1:] {
+			if info.ExName == column {
+				indexes[i] = int64(j)
+				break
+			}
+		}
+	}
+
+	values := make([][]interface{}, len(columns))
+	for remaining := parquetReader.GetNumRows(); remaining > 0; {
+		n := min(remaining, parquetReadRows)
+		for i, index := range indexes {
+			if index < 0 {
+				values[i] = nil
+				continue
+			}
+			values[i], _, _, err = parquetReader.ReadColumnByIndex(index, n)
+			if err != nil {
+				return err
+			}
+			if int64(len(values[i])) != n {
+				return fmt.Errorf("column %s holds %d rows, expected %d", columns[i], len(values[i]), n)
+			}
+		}
+
+		for row := int64(0); row < n; row++ {
+			record := make([]interface{}, len(columns))
+			for i := range columns {
+				if values[i] != nil {
+					record[i] = parquetRecordValue(values[i][row], types[i])
+				}
+			}
+
+			err = fn(record)
+			if err != nil {
+				return err
+			}
+		}
+		remaining -= n
+	}
+
+	return nil
+}
+
+// parquetRecordValue converts a value read from a Parquet column to a
+// value of type t. Times are stored as milliseconds since the epoch.
+func parquetRecordValue(value interface{}, t sfm.Type) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case int64:
+		if t == sfm.TypeTime {
+			return time.UnixMilli(v).UTC()
+		}
+		if t == sfm.TypeInt {
+			return v
+		}
+	case float64:
+		if t == sfm.TypeFloat {
+			return v
+		}
+	case bool:
+		if t == sfm.TypeBool {
+			return v
+		}
+	case string:
+		return typedValue(v, t)
+	}
+	return typedValue(fmt.Sprint(value), t)
+}
+
+// typedValue converts a field to type t, or returns nil if it does not convert
+func typedValue(field string, t sfm.Type) interface{} {
+	value, err := t.Convert(field)
+	if err != nil {
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,360 @@
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"s3-exporter/sfm"
+	"s3-exporter/src"
+)
+
+// batchLimits are the sizes at which a batch is closed and the next one
+// started. Zero limits are not checked; when several are set the batch is
+// closed as soon as any of them is reached.
+type batchLimits struct {
+	records int
+	// bytes is the size of the encoded batch before compression
+	bytes int64
+	// compressedBytes is the size of the stored object. Codecs hold some
+	// input back before they emit output, so batches may go over it by up
+	// to what the codec buffers.
+	compressedBytes int64
+}
+
+// batchLimitsFor returns the batch limits set in config
+func batchLimitsFor(config *Config) batchLimits {
+	return batchLimits{
+		records:         config.Export.BatchSize,
+		bytes:           config.Export.BatchBytes,
+		compressedBytes: config.Export.BatchCompressedBytes,
+	}
+}
+
+// reached reports whether a batch of the given size is full
+func (l batchLimits) reached(records int, bytes, compressedBytes int64) bool {
+	return (l.records > 0 && records >= l.records) ||
+		(l.bytes > 0 && bytes >= l.bytes) ||
+		(l.compressedBytes > 0 && compressedBytes >= l.compressedBytes)
+}
+
+// countingWriter counts the bytes written through it. Codecs may write from
+// goroutines of their own, so the count is kept atomically.
+type countingWriter struct {
+	n atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// batchBuffer receives the stored bytes of a batch and gets them into the
+// object store
+type batchBuffer interface {
+	io.Writer
+	// finish is called once the batch is complete
+	finish() error
+	// upload stores the finished batch under key. Buffers that stream the
+	// batch into its object as it is written wait for that upload to end.
+	upload(store src.ObjectStore, key string, opts src.PutOptions) error
+	// remove discards the batch
+	remove()
+}
+
+// errUploadAborted is given to the store when a streamed batch is discarded
+// before it is complete
+var errUploadAborted = errors.New("upload aborted")
+
+// streamBuffer uploads a batch while it is written. The store reads the
+// other end of a pipe, so apart from the codec's and the store's own part
+// buffers nothing of the batch is held in memory or written to disk. The
+// upload may still be running once the batch is finished; it is waited for
+// in upload, so the next batch can be written in the meantime. A streamed
+// body cannot be rewound, so a RetryingStore does not retry it and S3Store
+// retries its parts itself.
+type streamBuffer struct {
+	writer *io.PipeWriter
+	// done receives the result of the upload, which is kept in err
+	done chan error
+	err  error
+}
+
+// newStreamBuffer starts the upload of a batch under key
+func newStreamBuffer(store src.ObjectStore, key string, opts src.PutOptions) *streamBuffer {
+	reader, writer := io.Pipe()
+	b := &streamBuffer{writer: writer, done: make(chan error, 1)}
+
+	go func() {
+		err := store.Put(key, reader, opts)
+		// Unblock the batch writer if the upload stopped reading early
+		if err != nil {
+			reader.CloseWithError(err)
+		} else {
+			reader.CloseWithError(errUploadAborted)
+		}
+		b.done <- err
+	}()
+
+	return b
+}
+
+func (b *streamBuffer) Write(p []byte) (int, error) {
+	return b.writer.Write(p)
+}
+
+func (b *streamBuffer) finish() error {
+	return b.writer.Close()
+}
+
+func (b *streamBuffer) upload(src.ObjectStore, string, src.PutOptions) error {
+	return b.wait()
+}
+
+func (b *streamBuffer) remove() {
+	b.writer.CloseWithError(errUploadAborted)
+	b.wait()
+}
+
+// wait waits for the upload to end and returns its result
+func (b *streamBuffer) wait() error {
+	if b.done != nil {
+		b.err = <-b.done
+		b.done = nil
+	}
+	return b.err
+}
+
+// memoryBuffer keeps a batch in memory. It is only used for small objects,
+// such as the windows of rollup tiers.
+type memoryBuffer struct {
+	bytes.Buffer
+}
+
+func (b *memoryBuffer) finish() error { return nil }
+
+func (b *memoryBuffer) upload(store src.ObjectStore, key string, opts src.PutOptions) error {
+	return store.Put(key, bytes.NewReader(b.Bytes()), opts)
+}
+
+func (b *memoryBuffer) remove() { b.Reset() }
+
+// fileBuffer keeps a batch in a temporary file
+type fileBuffer struct {
+	*os.File
+}
+
+// newFileBuffer creates a temporary file for a batch in dir
+func newFileBuffer(dir, pattern string) (*fileBuffer, error) {
+	file, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("error creating batch file: %w", err)
+	}
+	return &fileBuffer{File: file}, nil
+}
+
+func (b *fileBuffer) finish() error {
+	err := b.Close()
+	if err != nil {
+		return fmt.Errorf("error closing batch file: %w", err)
+	}
+	return nil
+}
+
+func (b *fileBuffer) upload(store src.ObjectStore, key string, opts src.PutOptions) error {
+	file, err := os.Open(b.Name())
+	if err != nil {
+		return fmt.Errorf("error opening batch file: %w", err)
+	}
+	defer file.Close()
+
+	return store.Put(key, file, opts)
+}
+
+func (b *fileBuffer) remove() {
+	b.Close()
+	CleanupTempFiles([]string{b.Name()})
+}
+
+// writtenBatch is a complete batch, ready to be uploaded
+type writtenBatch struct {
+	num     int
+	records int
+	buffer  batchBuffer
+	// size and checksum are those of the stored bytes
+	size     int64
+	checksum string
+	// end is the position just after the last record of the batch
+	end sfm.Position
+	// nulled is the number of values written as null because they did
+	// not match their column type
+	nulled int
+}
+
+// batchWriter encodes records in the output format, compresses them with
+// codec if not nil and splits them into batches according to limits. Each
+// batch is written to a buffer from newBuffer as the records arrive.
+type batchWriter struct {
+	format    outputFormat
+	codec     src.Codec
+	limits    batchLimits
+	newBuffer func(num int) (batchBuffer, error)
+	next      int
+
+	// The open batch; buffer is nil between batches
+	buffer     batchBuffer
+	buffered   *bufio.Writer
+	compressor io.WriteCloser
+	writer     recordWriter
+	hash       hash.Hash
+	encoded    *countingWriter
+	stored     *countingWriter
+	records    int
+	end        sfm.Position
+}
+
+// newBatchWriter creates a batch writer whose first batch is number firstBatch
+func newBatchWriter(format outputFormat, codec src.Codec, limits batchLimits, firstBatch int, newBuffer func(num int) (batchBuffer, error)) *batchWriter {
+	return &batchWriter{
+		format:    format,
+		codec:     codec,
+		limits:    limits,
+		newBuffer: newBuffer,
+		next:      firstBatch,
+	}
+}
+
+// write adds a record that ends at end in the segment file. It returns the
+// batch the record completed, or nil if the batch is still open.
+func (w *batchWriter) write(record []interface{}, end sfm.Position) (*writtenBatch, error) {
+	if w.buffer == nil {
+		err := w.start()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := w.writer.write(record)
+	if err != nil {
+		return nil, err
+	}
+	w.records++
+	w.end = end
+
+	// Compare the batch size with the limits, counting what the format
+	// has not written yet
+	pending := w.writer.pending()
+	encoded := w.encoded.n.Load() + pending
+	stored := w.stored.n.Load()
+	if w.codec == nil {
+		stored += pending
+	}
+	if !w.limits.reached(w.records, encoded, stored) {
+		return nil, nil
+	}
+
+	return w.finish()
+}
+
+// close completes the open batch. It returns nil if no batch is open.
+func (w *batchWriter) close() (*writtenBatch, error) {
+	if w.buffer == nil {
+		return nil, nil
+	}
+	return w.finish()
+}
+
+// abort discards the open batch
+func (w *batchWriter) abort() {
+	if w.buffer == nil {
+		return
+	}
+	if w.compressor != nil {
+		w.compressor.Close()
+	}
+	w.buffer.remove()
+	w.buffer = nil
+}
+
+// start opens the next batch
+func (w *batchWriter) start() error {
+	buffer, err := w.newBuffer(w.next)
+	if err != nil {
+		return err
+	}
+
+	w.buffer = buffer
+	w.buffered = bufio.NewWriter(buffer)
+	w.hash = sha256.New()
+	w.encoded = &countingWriter{}
+	w.stored = &countingWriter{}
+	w.compressor = nil
+	w.records = 0
+
+	// Stored bytes are counted and hashed on their way to the buffer, and
+	// encoded bytes on their way to the codec
+	var out io.Writer = io.MultiWriter(w.buffered, w.hash, w.stored)
+	if w.codec != nil {
+		w.compressor, err = w.codec.NewWriter(out)
+		if err != nil {
+			w.abort()
+			return fmt.Errorf("error creating %s writer: %w", w.codec.Name(), err)
+		}
+		out = w.compressor
+	}
+
+	w.writer, err = w.format.newWriter(io.MultiWriter(out, w.encoded))
+	if err != nil {
+		w.abort()
+		return err
+	}
+
+	return nil
+}
+
+// finish completes the open batch
+func (w *batchWriter) finish() (*writtenBatch, error) {
+	err := w.writer.close()
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+
+	if w.compressor != nil {
+		err = w.compressor.Close()
+		w.compressor = nil
+		if err != nil {
+			w.abort()
+			return nil, fmt.Errorf("error closing %s writer: %w", w.codec.Name(), err)
+		}
+	}
+
+	err = w.buffered.Flush()
+	if err == nil {
+		err = w.buffer.finish()
+	}
+	if err != nil {
+		w.abort()
+		return nil, fmt.Errorf("error writing batch: %w", err)
+	}
+
+	batch := &writtenBatch{
+		num:      w.next,
+		records:  w.records,
+		buffer:   w.buffer,
+		size:     w.stored.n.Load(),
+		checksum: "sha256:" + hex.EncodeToString(w.hash.Sum(nil)),
+		end:      w.end,
+	}
+	w.buffer = nil
+	w.next++
+
+	return batch, nil
+}
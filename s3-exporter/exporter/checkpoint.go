@@ -0,0 +1,174 @@
+package exporter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"s3-exporter/sfm"
+	"s3-exporter/src"
+)
+
+// checkpointDir is the directory inside the state directory holding checkpoints
+const checkpointDir = "checkpoints"
+
+// Checkpoint records how far the export of a segment file got, so that a
+// failed export can resume after the last uploaded batch instead of
+// starting over
+type Checkpoint struct {
+	SourceFile    string    `json:"source_file"`
+	SourceSize    int64     `json:"source_size"`
+	SourceModTime time.Time `json:"source_mod_time"`
+	RunTimestamp  time.Time `json:"run_timestamp"`
+	// NextBatch is the number of the next batch to upload
+	NextBatch int `json:"next_batch"`
+	// Offset is the byte offset in the segment file just after the last
+	// record of the last uploaded batch
+	Offset int64 `json:"offset"`
+	// Line is the number of lines before Offset
+	Line int `json:"line"`
+	// ColumnTypes are the column types used for the batches uploaded so
+	// far, so that a resumed export does not infer different ones
+	ColumnTypes []sfm.Type `json:"column_types,omitempty"`
+	// Batches are the manifest entries of the batches uploaded so far
+	Batches []ManifestBatch `json:"batches"`
+	// Settings are the export settings the batches were written with
+	Settings CheckpointSettings `json:"settings"`
+}
+
+// CheckpointSettings are the export settings that shape the batches of an
+// export. An export resumed with different settings would mix batches of
+// both, so it starts over instead.
+type CheckpointSettings struct {
+	Format               string `json:"format"`
+	BatchSize            int    `json:"batch_size"`
+	BatchBytes           int64  `json:"batch_bytes"`
+	BatchCompressedBytes int64  `json:"batch_compressed_bytes"`
+	Compression          bool   `json:"compression"`
+	Codec                string `json:"codec"`
+}
+
+// checkpointSettings returns the settings of config recorded in checkpoints
+func checkpointSettings(config *Config) CheckpointSettings {
+	return CheckpointSettings{
+		Format:               config.Export.Format,
+		BatchSize:            config.Export.BatchSize,
+		BatchBytes:           config.Export.BatchBytes,
+		BatchCompressedBytes: config.Export.BatchCompressedBytes,
+		Compression:          config.Export.Compression,
+		Codec:                config.Export.Codec,
+	}
+}
+
+// checkpointPath returns the checkpoint file for a segment file
+func checkpointPath(stateDir, sfmFile string) (string, error) {
+	path, err := filepath.Abs(sfmFile)
+	if err != nil {
+		return "", fmt.Errorf("error resolving segment path: %w", err)
+	}
+
+	// Segments in different directories may share a base name
+	sum := sha256.Sum256([]byte(path))
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	name := fmt.Sprintf("%s-%s.json", base, hex.EncodeToString(sum[:8]))
+	return filepath.Join(stateDir, checkpointDir, name), nil
+}
+
+// LoadCheckpoint returns the checkpoint of an interrupted export of sfmFile,
+// or nil if there is none. Checkpoints taken before the segment file was
+// modified are discarded.
+func LoadCheckpoint(stateDir, sfmFile string) (*Checkpoint, error) {
+	path, err := checkpointPath(stateDir, sfmFile)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading checkpoint: %w", err)
+	}
+
+	checkpoint := &Checkpoint{}
+	err = json.Unmarshal(data, checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing checkpoint %s: %w", path, err)
+	}
+
+	info, err := os.Stat(sfmFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SFM file info: %w", err)
+	}
+	if info.Size() != checkpoint.SourceSize || !info.ModTime().Equal(checkpoint.SourceModTime) {
+		return nil, RemoveCheckpoint(stateDir, sfmFile)
+	}
+
+	return checkpoint, nil
+}
+
+// SaveCheckpoint atomically replaces the checkpoint of a segment file
+func SaveCheckpoint(stateDir string, checkpoint *Checkpoint) error {
+	path, err := checkpointPath(stateDir, checkpoint.SourceFile)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating checkpoint directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling checkpoint: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing checkpoint: %w", err)
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return fmt.Errorf("error replacing checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveCheckpoint deletes the checkpoint of a segment file, if any
+func RemoveCheckpoint(stateDir, sfmFile string) error {
+	path, err := checkpointPath(stateDir, sfmFile)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error removing checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// discardCheckpoint deletes the batches uploaded by a checkpointed export,
+// then its checkpoint
+func discardCheckpoint(stateDir string, store src.ObjectStore, checkpoint *Checkpoint) error {
+	for _, batch := range checkpoint.Batches {
+		err := store.Delete(batch.Key)
+		if err != nil {
+			return fmt.Errorf("error removing batch of discarded checkpoint: %w", err)
+		}
+	}
+	return RemoveCheckpoint(stateDir, checkpoint.SourceFile)
+}
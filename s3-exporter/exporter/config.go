@@ -3,8 +3,13 @@ package exporter
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v2"
+
+	"s3-exporter/rollup"
+	"s3-exporter/sfm"
+	"s3-exporter/src"
 )
 
 // Config holds all configuration for the S3 exporter
@@ -12,43 +17,293 @@ type Config struct {
 	S3 struct {
 		Region    string `yaml:"region"`
 		Bucket    string `yaml:"bucket"`
-		AccessKey string `yaml:"access_key"`
-		SecretKey string `yaml:"secret_key"`
+		AccessKey string `yaml:"access_key"` // deprecated, prefer the AWS credential chain
+		SecretKey string `yaml:"secret_key"` // deprecated, prefer the AWS credential chain
+
+		// Credential chain settings; env vars, instance roles and web
+		// identity tokens from the environment are picked up automatically
+		Profile              string `yaml:"profile"`
+		RoleARN              string `yaml:"role_arn"`
+		ExternalID           string `yaml:"external_id"`
+		RoleSessionName      string `yaml:"role_session_name"`
+		WebIdentityTokenFile string `yaml:"web_identity_token_file"`
+
+		// Settings for S3-compatible services (MinIO, Ceph, LocalStack)
+		Endpoint       string `yaml:"endpoint"`
+		ForcePathStyle bool   `yaml:"force_path_style"`
+		DisableSSL     bool   `yaml:"disable_ssl"`
+		CABundle       string `yaml:"ca_bundle"`
+
+		// Multipart upload tuning
+		PartSizeMB  int64 `yaml:"part_size_mb"`
+		Concurrency int   `yaml:"concurrency"`
 	} `yaml:"s3"`
 
+	Storage struct {
+		Backend  string `yaml:"backend"`   // s3, local or memory
+		LocalDir string `yaml:"local_dir"` // root directory for the local backend
+	} `yaml:"storage"`
+
+	Source struct {
+		Delimiter string `yaml:"delimiter"` // comma, tab, pipe or a single character
+	} `yaml:"source"`
+
+	Types struct {
+		Infer      bool   `yaml:"infer"`       // infer undeclared column types from a sample of rows, off by default
+		SampleRows int    `yaml:"sample_rows"` // rows sampled for inference
+		OnError    string `yaml:"on_error"`    // null, string, skip or fail for values that do not match their type
+	} `yaml:"types"`
+
+	Columns struct {
+		Include []string          `yaml:"include"` // columns to export, all if empty
+		Exclude []string          `yaml:"exclude"` // columns to drop
+		Rename  map[string]string `yaml:"rename"`  // output names by column name
+	} `yaml:"columns"`
+
 	Export struct {
-		BatchSize   int    `yaml:"batch_size"`
-		Compression bool   `yaml:"compression"`
-		TempDir     string `yaml:"temp_dir"`
+		// Batch rotation; a batch is closed as soon as it reaches any limit
+		BatchSize            int   `yaml:"batch_size"`             // records per batch, 0 for no limit
+		BatchBytes           int64 `yaml:"batch_bytes"`            // encoded bytes per batch before compression, 0 for no limit
+		BatchCompressedBytes int64 `yaml:"batch_compressed_bytes"` // stored bytes per batch, 0 for no limit
+
+		TempDir string `yaml:"temp_dir"`
+		Mode    string `yaml:"mode"` // stream, or tempfile to stage batches in TempDir
+
+		// Compression of whole batches
+		Compression      bool   `yaml:"compression"`
+		Codec            string `yaml:"codec"`              // gzip, zlib, zstd, snappy or lz4
+		CompressionLevel int    `yaml:"compression_level"`  // 0 for the codec's default
+		GzipConcurrency  int    `yaml:"gzip_concurrency"`   // gzip blocks compressed in parallel, 0 for one per CPU
+		GzipBlockSizeKB  int    `yaml:"gzip_block_size_kb"` // input per gzip block
+
+		// Output format
+		Format       string `yaml:"format"`         // ndjson, json_array, csv or parquet
+		RowGroupRows int    `yaml:"row_group_rows"` // parquet rows per row group, batch_size if 0
+
+		// Concurrency
+		Workers       int `yaml:"workers"`        // segment files exported in parallel
+		PipelineDepth int `yaml:"pipeline_depth"` // batches buffered between pipeline stages
 	} `yaml:"export"`
 
+	Rollup struct {
+		Enabled    bool     `yaml:"enabled"`
+		Timestamp  string   `yaml:"timestamp"`  // time column the windows are based on
+		Values     []string `yaml:"values"`     // int or float columns to aggregate
+		Tags       []string `yaml:"tags"`       // columns identifying a series
+		MaxSeries  int      `yaml:"max_series"` // series kept before the rest are folded into __other__, 0 for no cap
+		Intervals  []string `yaml:"intervals"`  // window lengths, e.g. 1m, 5m, 1h, 1d
+		Aggregates []string `yaml:"aggregates"` // count, sum, min, max, avg, first, last, p50, p95, p99, sketch
+		Output     string   `yaml:"output"`     // alongside or instead of the raw rows
+
+		// Metric kinds of value columns: gauge (the default), counter or delta
+		Kinds map[string]string `yaml:"kinds"`
+
+		SketchAccuracy float64 `yaml:"sketch_accuracy"` // relative accuracy of percentiles and sketches
+	} `yaml:"rollup"`
+
+	// Automatic rollup of exported segments into tiers, using the
+	// timestamp, values and tags of the rollup settings
+	AutoRollup struct {
+		Grace        Duration     `yaml:"grace"`         // wait after a window closes before rolling it up
+		RawRetention Duration     `yaml:"raw_retention"` // age of rolled-up segments to delete, 0 to keep them
+		Tiers        []TierConfig `yaml:"tiers"`         // from the shortest interval to the longest
+	} `yaml:"autorollup"`
+
+	State struct {
+		Backend string `yaml:"backend"` // ledger, or inline for the legacy in-file flag
+		Dir     string `yaml:"dir"`     // directory holding the export ledger
+	} `yaml:"state"`
+
+	Retry struct {
+		MaxAttempts int           `yaml:"max_attempts"`
+		BaseDelay   time.Duration `yaml:"base_delay"`
+		MaxDelay    time.Duration `yaml:"max_delay"`
+		Jitter      float64       `yaml:"jitter"` // fraction of each delay that is randomised
+	} `yaml:"retry"`
+
 	Logging struct {
 		Level  string `yaml:"level"`
 		Format string `yaml:"format"`
 	} `yaml:"logging"`
 }
 
+// TierConfig holds the settings of one automatic rollup tier
+type TierConfig struct {
+	Interval  string   `yaml:"interval"`  // window length, e.g. 1h or 1d
+	Prefix    string   `yaml:"prefix"`    // key prefix of the tier's objects
+	Retention Duration `yaml:"retention"` // age of windows to delete, 0 to keep them
+}
+
+// Duration is a time.Duration read from YAML that also accepts whole days
+// and weeks, such as 30d or 2w
+type Duration time.Duration
+
+// UnmarshalYAML parses a duration with rollup.ParseDuration
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	err := unmarshal(&text)
+	if err != nil {
+		return err
+	}
+
+	duration, err := rollup.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
 // LoadConfig loads configuration from a YAML file
 func LoadConfig(configPath string) (*Config, error) {
 	// Create default config
 	config := &Config{}
-	
+
 	// Set defaults
+	config.Source.Delimiter = "comma"
+	config.Types.SampleRows = 1000
+	config.Types.OnError = "null"
 	config.Export.BatchSize = 1000
 	config.Export.Compression = true
+	config.Export.Codec = "gzip"
+	config.Export.GzipBlockSizeKB = 1024
 	config.Export.TempDir = "/tmp/s3-exporter"
-	
+	config.Export.Mode = "stream"
+	config.Export.Format = "ndjson"
+	config.Export.Workers = 4
+	config.Export.PipelineDepth = 2
+	config.Rollup.Timestamp = "timestamp"
+	config.Rollup.Intervals = rollup.DefaultIntervals
+	config.Rollup.Output = "alongside"
+	config.Rollup.SketchAccuracy = rollup.DefaultSketchAccuracy
+	config.AutoRollup.Grace = Duration(10 * time.Minute)
+	config.AutoRollup.Tiers = []TierConfig{
+		{Interval: "1h", Prefix: "rollups/1h"},
+		{Interval: "1d", Prefix: "rollups/1d"},
+	}
+	config.Storage.Backend = "s3"
+	config.State.Backend = "ledger"
+	config.State.Dir = "state"
+	config.S3.PartSizeMB = 5
+	config.S3.Concurrency = 5
+
+	retry := src.DefaultRetryPolicy()
+	config.Retry.MaxAttempts = retry.MaxAttempts
+	config.Retry.BaseDelay = retry.BaseDelay
+	config.Retry.MaxDelay = retry.MaxDelay
+	config.Retry.Jitter = retry.Jitter
+
 	// Read config file
 	data, err := os.ReadFile(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("error reading config file: %w", err)
 	}
-	
+
 	// Parse YAML
 	err = yaml.Unmarshal(data, config)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing config file: %w", err)
 	}
-	
+
+	_, err = sfm.ParseDelimiter(config.Source.Delimiter)
+	if err != nil {
+		return nil, fmt.Errorf("error in source settings: %w", err)
+	}
+
+	switch config.Types.OnError {
+	case "", "null", "string", "skip", "fail":
+	default:
+		return nil, fmt.Errorf("error in types settings: unknown on_error policy: %q", config.Types.OnError)
+	}
+
+	if config.Rollup.Enabled {
+		_, err = config.RollupSpec()
+		if err != nil {
+			return nil, fmt.Errorf("error in rollup settings: %w", err)
+		}
+	}
+
 	return config, nil
-}
\ No newline at end of file
+}
+
+// S3Options returns the S3 connection settings from the configuration
+func (c *Config) S3Options() src.S3Options {
+	return src.S3Options{
+		Region:               c.S3.Region,
+		Bucket:               c.S3.Bucket,
+		AccessKey:            c.S3.AccessKey,
+		SecretKey:            c.S3.SecretKey,
+		Profile:              c.S3.Profile,
+		RoleARN:              c.S3.RoleARN,
+		ExternalID:           c.S3.ExternalID,
+		RoleSessionName:      c.S3.RoleSessionName,
+		WebIdentityTokenFile: c.S3.WebIdentityTokenFile,
+		Endpoint:             c.S3.Endpoint,
+		ForcePathStyle:       c.S3.ForcePathStyle,
+		DisableSSL:           c.S3.DisableSSL,
+		CABundle:             c.S3.CABundle,
+		PartSize:             c.S3.PartSizeMB * 1024 * 1024,
+		Concurrency:          c.S3.Concurrency,
+	}
+}
+
+// RetryPolicy returns the retry policy for storage operations
+func (c *Config) RetryPolicy() src.RetryPolicy {
+	return src.RetryPolicy{
+		MaxAttempts: c.Retry.MaxAttempts,
+		BaseDelay:   c.Retry.BaseDelay,
+		MaxDelay:    c.Retry.MaxDelay,
+		Jitter:      c.Retry.Jitter,
+	}
+}
+
+// RollupSpec returns the rollup settings from the configuration
+func (c *Config) RollupSpec() (rollup.Spec, error) {
+	switch c.Rollup.Output {
+	case "", "alongside", "instead":
+	default:
+		return rollup.Spec{}, fmt.Errorf("unknown rollup output: %q", c.Rollup.Output)
+	}
+
+	spec := rollup.Spec{
+		Timestamp: c.Rollup.Timestamp,
+		Values:    c.Rollup.Values,
+		Tags:      c.Rollup.Tags,
+		MaxSeries: c.Rollup.MaxSeries,
+		// Checked by the engine
+		SketchAccuracy: c.Rollup.SketchAccuracy,
+	}
+
+	intervals := c.Rollup.Intervals
+	if len(intervals) == 0 {
+		intervals = rollup.DefaultIntervals
+	}
+	for _, name := range intervals {
+		interval, err := rollup.ParseInterval(name)
+		if err != nil {
+			return rollup.Spec{}, err
+		}
+		spec.Intervals = append(spec.Intervals, interval)
+	}
+
+	for _, name := range c.Rollup.Aggregates {
+		aggregate, err := rollup.ParseAggregate(name)
+		if err != nil {
+			return rollup.Spec{}, err
+		}
+		spec.Aggregates = append(spec.Aggregates, aggregate)
+	}
+
+	if len(c.Rollup.Kinds) > 0 {
+		spec.Kinds = make(map[string]rollup.Kind, len(c.Rollup.Kinds))
+		for column, name := range c.Rollup.Kinds {
+			kind, err := rollup.ParseKind(name)
+			if err != nil {
+				return rollup.Spec{}, err
+			}
+			spec.Kinds[column] = kind
+		}
+	}
+
+	return spec, nil
+}
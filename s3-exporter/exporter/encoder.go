@@ -0,0 +1,188 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"s3-exporter/sfm"
+)
+
+// recordEncoder writes records as JSON objects with their keys in header
+// order. Columns can be dropped or renamed on the way out. The encoder
+// appends to a caller's buffer instead of building a map per record, and
+// is safe for concurrent use.
+type recordEncoder struct {
+	// indexes are the record fields that are written, in order
+	indexes []int
+	// names and types are the output column names and their types
+	names []string
+	types []sfm.Type
+	// keys are the JSON keys with their separators, such as `{"id":` and `,"value":`
+	keys [][]byte
+}
+
+// newRecordEncoder creates an encoder for records with the given columns
+// and types, applying the projection and renames of config.Columns
+func newRecordEncoder(columns []string, types []sfm.Type, config *Config) (*recordEncoder, error) {
+	known := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		known[column] = true
+	}
+
+	// Every configured column must exist, so that typos do not silently
+	// change what is exported
+	check := func(setting string, names []string) error {
+		for _, name := range names {
+			if !known[name] {
+				return fmt.Errorf("unknown column %q in columns.%s", name, setting)
+			}
+		}
+		return nil
+	}
+	err := check("include", config.Columns.Include)
+	if err != nil {
+		return nil, err
+	}
+	err = check("exclude", config.Columns.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	renamed := make([]string, 0, len(config.Columns.Rename))
+	for name := range config.Columns.Rename {
+		renamed = append(renamed, name)
+	}
+	err = check("rename", renamed)
+	if err != nil {
+		return nil, err
+	}
+
+	include := make(map[string]bool, len(config.Columns.Include))
+	for _, name := range config.Columns.Include {
+		include[name] = true
+	}
+	exclude := make(map[string]bool, len(config.Columns.Exclude))
+	for _, name := range config.Columns.Exclude {
+		exclude[name] = true
+	}
+
+	e := &recordEncoder{}
+	seen := map[string]bool{}
+	for i, column := range columns {
+		if (len(include) > 0 && !include[column]) || exclude[column] {
+			continue
+		}
+
+		name := column
+		if rename, ok := config.Columns.Rename[column]; ok {
+			name = rename
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate output column %q", name)
+		}
+		seen[name] = true
+
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding column name: %w", err)
+		}
+		separator := byte(',')
+		if len(e.keys) == 0 {
+			separator = '{'
+		}
+		e.keys = append(e.keys, append(append([]byte{separator}, key...), ':'))
+
+		e.indexes = append(e.indexes, i)
+		e.names = append(e.names, name)
+		e.types = append(e.types, types[i])
+	}
+
+	if len(e.indexes) == 0 {
+		return nil, fmt.Errorf("no columns left to export")
+	}
+
+	return e, nil
+}
+
+// appendRecord appends a record as a JSON object, without a trailing newline, to dst
+func (e *recordEncoder) appendRecord(dst []byte, values []interface{}) ([]byte, error) {
+	var err error
+	for i, index := range e.indexes {
+		dst = append(dst, e.keys[i]...)
+		dst, err = appendJSONValue(dst, values[index])
+		if err != nil {
+			return nil, fmt.Errorf("error encoding column %s: %w", e.names[i], err)
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+// appendJSONValue appends a typed record value as JSON to dst
+func appendJSONValue(dst []byte, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(dst, "null"...), nil
+	case string:
+		return appendJSONString(dst, v), nil
+	case int64:
+		return strconv.AppendInt(dst, v, 10), nil
+	case float64:
+		return appendJSONFloat(dst, v)
+	case bool:
+		return strconv.AppendBool(dst, v), nil
+	case time.Time:
+		dst = append(dst, '"')
+		dst = v.AppendFormat(dst, time.RFC3339Nano)
+		return append(dst, '"'), nil
+	}
+
+	// Anything else goes through encoding/json
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, data...), nil
+}
+
+// appendJSONString appends s as a JSON string to dst. Plain ASCII strings,
+// by far the most common, are copied as is; anything else is escaped by
+// encoding/json.
+func appendJSONString(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c >= utf8.RuneSelf || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			data, _ := json.Marshal(s)
+			return append(dst, data...)
+		}
+	}
+
+	dst = append(dst, '"')
+	dst = append(dst, s...)
+	return append(dst, '"')
+}
+
+// appendJSONFloat appends f to dst formatted like encoding/json does
+func appendJSONFloat(dst []byte, f float64) ([]byte, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("unsupported float value: %v", f)
+	}
+
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, 64)
+
+	if format == 'e' {
+		// Shorten e-09 to e-9
+		n := len(dst)
+		if n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst, nil
+}
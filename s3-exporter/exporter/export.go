@@ -1,19 +1,28 @@
 package exporter
 
 import (
-	"bufio"
-	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"s3-exporter/sfm"
 	"s3-exporter/src"
 )
 
+// ExportedFlag is the metadata key of the legacy in-file export flag
+const ExportedFlag = "jsonS3Exported"
+
 // CheckIfExported checks if a segment file has already been exported
 func CheckIfExported(sfmFile string) (bool, error) {
+	return checkIfExported(sfmFile, sfm.DefaultDelimiter)
+}
+
+// checkIfExported checks the jsonS3Exported flag in the header of sfmFile
+func checkIfExported(sfmFile string, delimiter rune) (bool, error) {
 	// Open the SFM file
 	file, err := os.Open(sfmFile)
 	if err != nil {
@@ -21,86 +30,134 @@ func CheckIfExported(sfmFile string) (bool, error) {
 	}
 	defer file.Close()
 
-	// Look for the jsonS3Exported flag
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, "jsonS3Exported") {
-			// Check if the flag is true
-			if strings.Contains(line, "jsonS3Exported:true") || 
-               strings.Contains(line, "jsonS3Exported: true") {
-				return true, nil
-			}
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
+	header, err := sfm.NewReader(file, delimiter).ReadHeader()
+	if err != nil {
 		return false, fmt.Errorf("error reading SFM file: %w", err)
 	}
 
-	return false, nil
+	// Look for the jsonS3Exported flag
+	value, _ := header.Get(ExportedFlag)
+	return value == "true", nil
 }
 
-// MarkAsExported updates the SFM file to mark it as exported
+// MarkAsExported sets the jsonS3Exported flag of an SFM file to true,
+// adding the flag after the column header if it is missing. The file is
+// never modified in place: the new content is streamed into a temporary
+// file in the same directory, synced, given the original mode and owner and
+// then renamed over the original, so a crash at any point leaves either the
+// old or the new file. Files whose header block cannot be parsed are left
+// untouched.
 func MarkAsExported(sfmFile string) error {
-	// Read the entire file
-	data, err := os.ReadFile(sfmFile)
+	return markAsExported(sfmFile, sfm.DefaultDelimiter)
+}
+
+// markAsExported is MarkAsExported for files with any delimiter
+func markAsExported(sfmFile string, delimiter rune) error {
+	file, err := os.Open(sfmFile)
 	if err != nil {
-		return fmt.Errorf("error reading SFM file: %w", err)
+		return fmt.Errorf("error opening SFM file: %w", err)
 	}
+	defer file.Close()
 
-	content := string(data)
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading SFM file info: %w", err)
+	}
 
-	// Check if the jsonS3Exported flag exists
-	if strings.Contains(content, "jsonS3Exported:false") {
-		content = strings.Replace(content, "jsonS3Exported:false", "jsonS3Exported:true", 1)
-	} else if strings.Contains(content, "jsonS3Exported: false") {
-		content = strings.Replace(content, "jsonS3Exported: false", "jsonS3Exported: true", 1)
-	} else {
-		// If the flag doesn't exist, add it
-		if strings.Contains(content, ".sfm") || strings.Contains(content, "segmeta.json") {
-			// Find a suitable location to add the flag
-			// This is a simplification - you might need more robust logic
-			lines := strings.Split(content, "\n")
-			for i, line := range lines {
-				if strings.Contains(line, ".sfm") || strings.Contains(line, "segmeta.json") {
-					lines[i] = line + "\njsonS3Exported:true"
-					break
-				}
-			}
-			content = strings.Join(lines, "\n")
+	// Parse the header block before touching anything
+	reader := sfm.NewReader(file, delimiter)
+	header, err := reader.ReadHeader()
+	if err != nil {
+		return fmt.Errorf("error reading SFM header: %w", err)
+	}
+	if header.Columns == nil {
+		return fmt.Errorf("refusing to update %s: no column header found in its header block", sfmFile)
+	}
+
+	value, _ := header.Get(ExportedFlag)
+	if value == "true" {
+		return nil
+	}
+	header.Set(ExportedFlag, "true")
+
+	// Write the new content to a temporary file next to the original
+	dir := filepath.Dir(sfmFile)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(sfmFile)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary SFM file: %w", err)
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			tmp.Close()
+			os.Remove(tmp.Name())
 		}
+	}()
+
+	writer := sfm.NewWriter(tmp, delimiter)
+	err = writer.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
 	}
 
-	// Write the modified content back to the file
-	err = os.WriteFile(sfmFile, []byte(content), 0644)
+	// Stream the data lines without loading them into memory
+	_, err = io.Copy(tmp, reader.Rest())
 	if err != nil {
-		return fmt.Errorf("error updating SFM file: %w", err)
+		return fmt.Errorf("error copying SFM data: %w", err)
 	}
 
-	return nil
-}
+	// Preserve the permissions and owner of the original
+	err = tmp.Chmod(info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("error setting SFM file mode: %w", err)
+	}
+	err = preserveOwner(tmp, info)
+	if err != nil {
+		return fmt.Errorf("error setting SFM file owner: %w", err)
+	}
 
-// ConvertAndUpload converts an SFM file to JSON and uploads it to S3
-func ConvertAndUpload(sfmFile string, config *Config) error {
-	// Create temp directory if it doesn't exist
-	err := os.MkdirAll(config.Export.TempDir, 0755)
+	err = tmp.Sync()
 	if err != nil {
-		return fmt.Errorf("error creating temp directory: %w", err)
+		return fmt.Errorf("error syncing temporary SFM file: %w", err)
 	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("error closing temporary SFM file: %w", err)
+	}
+
+	// Atomically replace the original
+	err = os.Rename(tmp.Name(), sfmFile)
+	if err != nil {
+		return fmt.Errorf("error replacing SFM file: %w", err)
+	}
+	renamed = true
 
-	// Create a temporary file for the JSON output
-	baseFileName := filepath.Base(sfmFile)
-	baseFileName = strings.TrimSuffix(baseFileName, filepath.Ext(baseFileName))
-	timeStamp := time.Now().Format("20060102-150405")
-	jsonFileName := fmt.Sprintf("%s/%s-%s.json", config.Export.TempDir, baseFileName, timeStamp)
-	
-	jsonFile, err := os.Create(jsonFileName)
+	// Persist the rename itself
+	err = syncDir(dir)
 	if err != nil {
-		return fmt.Errorf("error creating JSON file: %w", err)
+		return fmt.Errorf("error syncing SFM directory: %w", err)
 	}
-	defer jsonFile.Close()
 
+	return nil
+}
+
+// ConvertAndUpload converts an SFM file to newline-delimited JSON, a JSON
+// array, CSV or Parquet, as set by config.Export.Format, and uploads it to
+// the object store. Values are written according to their column types.
+// Records are split into batches by count, encoded size or compressed size,
+// whichever limit is reached first. With rollups enabled the records are
+// also aggregated into the configured intervals, and the rolled-up series
+// are uploaded alongside or instead of the raw batches. Reading, encoding
+// and compressing, and uploading run as concurrent pipeline stages
+// connected by channels holding up to config.Export.PipelineDepth chunks of
+// records or batches. After every uploaded batch a checkpoint is saved in
+// the state directory, so if the export fails a later call resumes after
+// the last uploaded batch, reusing the same object keys and run timestamp.
+func ConvertAndUpload(sfmFile string, config *Config, store src.ObjectStore) error {
 	// Open the SFM file
 	sfmReader, err := os.Open(sfmFile)
 	if err != nil {
@@ -108,175 +165,348 @@ func ConvertAndUpload(sfmFile string, config *Config) error {
 	}
 	defer sfmReader.Close()
 
-	// Read column names from the SFM file
-	columnNames, err := readColumnNames(sfmReader)
+	sfmInfo, err := sfmReader.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading SFM file info: %w", err)
+	}
+
+	delimiter, err := sfm.ParseDelimiter(config.Source.Delimiter)
 	if err != nil {
-		return fmt.Errorf("error reading column names: %w", err)
+		return err
 	}
 
-	// Reset file pointer to beginning
-	_, err = sfmReader.Seek(0, 0)
+	// Read column names from the SFM file header
+	records := sfm.NewReader(sfmReader, delimiter)
+	header, err := records.ReadHeader()
 	if err != nil {
-		return fmt.Errorf("error resetting file pointer: %w", err)
+		return fmt.Errorf("error reading SFM header: %w", err)
+	}
+	if header.Columns == nil {
+		return fmt.Errorf("error reading column names: column names not found in file header")
 	}
+	columnNames := header.Columns
 
-	scanner := bufio.NewScanner(sfmReader)
-	writer := bufio.NewWriter(jsonFile)
-	recordCount := 0
-	batchCount := 0
+	baseFileName := SegmentPrefix(sfmFile)
 
-	// Process each record
-	for scanner.Scan() {
-		line := scanner.Text()
-		// Skip header lines or non-data lines
-		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
-			continue
+	// Pick up where an interrupted export left off
+	checkpoint := &Checkpoint{
+		SourceFile:    sfmFile,
+		SourceSize:    sfmInfo.Size(),
+		SourceModTime: sfmInfo.ModTime(),
+		RunTimestamp:  time.Now().UTC(),
+		Settings:      checkpointSettings(config),
+	}
+	if config.State.Dir != "" {
+		previous, err := LoadCheckpoint(config.State.Dir, sfmFile)
+		if err != nil {
+			return err
 		}
-
-		// Process data line and convert to JSON
-		record := strings.Split(line, ",")
-		if len(record) != len(columnNames) {
-			continue // Skip malformed records
+		if previous != nil && previous.Settings != checkpoint.Settings {
+			log.Printf("Export settings changed since the export of %s was interrupted, starting over", sfmFile)
+			err = discardCheckpoint(config.State.Dir, store, previous)
+			if err != nil {
+				return err
+			}
+			previous = nil
+		}
+		if previous != nil {
+			log.Printf("Resuming export of %s at batch %d (offset %d)", sfmFile, previous.NextBatch, previous.Offset)
+			checkpoint = previous
 		}
+	}
 
-		jsonRecord := make(map[string]string)
-		for i, value := range record {
-			jsonRecord[columnNames[i]] = strings.TrimSpace(value)
+	// Position the reader at the first record still to be exported
+	if checkpoint.Offset > 0 {
+		_, err = sfmReader.Seek(checkpoint.Offset, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("error resetting file pointer: %w", err)
 		}
+		records = sfm.Resume(sfmReader, delimiter, header, sfm.Position{Offset: checkpoint.Offset, Line: checkpoint.Line})
+	}
 
-		// Convert to JSON
-		jsonData, err := json.Marshal(jsonRecord)
+	// Work out the column types, keeping those of an interrupted export
+	recordSchema, err := newSchema(sfmFile, delimiter, header, checkpoint.ColumnTypes, config)
+	if err != nil {
+		return err
+	}
+	checkpoint.ColumnTypes = recordSchema.types
+
+	// Records are written in header order, projected and renamed as configured
+	encoder, err := newRecordEncoder(columnNames, recordSchema.types, config)
+	if err != nil {
+		return err
+	}
+	format, err := newOutputFormat(config, encoder)
+	if err != nil {
+		return err
+	}
+	codec, err := batchCodec(config, format)
+	if err != nil {
+		return err
+	}
+
+	// Rollups cover the whole file, including the records of batches
+	// uploaded before an interruption
+	engine, err := newRollupEngine(config, columnNames, recordSchema.types)
+	if err != nil {
+		return err
+	}
+	if engine != nil && checkpoint.Offset > 0 {
+		err = rollupExported(sfmFile, delimiter, recordSchema, engine, checkpoint.Offset)
 		if err != nil {
-			return fmt.Errorf("error marshaling to JSON: %w", err)
+			return err
 		}
+	}
+	rollupOnly := engine != nil && config.Rollup.Output == "instead"
 
-		// Write to file
-		_, err = writer.WriteString(string(jsonData) + "\n")
+	// Remove the manifest of an earlier run so readers do not treat the
+	// segment as complete while its batches are being replaced
+	err = store.Delete(ManifestKey(baseFileName))
+	if err != nil {
+		return fmt.Errorf("error removing previous manifest: %w", err)
+	}
+
+	manifest := &Manifest{
+		Version:      ManifestVersion,
+		SourceFile:   sfmFile,
+		Columns:      encoder.names,
+		ColumnTypes:  encoder.types,
+		RunTimestamp: checkpoint.RunTimestamp,
+		Format:       format.name(),
+		Compression:  compressionName(codec),
+	}
+	for _, batch := range checkpoint.Batches {
+		manifest.AddBatch(batch)
+	}
+
+	// commit records an uploaded batch in the manifest and the checkpoint
+	commit := func(batch ManifestBatch, nextBatch int, end sfm.Position) error {
+		manifest.AddBatch(batch)
+
+		// Remember the progress in case a later batch fails
+		return saveProgress(config, checkpoint, batch, nextBatch, end)
+	}
+
+	depth := config.Export.PipelineDepth
+	if depth < 1 {
+		depth = 1
+	}
+
+	// Batches are streamed into their objects as they are written, or
+	// staged in temporary files with mode tempfile
+	var newBuffer func(key string, opts src.PutOptions) (batchBuffer, error)
+	switch config.Export.Mode {
+	case "", "stream":
+		newBuffer = func(key string, opts src.PutOptions) (batchBuffer, error) {
+			return newStreamBuffer(store, key, opts), nil
+		}
+	case "tempfile":
+		// Batch files go to a directory of their own, removed with
+		// anything left in it once every stage has stopped
+		tempDir, err := makeExportTempDir(config.Export.TempDir, baseFileName, checkpoint.RunTimestamp)
 		if err != nil {
-			return fmt.Errorf("error writing to JSON file: %w", err)
+			return err
 		}
+		defer os.RemoveAll(tempDir)
 
-		recordCount++
-		
-		// Flush every N records to avoid memory issues
-		if recordCount%1000 == 0 {
-			err = writer.Flush()
-			if err != nil {
-				return fmt.Errorf("error flushing to file: %w", err)
-			}
+		extension := batchExtension(format, codec)
+		newBuffer = func(key string, _ src.PutOptions) (batchBuffer, error) {
+			name := strings.ReplaceAll(strings.TrimSuffix(key, extension), "/", "-")
+			return newFileBuffer(tempDir, name+"-*"+extension)
 		}
+	default:
+		return fmt.Errorf("unknown export mode: %q", config.Export.Mode)
+	}
+	// Read, encode and upload in concurrent stages, each working on
+	// different records
+	p := newPipeline()
+	if rollupOnly {
+		// Only the rollups are exported, so records are not batched
+		p.run(func() error {
+			return p.parseStage(records, recordSchema, engine, nil)
+		})
+	} else {
+		opts := putOptions(format, codec)
+		writer := newBatchWriter(format, codec, batchLimitsFor(config), checkpoint.NextBatch, func(num int) (batchBuffer, error) {
+			return newBuffer(batchKey(baseFileName, num, format, codec), opts)
+		})
+		parsed := make(chan recordChunk, depth)
+		written := make(chan *writtenBatch, depth)
+		p.run(func() error {
+			return p.parseStage(records, recordSchema, engine, parsed)
+		})
+		p.run(func() error {
+			return p.batchStage(parsed, writer, written)
+		})
 
-		// Check if we need to start a new batch
-		if config.Export.BatchSize > 0 && recordCount >= config.Export.BatchSize {
-			err = writer.Flush()
-			if err != nil {
-				return fmt.Errorf("error flushing to file: %w", err)
-			}
-			
-			// Close current file
-			jsonFile.Close()
-			
-			// Compress if needed
-			finalFile := jsonFileName
-			if config.Export.Compression {
-				compressedFile, err := src.CompressFile(jsonFileName)
-				if err != nil {
-					return fmt.Errorf("error compressing file: %w", err)
-				}
-				finalFile = compressedFile
-			}
-			
-			// Upload to S3
-			s3Path := fmt.Sprintf("%s/batch-%d.json", baseFileName, batchCount)
-			if strings.HasSuffix(finalFile, ".gz") {
-				s3Path += ".gz"
-			}
-			
-			err = src.UploadToS3(finalFile, s3Path, config.S3.Bucket, config.S3.Region, 
-                            config.S3.AccessKey, config.S3.SecretKey)
-			if err != nil {
-				return fmt.Errorf("error uploading to S3: %w", err)
-			}
-			
-			// Start a new batch
-			batchCount++
-			recordCount = 0
-			jsonFileName = fmt.Sprintf("%s/%s-%s-batch-%d.json", 
-                            config.Export.TempDir, baseFileName, timeStamp, batchCount)
-			
-			jsonFile, err = os.Create(jsonFileName)
-			if err != nil {
-				return fmt.Errorf("error creating JSON file: %w", err)
+		// Upload the batches in order
+		err = uploadBatches(store, format, codec, baseFileName, written, commit)
+		if err != nil {
+			p.fail(err)
+			// Discard the batches still waiting for their upload
+			for batch := range written {
+				batch.buffer.remove()
 			}
-			writer = bufio.NewWriter(jsonFile)
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading SFM file: %w", err)
+	err = p.wait()
+	if err != nil {
+		return err
 	}
 
-	// Flush any remaining records
-	err = writer.Flush()
+	if engine != nil {
+		manifest.Rollup, err = uploadRollups(store, config, engine, codec, baseFileName, newBuffer)
+		if err != nil {
+			return fmt.Errorf("error uploading rollups: %w", err)
+		}
+	}
+
+	// Write the manifest last so its presence marks the export as complete
+	err = WriteManifest(store, baseFileName, manifest)
 	if err != nil {
-		return fmt.Errorf("error flushing to file: %w", err)
+		return err
 	}
-	
-	// Close the final file
-	jsonFile.Close()
 
-	// Process the final batch if there's any data
-	if recordCount > 0 {
-		// Compress if needed
-		finalFile := jsonFileName
-		if config.Export.Compression {
-			compressedFile, err := src.CompressFile(jsonFileName)
-			if err != nil {
-				return fmt.Errorf("error compressing file: %w", err)
-			}
-			finalFile = compressedFile
+	// The export is complete, so there is nothing left to resume
+	if config.State.Dir != "" {
+		err = RemoveCheckpoint(config.State.Dir, sfmFile)
+		if err != nil {
+			return err
 		}
-		
-		// Upload to S3
-		s3Path := fmt.Sprintf("%s/batch-%d.json", baseFileName, batchCount)
-		if strings.HasSuffix(finalFile, ".gz") {
-			s3Path += ".gz"
+	}
+
+	return nil
+}
+
+// saveProgress records an uploaded batch in the checkpoint and saves it
+func saveProgress(config *Config, checkpoint *Checkpoint, batch ManifestBatch, nextBatch int, end sfm.Position) error {
+	if config.State.Dir == "" {
+		return nil
+	}
+
+	checkpoint.Batches = append(checkpoint.Batches, batch)
+	checkpoint.NextBatch = nextBatch
+	checkpoint.Offset = end.Offset
+	checkpoint.Line = end.Line
+
+	err := SaveCheckpoint(config.State.Dir, checkpoint)
+	if err != nil {
+		return fmt.Errorf("error saving checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// batchCodec returns the codec that whole batches are compressed with, or
+// nil if they are not compressed
+func batchCodec(config *Config, format outputFormat) (src.Codec, error) {
+	if !config.Export.Compression || !format.compressible() {
+		return nil, nil
+	}
+
+	// gzip batches are compressed in parallel blocks
+	if config.Export.Codec == "" || config.Export.Codec == "gzip" {
+		codec, err := src.NewParallelGzipCodec(src.ParallelGzipOptions{
+			Level:       config.Export.CompressionLevel,
+			Concurrency: config.Export.GzipConcurrency,
+			BlockSize:   config.Export.GzipBlockSizeKB * 1024,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error in export settings: %w", err)
+		}
+		return codec, nil
+	}
+
+	codec, err := src.NewCodec(config.Export.Codec, config.Export.CompressionLevel)
+	if err != nil {
+		return nil, fmt.Errorf("error in export settings: %w", err)
+	}
+	return codec, nil
+}
+
+// compressionName returns the name of the compression applied to batches
+func compressionName(codec src.Codec) string {
+	if codec != nil {
+		return codec.Name()
+	}
+	return "none"
+}
+
+// putOptions returns the metadata of a batch object. Codecs with an HTTP
+// content coding keep the content type of the format; the others replace it.
+func putOptions(format outputFormat, codec src.Codec) src.PutOptions {
+	if codec == nil {
+		return src.PutOptions{ContentType: format.contentType()}
+	}
+	if codec.ContentEncoding() == "" {
+		return src.PutOptions{ContentType: codec.ContentType()}
+	}
+	return src.PutOptions{ContentType: format.contentType(), ContentEncoding: codec.ContentEncoding()}
+}
+
+// uploadBatches uploads every written batch as it arrives and commits it.
+// Each batch is discarded once it has been uploaded.
+func uploadBatches(store src.ObjectStore, format outputFormat, codec src.Codec, prefix string, written <-chan *writtenBatch, commit func(ManifestBatch, int, sfm.Position) error) error {
+	for batch := range written {
+		key := batchKey(prefix, batch.num, format, codec)
+		manifestBatch, err := uploadBatch(store, key, format, codec, batch)
+		batch.buffer.remove()
+		if err != nil {
+			return err
 		}
-		
-		err = src.UploadToS3(finalFile, s3Path, config.S3.Bucket, config.S3.Region, 
-                        config.S3.AccessKey, config.S3.SecretKey)
+
+		err = commit(manifestBatch, batch.num+1, batch.end)
 		if err != nil {
-			return fmt.Errorf("error uploading to S3: %w", err)
+			return err
 		}
 	}
 
 	return nil
 }
 
-// readColumnNames reads column names from the SFM file header
-func readColumnNames(file *os.File) ([]string, error) {
-	scanner := bufio.NewScanner(file)
-	
-	// Look for the header line (typically starts with # or similar)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "#") && strings.Contains(line, ",") {
-			// Remove the # prefix and split by comma
-			headerLine := strings.TrimPrefix(line, "#")
-			columns := strings.Split(headerLine, ",")
-			
-			// Trim whitespace from column names
-			for i, col := range columns {
-				columns[i] = strings.TrimSpace(col)
-			}
-			
-			return columns, nil
-		}
+// makeExportTempDir creates a directory inside tempDir for the batch files of one export
+func makeExportTempDir(tempDir, prefix string, runTime time.Time) (string, error) {
+	// Create temp directory if it doesn't exist
+	err := os.MkdirAll(tempDir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("error creating temp directory: %w", err)
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error scanning file: %w", err)
+	dir, err := os.MkdirTemp(tempDir, fmt.Sprintf("%s-%s-*", prefix, runTime.Format("20060102-150405")))
+	if err != nil {
+		return "", fmt.Errorf("error creating temp directory: %w", err)
 	}
 
-	return nil, fmt.Errorf("column names not found in file header")
-}
\ No newline at end of file
+	return dir, nil
+}
+
+// batchKey returns the object key of batch number num of the segment under prefix
+func batchKey(prefix string, num int, format outputFormat, codec src.Codec) string {
+	return fmt.Sprintf("%s/batch-%d%s", prefix, num, batchExtension(format, codec))
+}
+
+// batchExtension returns the extension of batch objects
+func batchExtension(format outputFormat, codec src.Codec) string {
+	if codec != nil {
+		return format.extension() + codec.Extension()
+	}
+	return format.extension()
+}
+
+// uploadBatch uploads a written batch under key and returns its manifest entry
+func uploadBatch(store src.ObjectStore, key string, format outputFormat, codec src.Codec, batch *writtenBatch) (ManifestBatch, error) {
+	err := batch.buffer.upload(store, key, putOptions(format, codec))
+	if err != nil {
+		return ManifestBatch{}, fmt.Errorf("error uploading batch: %w", err)
+	}
+
+	return ManifestBatch{
+		Key:          key,
+		Size:         batch.size,
+		Records:      batch.records,
+		Checksum:     batch.checksum,
+		Compression:  compressionName(codec),
+		NulledValues: batch.nulled,
+	}, nil
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package exporter
+
+import "os"
+
+// preserveOwner is a no-op on platforms without Unix file ownership
+func preserveOwner(file *os.File, info os.FileInfo) error {
+	return nil
+}
+
+// syncDir is a no-op on platforms that cannot sync directories
+func syncDir(dir string) error {
+	return nil
+}
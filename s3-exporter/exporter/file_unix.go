@@ -0,0 +1,27 @@
+//go:build unix
+
+package exporter
+
+import (
+	"os"
+	"syscall"
+)
+
+// preserveOwner gives file the owner and group recorded in info
+func preserveOwner(file *os.File, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return file.Chown(int(stat.Uid), int(stat.Gid))
+}
+
+// syncDir flushes a directory entry change, such as a rename, to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
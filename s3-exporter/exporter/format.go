@@ -0,0 +1,371 @@
+package exporter
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+
+	"s3-exporter/sfm"
+)
+
+// outputFormat writes batches of typed records as complete objects
+type outputFormat interface {
+	// name is the format name used in the configuration and the manifest
+	name() string
+	// extension is the object key extension, without any compression suffix
+	extension() string
+	contentType() string
+	// compressible reports whether whole batches are worth compressing;
+	// formats that compress internally are uploaded as they are
+	compressible() bool
+	// newWriter starts a batch written to w
+	newWriter(w io.Writer) (recordWriter, error)
+}
+
+// recordWriter writes the records of one batch as they arrive
+type recordWriter interface {
+	write(record []interface{}) error
+	// pending is the estimated size of records held back by the writer and
+	// not yet written out
+	pending() int64
+	// close writes anything the format needs after the last record
+	close() error
+}
+
+// newOutputFormat returns the output format selected by config.Export.Format
+func newOutputFormat(config *Config, encoder *recordEncoder) (outputFormat, error) {
+	switch config.Export.Format {
+	case "", "ndjson":
+		return ndjsonFormat{encoder: encoder}, nil
+	case "json_array":
+		return jsonArrayFormat{encoder: encoder}, nil
+	case "csv":
+		return csvFormat{encoder: encoder}, nil
+	case "parquet":
+		return newParquetFormat(config, encoder)
+	}
+	return nil, fmt.Errorf("unknown export format: %q", config.Export.Format)
+}
+
+// ndjsonFormat writes one JSON object per line
+type ndjsonFormat struct {
+	encoder *recordEncoder
+}
+
+func (ndjsonFormat) name() string        { return "ndjson" }
+func (ndjsonFormat) extension() string   { return ".json" }
+func (ndjsonFormat) contentType() string { return "application/json" }
+func (ndjsonFormat) compressible() bool  { return true }
+
+func (f ndjsonFormat) newWriter(w io.Writer) (recordWriter, error) {
+	return &ndjsonWriter{w: w, encoder: f.encoder}, nil
+}
+
+// ndjsonWriter writes records as newline-delimited JSON objects
+type ndjsonWriter struct {
+	w       io.Writer
+	encoder *recordEncoder
+	line    []byte
+}
+
+func (w *ndjsonWriter) write(record []interface{}) error {
+	// Convert to JSON
+	var err error
+	w.line, err = w.encoder.appendRecord(w.line[:0], record)
+	if err != nil {
+		return fmt.Errorf("error encoding record: %w", err)
+	}
+
+	// Write the JSON line
+	w.line = append(w.line, '\n')
+	_, err = w.w.Write(w.line)
+	if err != nil {
+		return fmt.Errorf("error writing JSON output: %w", err)
+	}
+
+	return nil
+}
+
+func (w *ndjsonWriter) pending() int64 { return 0 }
+func (w *ndjsonWriter) close() error   { return nil }
+
+// jsonArrayFormat writes every batch as a single JSON array of objects
+type jsonArrayFormat struct {
+	encoder *recordEncoder
+}
+
+func (jsonArrayFormat) name() string        { return "json_array" }
+func (jsonArrayFormat) extension() string   { return ".json" }
+func (jsonArrayFormat) contentType() string { return "application/json" }
+func (jsonArrayFormat) compressible() bool  { return true }
+
+func (f jsonArrayFormat) newWriter(w io.Writer) (recordWriter, error) {
+	_, err := io.WriteString(w, "[\n")
+	if err != nil {
+		return nil, fmt.Errorf("error writing JSON output: %w", err)
+	}
+	return &jsonArrayWriter{w: w, encoder: f.encoder}, nil
+}
+
+// jsonArrayWriter writes records as the elements of a JSON array, one per line
+type jsonArrayWriter struct {
+	w       io.Writer
+	encoder *recordEncoder
+	line    []byte
+	records int
+}
+
+func (w *jsonArrayWriter) write(record []interface{}) error {
+	// Every element but the first ends the line before it
+	w.line = w.line[:0]
+	if w.records > 0 {
+		w.line = append(w.line, ",\n"...)
+	}
+
+	var err error
+	w.line, err = w.encoder.appendRecord(w.line, record)
+	if err != nil {
+		return fmt.Errorf("error encoding record: %w", err)
+	}
+
+	_, err = w.w.Write(w.line)
+	if err != nil {
+		return fmt.Errorf("error writing JSON output: %w", err)
+	}
+	w.records++
+
+	return nil
+}
+
+func (w *jsonArrayWriter) pending() int64 { return 0 }
+
+func (w *jsonArrayWriter) close() error {
+	end := "]\n"
+	if w.records > 0 {
+		end = "\n]\n"
+	}
+
+	_, err := io.WriteString(w.w, end)
+	if err != nil {
+		return fmt.Errorf("error writing JSON output: %w", err)
+	}
+
+	return nil
+}
+
+// csvFormat writes every batch as RFC 4180 CSV with a header row of the
+// output column names. Nulls are written as empty fields.
+type csvFormat struct {
+	encoder *recordEncoder
+}
+
+func (csvFormat) name() string        { return "csv" }
+func (csvFormat) extension() string   { return ".csv" }
+func (csvFormat) contentType() string { return "text/csv" }
+func (csvFormat) compressible() bool  { return true }
+
+func (f csvFormat) newWriter(w io.Writer) (recordWriter, error) {
+	writer := &csvWriter{
+		writer:  csv.NewWriter(w),
+		encoder: f.encoder,
+		row:     make([]string, len(f.encoder.indexes)),
+	}
+
+	err := writer.flush(f.encoder.names)
+	if err != nil {
+		return nil, fmt.Errorf("error writing CSV header: %w", err)
+	}
+
+	return writer, nil
+}
+
+// csvWriter writes records as CSV rows
+type csvWriter struct {
+	writer  *csv.Writer
+	encoder *recordEncoder
+	row     []string
+}
+
+func (w *csvWriter) write(record []interface{}) error {
+	for i, index := range w.encoder.indexes {
+		var err error
+		w.row[i], err = csvValue(record[index])
+		if err != nil {
+			return fmt.Errorf("error encoding column %s: %w", w.encoder.names[i], err)
+		}
+	}
+
+	err := w.flush(w.row)
+	if err != nil {
+		return fmt.Errorf("error writing CSV output: %w", err)
+	}
+
+	return nil
+}
+
+// flush writes a row straight through, so that nothing is held back
+func (w *csvWriter) flush(row []string) error {
+	err := w.writer.Write(row)
+	if err != nil {
+		return err
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func (w *csvWriter) pending() int64 { return 0 }
+func (w *csvWriter) close() error   { return nil }
+
+// csvValue formats a typed record value as a CSV field
+func csvValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		data, err := appendJSONFloat(nil, v)
+		return string(data), err
+	case bool:
+		return strconv.FormatBool(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// parquetFormat writes every batch as a Parquet file with one column per
+// output column, typed from the SFM column types. Every column is optional
+// so that nulls can be stored, and the writer records min, max and null
+// count statistics for every column chunk.
+type parquetFormat struct {
+	encoder  *recordEncoder
+	metadata []string
+	// rowGroupRows is the number of records per row group, 0 for one row
+	// group per batch
+	rowGroupRows int
+	compression  parquet.CompressionCodec
+}
+
+// newParquetFormat creates the Parquet schema for the encoder's output columns
+func newParquetFormat(config *Config, encoder *recordEncoder) (*parquetFormat, error) {
+	// Parquet columns hold a single type, so raw strings cannot be kept
+	// for values that do not match it
+	if config.Types.OnError == "string" {
+		return nil, fmt.Errorf("types.on_error: string is not supported by the parquet format")
+	}
+
+	f := &parquetFormat{
+		encoder:      encoder,
+		rowGroupRows: config.Export.RowGroupRows,
+		compression:  parquet.CompressionCodec_UNCOMPRESSED,
+	}
+	if f.rowGroupRows <= 0 {
+		f.rowGroupRows = config.Export.BatchSize
+	}
+	if config.Export.Compression {
+		f.compression = parquet.CompressionCodec_SNAPPY
+	}
+
+	for i, name := range encoder.names {
+		// The schema is declared as comma-separated key=value pairs
+		if strings.ContainsAny(name, ",=") {
+			return nil, fmt.Errorf("column name %q cannot be used in a parquet schema", name)
+		}
+
+		var columnType string
+		switch encoder.types[i] {
+		case sfm.TypeInt:
+			columnType = "type=INT64"
+		case sfm.TypeFloat:
+			columnType = "type=DOUBLE"
+		case sfm.TypeBool:
+			columnType = "type=BOOLEAN"
+		case sfm.TypeTime:
+			columnType = "type=INT64, convertedtype=TIMESTAMP_MILLIS"
+		default:
+			columnType = "type=BYTE_ARRAY, convertedtype=UTF8"
+		}
+		f.metadata = append(f.metadata, fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", name, columnType))
+	}
+
+	return f, nil
+}
+
+func (*parquetFormat) name() string        { return "parquet" }
+func (*parquetFormat) extension() string   { return ".parquet" }
+func (*parquetFormat) contentType() string { return "application/vnd.apache.parquet" }
+func (*parquetFormat) compressible() bool  { return false }
+
+func (f *parquetFormat) newWriter(w io.Writer) (recordWriter, error) {
+	parquetWriter, err := writer.NewCSVWriterFromWriter(f.metadata, w, 1)
+	if err != nil {
+		return nil, fmt.Errorf("error creating parquet writer: %w", err)
+	}
+	parquetWriter.CompressionType = f.compression
+
+	return &parquetRecordWriter{format: f, writer: parquetWriter}, nil
+}
+
+// parquetRecordWriter writes records as the rows of a Parquet file. Rows
+// are kept in memory until their row group is complete.
+type parquetRecordWriter struct {
+	format *parquetFormat
+	writer *writer.CSVWriter
+	rows   int
+}
+
+func (w *parquetRecordWriter) write(record []interface{}) error {
+	// The writer keeps the row until the row group is flushed
+	row := make([]interface{}, len(w.format.encoder.indexes))
+	for i, index := range w.format.encoder.indexes {
+		row[i] = parquetValue(record[index])
+	}
+
+	err := w.writer.Write(row)
+	if err != nil {
+		return fmt.Errorf("error writing parquet row: %w", err)
+	}
+	w.rows++
+
+	// Close the row group once it is full
+	if w.format.rowGroupRows > 0 && w.rows%w.format.rowGroupRows == 0 {
+		err = w.writer.Flush(true)
+		if err != nil {
+			return fmt.Errorf("error writing parquet row group: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// pending is the writer's own estimate of the pages and rows it holds
+func (w *parquetRecordWriter) pending() int64 {
+	return w.writer.Size + w.writer.ObjsSize
+}
+
+func (w *parquetRecordWriter) close() error {
+	// Write the last row group and the footer
+	err := w.writer.WriteStop()
+	if err != nil {
+		return fmt.Errorf("error finishing parquet file: %w", err)
+	}
+
+	return nil
+}
+
+// parquetValue converts a typed record value to its Parquet representation
+func parquetValue(value interface{}) interface{} {
+	if t, ok := value.(time.Time); ok {
+		return t.UnixMilli()
+	}
+	return value
+}
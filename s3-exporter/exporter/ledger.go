@@ -0,0 +1,289 @@
+package exporter
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"s3-exporter/sfm"
+)
+
+// LedgerFileName is the name of the ledger file inside the state directory
+const LedgerFileName = "ledger.jsonl"
+
+// ExportState records which segment files have been exported
+type ExportState interface {
+	// IsExported reports whether sfmFile has already been exported
+	IsExported(sfmFile string) (bool, error)
+	// MarkExported records that sfmFile has been exported
+	MarkExported(sfmFile string) error
+}
+
+// OpenExportState opens the export state store selected by config.State.Backend
+func OpenExportState(config *Config) (ExportState, error) {
+	delimiter, err := sfm.ParseDelimiter(config.Source.Delimiter)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.State.Backend {
+	case "", "ledger":
+		ledger, err := OpenLedger(config.State.Dir)
+		if err != nil {
+			return nil, err
+		}
+		ledger.delimiter = delimiter
+		return ledger, nil
+	case "inline":
+		return InlineState{Delimiter: delimiter}, nil
+	}
+	return nil, fmt.Errorf("unknown export state backend: %q", config.State.Backend)
+}
+
+// InlineState is the legacy ExportState that keeps a jsonS3Exported flag
+// inside every segment file
+type InlineState struct {
+	Delimiter rune // field delimiter of the segment files
+}
+
+// IsExported checks the jsonS3Exported flag of sfmFile
+func (s InlineState) IsExported(sfmFile string) (bool, error) {
+	return checkIfExported(sfmFile, s.Delimiter)
+}
+
+// MarkExported sets the jsonS3Exported flag of sfmFile
+func (s InlineState) MarkExported(sfmFile string) error {
+	return markAsExported(sfmFile, s.Delimiter)
+}
+
+// LedgerEntry is one line of the export ledger
+type LedgerEntry struct {
+	Path       string    `json:"path"`
+	SHA256     string    `json:"sha256"`
+	Size       int64     `json:"size"`
+	ExportedAt time.Time `json:"exported_at"`
+	Source     string    `json:"source"` // export, or migration for imported in-file flags
+}
+
+// Ledger is an ExportState kept in an append-only log next to, rather than
+// inside, the segment files. Entries are keyed by the absolute path of the
+// segment and the SHA-256 of its content, so a segment whose content
+// changes after export is exported again. Segment files are never modified.
+type Ledger struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]map[string]LedgerEntry // path -> sha256 -> entry
+	// torn is set when the ledger ends in a partial line, which the next
+	// append must not be glued onto
+	torn bool
+	// delimiter separates the fields of segment files the ledger has never
+	// seen, whose jsonS3Exported flag is read
+	delimiter rune
+}
+
+// OpenLedger opens the ledger in dir, creating the directory if needed
+func OpenLedger(dir string) (*Ledger, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no state directory configured")
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating state directory: %w", err)
+	}
+
+	ledger := &Ledger{
+		path:      filepath.Join(dir, LedgerFileName),
+		entries:   make(map[string]map[string]LedgerEntry),
+		delimiter: sfm.DefaultDelimiter,
+	}
+
+	err = ledger.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return ledger, nil
+}
+
+// load reads every entry of the ledger file
+func (l *Ledger) load() error {
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening ledger: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	lineNum := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			lineNum++
+			var entry LedgerEntry
+			if jsonErr := json.Unmarshal(line, &entry); jsonErr != nil {
+				// A torn line is what a crash during an append leaves behind
+				log.Printf("Ignoring unreadable ledger entry at %s:%d: %v", l.path, lineNum, jsonErr)
+			} else {
+				l.add(entry)
+			}
+		}
+		if err == io.EOF {
+			l.torn = len(line) > 0
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading ledger: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// add indexes an entry in memory
+func (l *Ledger) add(entry LedgerEntry) {
+	if l.entries[entry.Path] == nil {
+		l.entries[entry.Path] = make(map[string]LedgerEntry)
+	}
+	l.entries[entry.Path][entry.SHA256] = entry
+}
+
+// IsExported reports whether the current content of sfmFile is in the
+// ledger. Segments the ledger has never seen may have been exported before
+// it existed, so their jsonS3Exported flag is imported instead.
+func (l *Ledger) IsExported(sfmFile string) (bool, error) {
+	path, err := filepath.Abs(sfmFile)
+	if err != nil {
+		return false, fmt.Errorf("error resolving segment path: %w", err)
+	}
+
+	// Avoid hashing files the ledger has never seen
+	l.mu.Lock()
+	known := len(l.entries[path]) > 0
+	l.mu.Unlock()
+	if !known {
+		return l.ImportInlineFlag(sfmFile, l.delimiter)
+	}
+
+	return l.recorded(sfmFile, path)
+}
+
+// recorded reports whether the current content of the segment file at the
+// absolute path is in the ledger
+func (l *Ledger) recorded(sfmFile, path string) (bool, error) {
+	hash, _, err := segmentHash(sfmFile)
+	if err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.entries[path][hash]
+	return ok, nil
+}
+
+// MarkExported appends an entry for the current content of sfmFile
+func (l *Ledger) MarkExported(sfmFile string) error {
+	return l.record(sfmFile, "export")
+}
+
+// ImportInlineFlag migrates the jsonS3Exported flag of a segment file,
+// whose fields are separated by delimiter, into the ledger. It reports
+// whether the file was flagged as exported.
+func (l *Ledger) ImportInlineFlag(sfmFile string, delimiter rune) (bool, error) {
+	exported, err := checkIfExported(sfmFile, delimiter)
+	if err != nil || !exported {
+		return false, err
+	}
+
+	path, err := filepath.Abs(sfmFile)
+	if err != nil {
+		return true, fmt.Errorf("error resolving segment path: %w", err)
+	}
+	already, err := l.recorded(sfmFile, path)
+	if err != nil || already {
+		return true, err
+	}
+
+	return true, l.record(sfmFile, "migration")
+}
+
+// record appends an entry for the current content of sfmFile
+func (l *Ledger) record(sfmFile, source string) error {
+	path, err := filepath.Abs(sfmFile)
+	if err != nil {
+		return fmt.Errorf("error resolving segment path: %w", err)
+	}
+
+	hash, size, err := segmentHash(sfmFile)
+	if err != nil {
+		return err
+	}
+
+	entry := LedgerEntry{
+		Path:       path,
+		SHA256:     hash,
+		Size:       size,
+		ExportedAt: time.Now().UTC(),
+		Source:     source,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshaling ledger entry: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening ledger: %w", err)
+	}
+	defer file.Close()
+
+	if l.torn {
+		line = append([]byte{'\n'}, line...)
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("error writing ledger: %w", err)
+	}
+
+	// Make sure the entry survives a crash before reporting success
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing ledger: %w", err)
+	}
+
+	l.torn = false
+	l.add(entry)
+	return nil
+}
+
+// segmentHash returns the SHA-256 and size of a segment file
+func segmentHash(sfmFile string) (string, int64, error) {
+	file, err := os.Open(sfmFile)
+	if err != nil {
+		return "", 0, fmt.Errorf("error opening SFM file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, fmt.Errorf("error reading SFM file: %w", err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
@@ -0,0 +1,137 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"s3-exporter/sfm"
+	"s3-exporter/src"
+)
+
+// ManifestFileName is the name of the manifest object written next to the
+// batches of a segment. It is written last, so its presence means every
+// batch it lists has been uploaded.
+const ManifestFileName = "manifest.json"
+
+// ManifestVersion is the version of the manifest format
+const ManifestVersion = 1
+
+// ManifestBatch describes one uploaded batch object
+type ManifestBatch struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	Records     int    `json:"records"`
+	Checksum    string `json:"checksum"`
+	Compression string `json:"compression"`
+	// NulledValues counts the values of the batch written as null because
+	// they did not match their column type
+	NulledValues int `json:"nulled_values,omitempty"`
+}
+
+// Manifest lists every batch object that makes up an exported segment
+type Manifest struct {
+	Version      int             `json:"version"`
+	SourceFile   string          `json:"source_file"`
+	Columns      []string        `json:"columns"`
+	ColumnTypes  []sfm.Type      `json:"column_types,omitempty"`
+	RunTimestamp time.Time       `json:"run_timestamp"`
+	Format       string          `json:"format"`
+	Compression  string          `json:"compression"`
+	TotalRecords int             `json:"total_records"`
+	TotalSize    int64           `json:"total_size"`
+	NulledValues int             `json:"nulled_values,omitempty"`
+	Batches      []ManifestBatch `json:"batches"`
+	// Rollup describes the rolled-up series, if rollups are enabled
+	Rollup *ManifestRollup `json:"rollup,omitempty"`
+}
+
+// ManifestKey returns the object key of the manifest for a segment prefix
+func ManifestKey(prefix string) string {
+	return path.Join(prefix, ManifestFileName)
+}
+
+// SegmentPrefix returns the key prefix the objects of an exported segment
+// file are stored under: the base name of the file without its extension
+func SegmentPrefix(sfmFile string) string {
+	base := filepath.Base(sfmFile)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// CheckSegmentPrefixes returns the segment files that can be exported and
+// an error naming those that share a key prefix with another file, such as
+// same-named files in different directories. Their exports would overwrite
+// each other's batches and manifest, so none of them is exported.
+func CheckSegmentPrefixes(sfmFiles []string) ([]string, error) {
+	byPrefix := make(map[string][]string, len(sfmFiles))
+	for _, sfmFile := range sfmFiles {
+		prefix := SegmentPrefix(sfmFile)
+		byPrefix[prefix] = append(byPrefix[prefix], sfmFile)
+	}
+
+	var exportable []string
+	var conflicts []string
+	for _, sfmFile := range sfmFiles {
+		prefix := SegmentPrefix(sfmFile)
+		files := byPrefix[prefix]
+		if len(files) == 1 {
+			exportable = append(exportable, sfmFile)
+			continue
+		}
+		// Report each conflict once, at its first file
+		if files[0] == sfmFile {
+			conflicts = append(conflicts, fmt.Sprintf("%s would all be exported under %s/", strings.Join(files, ", "), prefix))
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return exportable, fmt.Errorf("segment files share a key prefix: %s", strings.Join(conflicts, "; "))
+	}
+	return exportable, nil
+}
+
+// AddBatch records an uploaded batch in the manifest
+func (m *Manifest) AddBatch(batch ManifestBatch) {
+	m.Batches = append(m.Batches, batch)
+	m.TotalRecords += batch.Records
+	m.TotalSize += batch.Size
+	m.NulledValues += batch.NulledValues
+}
+
+// WriteManifest stores the manifest for the segment under prefix
+func WriteManifest(store src.ObjectStore, prefix string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling manifest: %w", err)
+	}
+
+	err = store.Put(ManifestKey(prefix), bytes.NewReader(data), src.PutOptions{ContentType: "application/json"})
+	if err != nil {
+		return fmt.Errorf("error uploading manifest: %w", err)
+	}
+
+	return nil
+}
+
+// ReadManifest loads the manifest of the segment under prefix. The error
+// wraps src.ErrNotFound if the segment has no manifest, i.e. its export is
+// missing or incomplete.
+func ReadManifest(store src.ObjectStore, prefix string) (*Manifest, error) {
+	body, err := store.Get(ManifestKey(prefix))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	manifest := &Manifest{}
+	err = json.NewDecoder(body).Decode(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest: %w", err)
+	}
+
+	return manifest, nil
+}
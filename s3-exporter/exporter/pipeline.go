@@ -0,0 +1,221 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"s3-exporter/rollup"
+	"s3-exporter/sfm"
+)
+
+// errPipelineStopped is returned by a stage that stopped because another
+// stage failed
+var errPipelineStopped = errors.New("pipeline stopped")
+
+// recordChunkSize is the number of records passed between stages at a time
+const recordChunkSize = 256
+
+// recordChunk is a run of consecutive records read from a segment file
+type recordChunk struct {
+	records [][]interface{}
+	// ends holds the position just after each record
+	ends []sfm.Position
+	// nulled holds the number of values of each record written as null
+	// because they did not match their column type
+	nulled []int
+}
+
+// pipeline runs the stages of a segment export concurrently. The stages are
+// connected by buffered channels, so each one works on different records.
+// The first stage to fail stops all the others.
+type pipeline struct {
+	wg   sync.WaitGroup
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// newPipeline creates an empty pipeline
+func newPipeline() *pipeline {
+	return &pipeline{done: make(chan struct{})}
+}
+
+// run starts a stage in its own goroutine
+func (p *pipeline) run(stage func() error) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		err := stage()
+		if err != nil {
+			p.fail(err)
+		}
+	}()
+}
+
+// fail stops the pipeline, keeping the first error
+func (p *pipeline) fail(err error) {
+	p.once.Do(func() {
+		p.err = err
+		close(p.done)
+	})
+}
+
+// wait waits for every stage and returns the first error
+func (p *pipeline) wait() error {
+	p.wg.Wait()
+	if p.err == errPipelineStopped {
+		return nil
+	}
+	return p.err
+}
+
+// parseStage reads the records of a segment file, converts their fields to
+// the column types of s, adds them to engine if not nil and sends them on
+// out in chunks, unless out is nil. Malformed records are skipped.
+func (p *pipeline) parseStage(reader *sfm.Reader, s *schema, engine *rollup.Engine, out chan<- recordChunk) error {
+	if out != nil {
+		defer close(out)
+	}
+
+	var chunk recordChunk
+	skipped := 0
+	mistyped := 0
+	untimed := 0
+	var converted conversion
+
+	send := func() bool {
+		if out == nil {
+			chunk = recordChunk{}
+			return true
+		}
+
+		select {
+		case out <- chunk:
+			chunk = recordChunk{}
+			return true
+		case <-p.done:
+			return false
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		// Skip malformed records
+		var syntaxErr *sfm.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			if skipped == 0 {
+				log.Printf("Skipping malformed record: %v", syntaxErr)
+			}
+			skipped++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading SFM file: %w", err)
+		}
+
+		values, counts, err := s.convert(record)
+		if err == errSkipRecord {
+			mistyped++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error converting record: %w", err)
+		}
+
+		if engine != nil && engine.Add(values) == rollup.ErrNoTimestamp {
+			untimed++
+		}
+
+		converted.nulled += counts.nulled
+		converted.widened += counts.widened
+
+		chunk.records = append(chunk.records, values)
+		chunk.ends = append(chunk.ends, reader.Position())
+		chunk.nulled = append(chunk.nulled, counts.nulled)
+
+		if len(chunk.records) >= recordChunkSize && !send() {
+			return errPipelineStopped
+		}
+	}
+
+	if skipped > 0 {
+		log.Printf("Skipped %d malformed records", skipped)
+	}
+	if mistyped > 0 {
+		log.Printf("Skipped %d records with values that do not match their column type", mistyped)
+	}
+	if converted.nulled > 0 {
+		log.Printf("Wrote %d values that do not match their column type as null", converted.nulled)
+	}
+	if converted.widened > 0 {
+		log.Printf("Wrote %d values of int columns with a fraction as floats", converted.widened)
+	}
+	if untimed > 0 {
+		log.Printf("Left %d records without a timestamp out of the rollups", untimed)
+	}
+
+	// Send the last records if there are any
+	if len(chunk.records) > 0 && !send() {
+		return errPipelineStopped
+	}
+
+	return nil
+}
+
+// batchStage writes the records with writer and sends every completed batch on out
+func (p *pipeline) batchStage(in <-chan recordChunk, writer *batchWriter, out chan<- *writtenBatch) error {
+	defer close(out)
+	// Discard a batch left open by an error
+	defer writer.abort()
+
+	send := func(batch *writtenBatch) bool {
+		select {
+		case out <- batch:
+			return true
+		case <-p.done:
+			batch.buffer.remove()
+			return false
+		}
+	}
+
+	// Values nulled in the records of the open batch
+	nulled := 0
+
+	for chunk := range in {
+		for i, record := range chunk.records {
+			batch, err := writer.write(record, chunk.ends[i])
+			if err != nil {
+				return err
+			}
+			nulled += chunk.nulled[i]
+			if batch == nil {
+				continue
+			}
+			batch.nulled, nulled = nulled, 0
+			if !send(batch) {
+				return errPipelineStopped
+			}
+		}
+	}
+
+	// Complete the last batch, if the last record did not
+	batch, err := writer.close()
+	if err != nil {
+		return err
+	}
+	if batch != nil {
+		batch.nulled = nulled
+	}
+	if batch != nil && !send(batch) {
+		return errPipelineStopped
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"s3-exporter/rollup"
+	"s3-exporter/sfm"
+	"s3-exporter/src"
+)
+
+// ManifestRollup describes the rolled-up series of a segment
+type ManifestRollup struct {
+	Timestamp   string     `json:"timestamp"`
+	Values      []string   `json:"values"`
+	Tags        []string   `json:"tags"`
+	Columns     []string   `json:"columns"`
+	ColumnTypes []sfm.Type `json:"column_types"`
+	// Kinds holds the metric kind of value columns that are not gauges
+	Kinds map[string]rollup.Kind `json:"kinds,omitempty"`
+	// FoldedSeries counts the series beyond MaxSeries folded into the
+	// series tagged __other__
+	MaxSeries    int `json:"max_series,omitempty"`
+	FoldedSeries int `json:"folded_series,omitempty"`
+	// Intervals lists one object per interval holding every series
+	Intervals []ManifestInterval `json:"intervals"`
+}
+
+// ManifestInterval describes the object holding the rollups of one interval
+type ManifestInterval struct {
+	Interval string `json:"interval"`
+	ManifestBatch
+}
+
+// newRollupEngine creates the rollup engine for records with the given
+// columns and types, or returns nil if rollups are disabled
+func newRollupEngine(config *Config, columns []string, types []sfm.Type) (*rollup.Engine, error) {
+	if !config.Rollup.Enabled {
+		return nil, nil
+	}
+
+	spec, err := config.RollupSpec()
+	if err != nil {
+		return nil, fmt.Errorf("error in rollup settings: %w", err)
+	}
+
+	engine, err := rollup.NewEngine(spec, columns, types)
+	if err != nil {
+		return nil, fmt.Errorf("error in rollup settings: %w", err)
+	}
+	return engine, nil
+}
+
+// rollupExported adds the records of sfmFile before offset to engine.
+// These records were uploaded by an interrupted export, whose parse stage
+// has already reported any that it skipped.
+func rollupExported(sfmFile string, delimiter rune, s *schema, engine *rollup.Engine, offset int64) error {
+	file, err := os.Open(sfmFile)
+	if err != nil {
+		return fmt.Errorf("error opening SFM file: %w", err)
+	}
+	defer file.Close()
+
+	reader := sfm.NewReader(file, delimiter)
+	_, err = reader.ReadHeader()
+	if err != nil {
+		return fmt.Errorf("error reading SFM header: %w", err)
+	}
+
+	for reader.Position().Offset < offset {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			continue
+		}
+
+		values, _, err := s.convert(record)
+		if err != nil {
+			continue
+		}
+		engine.Add(values)
+	}
+
+	return nil
+}
+
+// uploadRollups uploads the rows of every interval of engine as one object
+// under prefix, in the output format and compressed with codec, and returns
+// their manifest entry. Intervals without rows are left out.
+func uploadRollups(store src.ObjectStore, config *Config, engine *rollup.Engine, codec src.Codec, prefix string, newBuffer func(key string, opts src.PutOptions) (batchBuffer, error)) (*ManifestRollup, error) {
+	if n := engine.OutOfOrder(); n > 0 {
+		log.Printf("Left %d out-of-order counter samples out of the rollups", n)
+	}
+	if n := engine.Folded(); n > 0 {
+		log.Printf("Folded %d series beyond max_series into %s", n, rollup.OtherSeries)
+	}
+
+	spec := engine.Spec()
+	manifest := &ManifestRollup{
+		Timestamp:    spec.Timestamp,
+		Values:       spec.Values,
+		Tags:         spec.Tags,
+		Kinds:        spec.Kinds,
+		MaxSeries:    spec.MaxSeries,
+		FoldedSeries: engine.Folded(),
+		Columns:      engine.Columns(),
+		ColumnTypes:  engine.Types(),
+	}
+
+	// Rollup rows are written whole; the column settings only apply to
+	// raw records
+	encoder, err := newRecordEncoder(manifest.Columns, manifest.ColumnTypes, &Config{})
+	if err != nil {
+		return nil, err
+	}
+	format, err := newOutputFormat(config, encoder)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := putOptions(format, codec)
+	for i, interval := range spec.Intervals {
+		key := fmt.Sprintf("%s/rollup-%s%s", prefix, interval.Name, batchExtension(format, codec))
+		writer := newBatchWriter(format, codec, batchLimits{}, 0, func(int) (batchBuffer, error) {
+			return newBuffer(key, opts)
+		})
+		for _, row := range engine.Rows(i) {
+			_, err = writer.write(row, sfm.Position{})
+			if err != nil {
+				writer.abort()
+				return nil, err
+			}
+		}
+
+		batch, err := writer.close()
+		if err != nil {
+			return nil, err
+		}
+		if batch == nil {
+			continue
+		}
+
+		manifestBatch, err := uploadBatch(store, key, format, codec, batch)
+		batch.buffer.remove()
+		if err != nil {
+			return nil, err
+		}
+
+		manifest.Intervals = append(manifest.Intervals, ManifestInterval{Interval: interval.Name, ManifestBatch: manifestBatch})
+	}
+
+	return manifest, nil
+}
@@ -0,0 +1,147 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"s3-exporter/sfm"
+)
+
+// errSkipRecord is returned by schema.convert for records dropped by the
+// skip policy
+var errSkipRecord = errors.New("record skipped")
+
+// schema converts the fields of SFM records into typed values
+type schema struct {
+	columns []string
+	types   []sfm.Type
+	// onError is the policy for values that do not convert to their
+	// column type: null, string, skip or fail
+	onError string
+	// widen writes values of int columns that only convert to a float as
+	// floats. It is off for formats whose columns have a fixed physical type.
+	widen bool
+}
+
+// conversion counts the values of a record that were not written as their
+// column type
+type conversion struct {
+	nulled  int // written as null by the null policy
+	widened int // int column values written as floats
+}
+
+// newSchema returns the schema of a segment file. Declared column types
+// come from the header; the types of other columns are inferred from the
+// first config.Types.SampleRows records if inference is enabled, or are
+// taken from an earlier run if known.
+func newSchema(sfmFile string, delimiter rune, header *sfm.Header, known []sfm.Type, config *Config) (*schema, error) {
+	s := &schema{
+		columns: header.Columns,
+		types:   make([]sfm.Type, len(header.Columns)),
+		onError: config.Types.OnError,
+		widen:   config.Export.Format != "parquet",
+	}
+
+	// Keep the types of an interrupted export
+	if len(known) == len(header.Columns) {
+		copy(s.types, known)
+		return s, nil
+	}
+
+	undeclared := false
+	for i := range s.types {
+		if header.Types != nil && header.Types[i] != "" {
+			s.types[i] = header.Types[i]
+			continue
+		}
+		s.types[i] = sfm.TypeString
+		undeclared = true
+	}
+
+	if undeclared && config.Types.Infer {
+		samples, err := sampleColumns(sfmFile, delimiter, config.Types.SampleRows)
+		if err != nil {
+			return nil, err
+		}
+		for i := range s.types {
+			if header.Types == nil || header.Types[i] == "" {
+				s.types[i] = sfm.InferType(samples[i])
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// sampleColumns returns the values of each column in the first rows records of sfmFile
+func sampleColumns(sfmFile string, delimiter rune, rows int) ([][]string, error) {
+	file, err := os.Open(sfmFile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening SFM file: %w", err)
+	}
+	defer file.Close()
+
+	reader := sfm.NewReader(file, delimiter)
+	header, err := reader.ReadHeader()
+	if err != nil {
+		return nil, fmt.Errorf("error reading SFM header: %w", err)
+	}
+
+	samples := make([][]string, len(header.Columns))
+	for n := 0; n < rows; {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var syntaxErr *sfm.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error sampling SFM file: %w", err)
+		}
+
+		for i, field := range record.Fields {
+			samples[i] = append(samples[i], field)
+		}
+		n++
+	}
+
+	return samples, nil
+}
+
+// convert converts the fields of a record to their column types and counts
+// the values that could not keep their type. It returns errSkipRecord if a
+// value does not convert and the policy is skip.
+func (s *schema) convert(record sfm.Record) ([]interface{}, conversion, error) {
+	var counts conversion
+	values := make([]interface{}, len(record.Fields))
+	for i, field := range record.Fields {
+		value, err := s.types[i].Convert(field)
+		if err != nil && s.widen && s.types[i] == sfm.TypeInt {
+			// A fraction in an int column, such as an inferred one, is
+			// still a number
+			if widened, floatErr := sfm.TypeFloat.Convert(field); floatErr == nil {
+				value, err = widened, nil
+				counts.widened++
+			}
+		}
+		if err != nil {
+			switch s.onError {
+			case "string":
+				value = field
+			case "skip":
+				return nil, conversion{}, errSkipRecord
+			case "fail":
+				return nil, conversion{}, fmt.Errorf("line %d: column %s: %w", record.Line, s.columns[i], err)
+			default:
+				value = nil
+				counts.nulled++
+			}
+		}
+		values[i] = value
+	}
+	return values, counts, nil
+}
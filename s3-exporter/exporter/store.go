@@ -0,0 +1,38 @@
+package exporter
+
+import (
+	"fmt"
+	"log"
+
+	"s3-exporter/src"
+)
+
+// NewObjectStore creates the object store selected by config.Storage.Backend,
+// wrapped so that failed operations are retried with config.Retry.
+// The store is meant to be created once and shared by every export in a run.
+func NewObjectStore(config *Config) (src.ObjectStore, error) {
+	store, err := newBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	return src.NewRetryingStore(store, config.RetryPolicy()), nil
+}
+
+// newBackend creates the storage backend without any retry handling
+func newBackend(config *Config) (src.ObjectStore, error) {
+	switch config.Storage.Backend {
+	case "", "s3":
+		if config.S3.AccessKey != "" || config.S3.SecretKey != "" {
+			log.Printf("Warning: static access_key/secret_key in the config are deprecated, use the AWS credential chain instead")
+		}
+		opts := config.S3Options()
+		// Every attempt is made by the RetryingStore wrapping the backend
+		opts.DisableSDKRetries = true
+		return src.NewS3Store(opts)
+	case "local":
+		return src.NewLocalStore(config.Storage.LocalDir)
+	case "memory":
+		return src.NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %q", config.Storage.Backend)
+}
@@ -6,6 +6,8 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+
+	"s3-exporter/sfm"
 )
 
 // GenerateOutputFileName generates a filename for the exported JSON
@@ -35,7 +37,9 @@ func CleanupTempFiles(files []string) {
 	}
 }
 
-// ParseSfmLine parses a line from an SFM file and returns a map of values
+// ParseSfmLine parses a line from an SFM file and returns a map of values.
+// Fields are comma-separated and may be quoted; a record whose quoted
+// fields span several lines must be read with sfm.Reader instead.
 func ParseSfmLine(line string, columnNames []string) (map[string]string, error) {
 	// Skip comments and empty lines
 	if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
@@ -43,7 +47,10 @@ func ParseSfmLine(line string, columnNames []string) (map[string]string, error)
 	}
 	
 	// Split the line into fields
-	fields := strings.Split(line, ",")
+	fields, err := sfm.ParseLine(line, sfm.DefaultDelimiter)
+	if err != nil {
+		return nil, err
+	}
 	
 	// Check if we have the correct number of fields
 	if len(fields) != len(columnNames) {
@@ -53,7 +60,7 @@ func ParseSfmLine(line string, columnNames []string) (map[string]string, error)
 	// Create a map of field name to value
 	result := make(map[string]string)
 	for i, name := range columnNames {
-		result[name] = strings.TrimSpace(fields[i])
+		result[name] = fields[i]
 	}
 	
 	return result, nil
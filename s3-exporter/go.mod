@@ -4,10 +4,18 @@ go 1.21
 
 require (
 	github.com/aws/aws-sdk-go v1.49.0
+	github.com/golang/snappy v0.0.3
+	github.com/klauspost/compress v1.15.9
+	github.com/pierrec/lz4/v4 v4.1.8
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20241021075129-b732d2ac9c9b
 	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
+	github.com/apache/arrow/go/arrow v0.0.0-20200730104253-651201b0f516 // indirect
+	github.com/apache/thrift v0.14.2 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 )
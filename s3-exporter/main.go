@@ -6,24 +6,33 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"s3-exporter/exporter"
+	"s3-exporter/rollup"
+	"s3-exporter/sfm"
+	"s3-exporter/src"
 )
 
 func main() {
+	// The autorollup command rolls up exported segments instead of exporting
+	if len(os.Args) > 1 && os.Args[1] == "autorollup" {
+		autoRollup(os.Args[2:])
+		return
+	}
+
 	// Setup command-line flags
 	configFile := flag.String("config", "config/config.yaml", "Path to configuration file")
 	dataDir := flag.String("data", "data", "Directory containing SFM files")
 	logFile := flag.String("log", "logs/app.log", "Path to log file")
+	migrate := flag.Bool("migrate", false, "Import jsonS3Exported flags from the SFM files into the export ledger before exporting")
 	flag.Parse()
 
 	// Set up logging
-	f, err := os.OpenFile(*logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalf("Error opening log file: %v", err)
-	}
+	f := openLog(*logFile)
 	defer f.Close()
-	log.SetOutput(f)
 	log.Println("S3 Exporter started")
 
 	// Load configuration
@@ -32,6 +41,12 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Create the object store shared by every export
+	store, err := exporter.NewObjectStore(config)
+	if err != nil {
+		log.Fatalf("Failed to create object store: %v", err)
+	}
+
 	// Find all SFM files
 	var sfmFiles []string
 	err = filepath.Walk(*dataDir, func(path string, info os.FileInfo, err error) error {
@@ -47,35 +62,145 @@ func main() {
 		log.Fatalf("Error finding SFM files: %v", err)
 	}
 
-	// Process each SFM file
-	for _, sfmFile := range sfmFiles {
-		log.Printf("Processing SFM file: %s", sfmFile)
-		
-		// Check if the file has already been exported
-		exported, err := exporter.CheckIfExported(sfmFile)
-		if err != nil {
-			log.Printf("Error checking export status for %s: %v", sfmFile, err)
-			continue
-		}
-		
-		if exported {
-			log.Printf("File %s already exported, skipping", sfmFile)
-			continue
+	// Segments are stored under their base name, so same-named files from
+	// different directories are skipped rather than overwriting each other
+	sfmFiles, err = exporter.CheckSegmentPrefixes(sfmFiles)
+	if err != nil {
+		log.Printf("Skipping SFM files: %v", err)
+	}
+
+	// Open the export state store
+	state, err := exporter.OpenExportState(config)
+	if err != nil {
+		log.Fatalf("Failed to open export state: %v", err)
+	}
+
+	// Import the in-file flags of segments exported before the ledger existed
+	if *migrate {
+		ledger, ok := state.(*exporter.Ledger)
+		if !ok {
+			log.Fatalf("Migration requires the ledger export state backend")
 		}
-		
-		// Start the conversion process
-		err = exporter.ConvertAndUpload(sfmFile, config)
+		delimiter, err := sfm.ParseDelimiter(config.Source.Delimiter)
 		if err != nil {
-			log.Printf("Error processing %s: %v", sfmFile, err)
-			continue
+			log.Fatalf("Invalid source delimiter: %v", err)
 		}
-		
-		// Mark as exported
-		err = exporter.MarkAsExported(sfmFile)
-		if err != nil {
-			log.Printf("Error marking %s as exported: %v", sfmFile, err)
+		imported := 0
+		for _, sfmFile := range sfmFiles {
+			exported, err := ledger.ImportInlineFlag(sfmFile, delimiter)
+			if err != nil {
+				log.Printf("Error migrating export flag of %s: %v", sfmFile, err)
+				continue
+			}
+			if exported {
+				imported++
+			}
 		}
+		log.Printf("Migrated %d exported segments into the ledger", imported)
+	}
+
+	// Process the SFM files with a pool of workers
+	workers := config.Export.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sfmFile := range jobs {
+				processFile(sfmFile, config, store, state)
+			}
+		}()
+	}
+	for _, sfmFile := range sfmFiles {
+		jobs <- sfmFile
 	}
+	close(jobs)
+	wg.Wait()
 
 	fmt.Println("S3 Export process completed. Check logs for details.")
-}
\ No newline at end of file
+}
+
+// processFile exports a single SFM file unless it has already been exported
+func processFile(sfmFile string, config *exporter.Config, store src.ObjectStore, state exporter.ExportState) {
+	log.Printf("Processing SFM file: %s", sfmFile)
+
+	// Check if the file has already been exported
+	exported, err := state.IsExported(sfmFile)
+	if err != nil {
+		log.Printf("Error checking export status for %s: %v", sfmFile, err)
+		return
+	}
+
+	if exported {
+		log.Printf("File %s already exported, skipping", sfmFile)
+		return
+	}
+
+	// Start the conversion process
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		log.Printf("Error processing %s: %v", sfmFile, err)
+		return
+	}
+
+	// Mark as exported
+	err = state.MarkExported(sfmFile)
+	if err != nil {
+		log.Printf("Error marking %s as exported: %v", sfmFile, err)
+	}
+}
+
+// openLog directs logging to the end of logFile
+func openLog(logFile string) *os.File {
+	f, err := os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatalf("Error opening log file: %v", err)
+	}
+	log.SetOutput(f)
+	return f
+}
+
+// autoRollup runs the autorollup command, which rolls up exported segments
+// into the configured tiers and deletes the data past its retention
+func autoRollup(args []string) {
+	flags := flag.NewFlagSet("autorollup", flag.ExitOnError)
+	configFile := flags.String("config", "config/config.yaml", "Path to configuration file")
+	logFile := flags.String("log", "logs/app.log", "Path to log file")
+	flags.Parse(args)
+
+	// Set up logging
+	f := openLog(*logFile)
+	defer f.Close()
+	log.Println("S3 Exporter autorollup started")
+
+	// Load configuration
+	config, err := exporter.LoadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	store, err := exporter.NewObjectStore(config)
+	if err != nil {
+		log.Fatalf("Failed to create object store: %v", err)
+	}
+
+	report, err := exporter.AutoRollup(store, config, time.Now())
+	if report != nil {
+		log.Printf("Rolled up %d segments, deleted %d segments past their retention", report.SegmentsRead, report.SegmentsDeleted)
+		for _, tier := range config.AutoRollup.Tiers {
+			log.Printf("Tier %s: wrote %d windows, deleted %d, folded %d series into %s", tier.Interval, report.Windows[tier.Interval], report.WindowsDeleted[tier.Interval], report.FoldedSeries[tier.Interval], rollup.OtherSeries)
+		}
+		if len(report.LateSegments) > 0 {
+			log.Printf("Warning: left %d late records out of windows that were already written; kept segments %s", report.LateRecords, strings.Join(report.LateSegments, ", "))
+		}
+	}
+	if err != nil {
+		log.Fatalf("Automatic rollup failed: %v", err)
+	}
+
+	fmt.Println("S3 Export autorollup completed. Check logs for details.")
+}
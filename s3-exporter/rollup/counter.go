@@ -0,0 +1,73 @@
+package rollup
+
+import "time"
+
+// addCounter adds a counter sample observed at t. Samples of a series must
+// arrive in time order; a sample older than the last one is left out and
+// addCounter returns false.
+func (s *stats) addCounter(value float64, t time.Time) bool {
+	if s.count == 0 {
+		s.first, s.firstTime = value, t
+		s.last, s.lastTime = value, t
+		s.count = 1
+		return true
+	}
+	if t.Before(s.lastTime) {
+		return false
+	}
+
+	// A counter that goes down has been reset to zero and counted up again
+	delta := value - s.last
+	if delta < 0 {
+		s.resets++
+		delta = value
+	}
+	s.increase += delta
+	s.last, s.lastTime = value, t
+	s.count++
+	return true
+}
+
+// counterIncrease returns the increase of a counter over the window of the
+// given duration starting at start, or false with fewer than two samples.
+// As with Prometheus' increase(), the increase between the first and last
+// sample is extrapolated towards the bounds of the window: all the way if
+// the samples come within 1.1 times their average spacing of a bound, and
+// by half that spacing otherwise, but never to before the counter was zero.
+// Counters merged from rolled-up rows are the sum of their increases.
+func (s *stats) counterIncrease(start time.Time, duration time.Duration) (float64, bool) {
+	if s.merged {
+		return s.increase, true
+	}
+
+	sampled := s.lastTime.Sub(s.firstTime).Seconds()
+	if s.count < 2 || sampled <= 0 {
+		return 0, false
+	}
+
+	toStart := s.firstTime.Sub(start).Seconds()
+	toEnd := start.Add(duration).Sub(s.lastTime).Seconds()
+	average := sampled / float64(s.count-1)
+
+	if s.increase > 0 && s.first >= 0 {
+		toZero := sampled * s.first / s.increase
+		if toZero < toStart {
+			toStart = toZero
+		}
+	}
+
+	threshold := average * 1.1
+	interval := sampled
+	if toStart < threshold {
+		interval += toStart
+	} else {
+		interval += average / 2
+	}
+	if toEnd < threshold {
+		interval += toEnd
+	} else {
+		interval += average / 2
+	}
+
+	return s.increase * interval / sampled, true
+}
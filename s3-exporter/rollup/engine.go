@@ -0,0 +1,699 @@
+package rollup
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"s3-exporter/sfm"
+)
+
+// ErrNoTimestamp is returned by Engine.Add for records without a timestamp
+var ErrNoTimestamp = errors.New("record has no timestamp")
+
+// OtherSeries is the value of every tag of the series that series beyond
+// the cardinality cap are folded into
+const OtherSeries = "__other__"
+
+// stats are the aggregates of one value column in one window
+type stats struct {
+	count     int64
+	sum       float64
+	min       float64
+	max       float64
+	first     float64
+	last      float64
+	firstTime time.Time
+	lastTime  time.Time
+	// sketch is nil unless percentiles or sketches are computed
+	sketch *QuantileSketch
+	// increase and resets hold the growth of counters
+	increase float64
+	resets   int64
+	// merged is set for counters merged from rolled-up rows, whose
+	// increases are already extrapolated to their windows
+	merged bool
+}
+
+// add adds a value observed at t
+func (s *stats) add(value float64, t time.Time) {
+	if s.count == 0 {
+		s.min, s.max = value, value
+		s.first, s.firstTime = value, t
+		s.last, s.lastTime = value, t
+	}
+	s.count++
+	s.sum += value
+	if value < s.min {
+		s.min = value
+	}
+	if value > s.max {
+		s.max = value
+	}
+	// Ties keep the first value seen as first and the last one as last
+	if t.Before(s.firstTime) {
+		s.first, s.firstTime = value, t
+	}
+	if !t.Before(s.lastTime) {
+		s.last, s.lastTime = value, t
+	}
+	if s.sketch != nil {
+		s.sketch.Add(value)
+	}
+}
+
+// merge adds the aggregates of o, whose sketch must have the accuracy of s
+func (s *stats) merge(o stats) {
+	if o.count == 0 {
+		return
+	}
+	if s.sketch != nil && o.sketch != nil {
+		s.sketch.merge(o.sketch)
+	}
+	if s.count == 0 {
+		sketch := s.sketch
+		*s = o
+		s.sketch = sketch
+		return
+	}
+
+	s.count += o.count
+	s.sum += o.sum
+	s.increase += o.increase
+	s.resets += o.resets
+	if o.min < s.min {
+		s.min = o.min
+	}
+	if o.max > s.max {
+		s.max = o.max
+	}
+	if o.firstTime.Before(s.firstTime) {
+		s.first, s.firstTime = o.first, o.firstTime
+	}
+	if !o.lastTime.Before(s.lastTime) {
+		s.last, s.lastTime = o.last, o.lastTime
+	}
+}
+
+// value returns an aggregate, nil if no value was added
+func (s *stats) value(aggregate Aggregate) interface{} {
+	if aggregate == Count {
+		return s.count
+	}
+	if s.count == 0 {
+		return nil
+	}
+
+	switch aggregate {
+	case Sum:
+		return s.sum
+	case Min:
+		return s.min
+	case Max:
+		return s.max
+	case Avg:
+		return s.sum / float64(s.count)
+	case First:
+		return s.first
+	case Last:
+		return s.last
+	case P50, P95, P99:
+		return s.quantile(quantiles[aggregate])
+	case Sketch:
+		if s.sketch != nil {
+			return s.sketch.Encode()
+		}
+	}
+	return nil
+}
+
+// quantile returns a quantile from the sketch, kept within the exact min
+// and max, or nil without a sketch
+func (s *stats) quantile(q float64) interface{} {
+	if s.sketch == nil {
+		return nil
+	}
+	value, ok := s.sketch.Quantile(q)
+	if !ok {
+		return nil
+	}
+	return math.Max(s.min, math.Min(s.max, value))
+}
+
+// bucketKey identifies the window of a series
+type bucketKey struct {
+	start  int64 // window start in Unix nanoseconds
+	series string
+}
+
+// bucket holds the aggregates of one series in one window
+type bucket struct {
+	start  time.Time
+	tags   []string
+	values []stats
+	// folded holds the counters of the series folded into OtherSeries by
+	// series key, as their samples do not make up one counter
+	folded map[string][]stats
+}
+
+// foldedValues returns the values of a series folded into the bucket,
+// creating them if needed
+func (b *bucket) foldedValues(series string) []stats {
+	if b.folded == nil {
+		b.folded = make(map[string][]stats)
+	}
+	values := b.folded[series]
+	if values == nil {
+		values = make([]stats, len(b.values))
+		b.folded[series] = values
+	}
+	return values
+}
+
+// counters returns the states of counter column j in the bucket: its own,
+// then those of the folded series ordered by series key
+func (b *bucket) counters(j int) []*stats {
+	keys := make([]string, 0, len(b.folded))
+	for series := range b.folded {
+		keys = append(keys, series)
+	}
+	sort.Strings(keys)
+
+	counters := []*stats{&b.values[j]}
+	for _, series := range keys {
+		counters = append(counters, &b.folded[series][j])
+	}
+	return counters
+}
+
+// Engine rolls up typed records, as produced by sfm.Type.Convert, into
+// every interval of its spec
+type Engine struct {
+	spec      Spec
+	timestamp int
+	values    []int
+	kinds     []Kind
+	tags      []int
+	// outOfOrder counts counter samples older than the last of their series
+	outOfOrder int64
+	// series holds the series kept under the cardinality cap, and folded
+	// the ones folded into OtherSeries
+	series map[string]bool
+	folded map[string]bool
+	// sketches is set if percentiles or sketches are computed
+	sketches bool
+	// buckets holds the buckets of every interval, by interval index
+	buckets []map[bucketKey]*bucket
+}
+
+// NewEngine creates an engine for records with the given columns and
+// types. The timestamp column must be of type time and the value columns
+// of type int or float.
+func NewEngine(spec Spec, columns []string, types []sfm.Type) (*Engine, error) {
+	if len(spec.Values) == 0 {
+		return nil, fmt.Errorf("rollup needs at least one value column")
+	}
+	if len(spec.Intervals) == 0 {
+		return nil, fmt.Errorf("rollup needs at least one interval")
+	}
+	if len(spec.Aggregates) == 0 {
+		spec.Aggregates = DefaultAggregates
+	}
+	if spec.SketchAccuracy == 0 {
+		spec.SketchAccuracy = DefaultSketchAccuracy
+	}
+	_, err := NewQuantileSketch(spec.SketchAccuracy)
+	if err != nil {
+		return nil, err
+	}
+	for name := range spec.Kinds {
+		found := false
+		for _, value := range spec.Values {
+			found = found || value == name
+		}
+		if !found {
+			return nil, fmt.Errorf("metric kind set for %q, which is not a rollup value column", name)
+		}
+	}
+
+	indexes := make(map[string]int, len(columns))
+	for i, column := range columns {
+		indexes[column] = i
+	}
+	find := func(name string) (int, error) {
+		index, ok := indexes[name]
+		if !ok {
+			return 0, fmt.Errorf("rollup column %q is not in the header", name)
+		}
+		return index, nil
+	}
+
+	e := &Engine{spec: spec}
+	for _, aggregate := range spec.Aggregates {
+		_, quantile := quantiles[aggregate]
+		if quantile || aggregate == Sketch {
+			e.sketches = true
+		}
+	}
+
+	e.timestamp, err = find(spec.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	if types[e.timestamp] != sfm.TypeTime {
+		return nil, fmt.Errorf("rollup timestamp column %q is of type %s, expected time", spec.Timestamp, types[e.timestamp])
+	}
+
+	for _, name := range spec.Values {
+		index, err := find(name)
+		if err != nil {
+			return nil, err
+		}
+		if types[index] != sfm.TypeInt && types[index] != sfm.TypeFloat {
+			return nil, fmt.Errorf("rollup value column %q is of type %s, expected int or float", name, types[index])
+		}
+		e.values = append(e.values, index)
+
+		kind := spec.Kinds[name]
+		if kind == "" {
+			kind = Gauge
+		}
+		e.kinds = append(e.kinds, kind)
+	}
+
+	for _, name := range spec.Tags {
+		index, err := find(name)
+		if err != nil {
+			return nil, err
+		}
+		e.tags = append(e.tags, index)
+	}
+
+	// Output columns must not collide
+	seen := make(map[string]bool)
+	for _, name := range e.Columns() {
+		if seen[name] {
+			return nil, fmt.Errorf("rollup column %q is used more than once", name)
+		}
+		seen[name] = true
+	}
+
+	for range spec.Intervals {
+		e.buckets = append(e.buckets, make(map[bucketKey]*bucket))
+	}
+	if spec.MaxSeries < 0 {
+		return nil, fmt.Errorf("rollup max series must not be negative")
+	}
+	if spec.MaxSeries > 0 {
+		e.series = make(map[string]bool)
+		e.folded = make(map[string]bool)
+	}
+
+	return e, nil
+}
+
+// Spec returns the spec of the engine
+func (e *Engine) Spec() Spec {
+	return e.spec
+}
+
+// Add adds a record to the window of its timestamp in every interval. It
+// returns ErrNoTimestamp if the timestamp is missing. Values that are null
+// or not numbers are left out of the aggregates.
+func (e *Engine) Add(record []interface{}) error {
+	t, ok := record[e.timestamp].(time.Time)
+	if !ok {
+		return ErrNoTimestamp
+	}
+
+	tags := make([]string, len(e.tags))
+	for i, index := range e.tags {
+		tags[i] = tagValue(record[index])
+	}
+	own := strings.Join(tags, "\x00")
+	tags, series := e.seriesOf(tags)
+	folded := series != own
+
+	for i, interval := range e.spec.Intervals {
+		b := e.bucket(i, interval.Start(t), tags, series)
+		for j, index := range e.values {
+			value, ok := numericValue(record[index])
+			if !ok {
+				continue
+			}
+			if e.kinds[j] != Counter {
+				b.values[j].add(value, t)
+				continue
+			}
+			// Folded series keep counting on their own
+			counter := &b.values[j]
+			if folded {
+				counter = &b.foldedValues(own)[j]
+			}
+			// A late sample is late in every interval; count it once
+			if !counter.addCounter(value, t) && i == 0 {
+				e.outOfOrder++
+			}
+		}
+	}
+
+	return nil
+}
+
+// AddRow merges a row returned by Rows of an engine with the same spec
+// but a shorter interval into the window of the row's start in every
+// interval. Both engines must compute every aggregate of their gauges. The
+// first and last values of the row are taken as observed at the row's
+// start, and the increases of counters and deltas are added up.
+func (e *Engine) AddRow(row []interface{}) error {
+	width := 1 + len(e.tags)
+	for j := range e.values {
+		if e.kinds[j] == Gauge && len(e.spec.Aggregates) != len(Aggregates) {
+			return fmt.Errorf("rows can only be merged by engines computing every aggregate")
+		}
+		width += len(e.aggregates(j))
+	}
+	if len(row) != width {
+		return fmt.Errorf("rollup row has %d columns, expected %d", len(row), width)
+	}
+	start, ok := row[0].(time.Time)
+	if !ok {
+		return ErrNoTimestamp
+	}
+
+	tags := make([]string, len(e.tags))
+	for i := range e.tags {
+		tags[i] = tagValue(row[1+i])
+	}
+
+	values := make([]stats, len(e.values))
+	offset := 1 + len(e.tags)
+	for j := range e.values {
+		var err error
+		values[j], err = e.rowStats(j, row[offset:], start)
+		if err != nil {
+			return fmt.Errorf("rollup column %s: %w", e.spec.Values[j], err)
+		}
+		offset += len(e.aggregates(j))
+	}
+
+	e.addStats(start, tags, values)
+	return nil
+}
+
+// rowStats reads the aggregates of value column j from a rolled-up row.
+// Averages, rates and percentiles are left out, as they are computed from
+// the other aggregates.
+func (e *Engine) rowStats(j int, aggregates []interface{}, start time.Time) (stats, error) {
+	count, ok := aggregates[0].(int64)
+	if !ok && aggregates[0] != nil {
+		return stats{}, fmt.Errorf("invalid count %v", aggregates[0])
+	}
+	if count == 0 {
+		return stats{}, nil
+	}
+
+	s := stats{count: count, firstTime: start, lastTime: start, merged: e.kinds[j] == Counter}
+	for i, aggregate := range e.aggregates(j) {
+		value := aggregates[i]
+		switch aggregate {
+		case Count, Avg, P50, P95, P99, Rate:
+			continue
+		case Resets:
+			s.resets, _ = value.(int64)
+			continue
+		case Increase:
+			// Counters with a single sample in the window have no increase
+			if value == nil {
+				continue
+			}
+		case Sketch:
+			text, _ := value.(string)
+			sketch, err := DecodeQuantileSketch(text)
+			if err != nil {
+				return stats{}, err
+			}
+			if sketch.Accuracy() != e.spec.SketchAccuracy {
+				return stats{}, fmt.Errorf("sketch accuracy %v does not match %v", sketch.Accuracy(), e.spec.SketchAccuracy)
+			}
+			s.sketch = sketch
+			continue
+		}
+
+		number, ok := numericValue(value)
+		if !ok {
+			return stats{}, fmt.Errorf("invalid %s %v", aggregate, value)
+		}
+		switch aggregate {
+		case Sum:
+			s.sum = number
+		case Min:
+			s.min = number
+		case Max:
+			s.max = number
+		case First:
+			s.first = number
+		case Last:
+			s.last = number
+		case Increase:
+			// The increase of deltas is their sum
+			s.increase, s.sum = number, number
+		}
+	}
+
+	return s, nil
+}
+
+// addStats merges the aggregates of one series observed at t into every interval
+func (e *Engine) addStats(t time.Time, tags []string, values []stats) {
+	tags, series := e.seriesOf(tags)
+	for i, interval := range e.spec.Intervals {
+		b := e.bucket(i, interval.Start(t), tags, series)
+		for j := range values {
+			b.values[j].merge(values[j])
+		}
+	}
+}
+
+// seriesOf returns the tags and key of a series, or those of OtherSeries
+// if the series is new and the cardinality cap has been reached
+func (e *Engine) seriesOf(tags []string) ([]string, string) {
+	series := strings.Join(tags, "\x00")
+	if e.series == nil || e.series[series] {
+		return tags, series
+	}
+
+	other := make([]string, len(tags))
+	for i := range other {
+		other[i] = OtherSeries
+	}
+	otherSeries := strings.Join(other, "\x00")
+
+	// Rows of a shorter interval may already hold the other series
+	if series == otherSeries {
+		return tags, series
+	}
+	if len(e.series) < e.spec.MaxSeries {
+		e.series[series] = true
+		return tags, series
+	}
+
+	e.folded[series] = true
+	return other, otherSeries
+}
+
+// bucket returns the bucket of a series in the window of interval i
+// starting at start, creating it if needed
+func (e *Engine) bucket(i int, start time.Time, tags []string, series string) *bucket {
+	key := bucketKey{start: start.UnixNano(), series: series}
+	b := e.buckets[i][key]
+	if b == nil {
+		b = &bucket{start: start, tags: tags, values: make([]stats, len(e.values))}
+		for j := range b.values {
+			if e.sketches && e.kinds[j] == Gauge {
+				b.values[j].sketch, _ = NewQuantileSketch(e.spec.SketchAccuracy)
+			}
+		}
+		e.buckets[i][key] = b
+	}
+	return b
+}
+
+// OutOfOrder returns the number of counter samples left out of the rollups
+// because an earlier record of their series had a later timestamp
+func (e *Engine) OutOfOrder() int64 {
+	return e.outOfOrder
+}
+
+// Folded returns the number of distinct series folded into OtherSeries
+// because of the cardinality cap
+func (e *Engine) Folded() int {
+	return len(e.folded)
+}
+
+// aggregates returns the aggregates of value column j, by its kind
+func (e *Engine) aggregates(j int) []Aggregate {
+	switch e.kinds[j] {
+	case Counter:
+		return CounterAggregates
+	case Delta:
+		return DeltaAggregates
+	}
+	return e.spec.Aggregates
+}
+
+// Columns returns the columns of rolled-up rows: the window start under
+// the name of the timestamp column, the tags, then every aggregate of
+// every value column, named value_aggregate
+func (e *Engine) Columns() []string {
+	columns := []string{e.spec.Timestamp}
+	columns = append(columns, e.spec.Tags...)
+	for j, value := range e.spec.Values {
+		for _, aggregate := range e.aggregates(j) {
+			columns = append(columns, value+"_"+string(aggregate))
+		}
+	}
+	return columns
+}
+
+// Types returns the types of the columns of rolled-up rows
+func (e *Engine) Types() []sfm.Type {
+	types := []sfm.Type{sfm.TypeTime}
+	for range e.spec.Tags {
+		types = append(types, sfm.TypeString)
+	}
+	for j := range e.spec.Values {
+		for _, aggregate := range e.aggregates(j) {
+			switch aggregate {
+			case Count, Resets:
+				types = append(types, sfm.TypeInt)
+			case Sketch:
+				types = append(types, sfm.TypeString)
+			default:
+				types = append(types, sfm.TypeFloat)
+			}
+		}
+	}
+	return types
+}
+
+// Rows returns the rolled-up rows of the interval with index i in the
+// spec, ordered by window start and then by tags
+func (e *Engine) Rows(i int) [][]interface{} {
+	buckets := make([]*bucket, 0, len(e.buckets[i]))
+	for _, b := range e.buckets[i] {
+		buckets = append(buckets, b)
+	}
+	sort.Slice(buckets, func(a, b int) bool {
+		if !buckets[a].start.Equal(buckets[b].start) {
+			return buckets[a].start.Before(buckets[b].start)
+		}
+		return lessTags(buckets[a].tags, buckets[b].tags)
+	})
+
+	rows := make([][]interface{}, 0, len(buckets))
+	for _, b := range buckets {
+		row := []interface{}{b.start}
+		for _, tag := range b.tags {
+			row = append(row, tag)
+		}
+		for j := range e.values {
+			for _, aggregate := range e.aggregates(j) {
+				row = append(row, e.value(b, j, aggregate, e.spec.Intervals[i].Duration))
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// value returns an aggregate of value column j in the bucket of a window
+// of the given duration. The counts, increases and resets of the series
+// folded into a bucket add up.
+func (e *Engine) value(b *bucket, j int, aggregate Aggregate, duration time.Duration) interface{} {
+	s := &b.values[j]
+	switch e.kinds[j] {
+	case Counter:
+		var count, resets int64
+		var increase float64
+		sampled := false
+		for _, counter := range b.counters(j) {
+			count += counter.count
+			resets += counter.resets
+			if counterIncrease, ok := counter.counterIncrease(b.start, duration); ok {
+				increase += counterIncrease
+				sampled = true
+			}
+		}
+
+		switch aggregate {
+		case Count:
+			return count
+		case Increase, Rate:
+			if !sampled {
+				return nil
+			}
+			if aggregate == Rate {
+				return increase / duration.Seconds()
+			}
+			return increase
+		case Resets:
+			return resets
+		}
+	case Delta:
+		if s.count == 0 {
+			break
+		}
+		switch aggregate {
+		case Increase:
+			return s.sum
+		case Rate:
+			return s.sum / duration.Seconds()
+		}
+	}
+	return s.value(aggregate)
+}
+
+// lessTags orders tag values column by column
+func lessTags(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// tagValue formats a typed value as a tag, "" for null
+func tagValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(value)
+}
+
+// numericValue returns a typed value as a float64
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,165 @@
+// Package rollup aggregates the records of metric segments into fixed time
+// intervals.
+//
+// Records are grouped into series by the values of their tag columns and
+// into windows by their timestamp. The number of series can be capped, in
+// which case later series are folded into one series tagged OtherSeries.
+// Windows are aligned to the Unix epoch, so the 1h window of a record
+// always starts on the hour in UTC. For every
+// series, window and value column the engine keeps the count, sum, minimum,
+// maximum, average and the first and last value by timestamp, and
+// optionally a quantile sketch (see QuantileSketch) giving its percentiles.
+//
+// Value columns holding counters or deltas are rolled up by Kind instead:
+// into their increase over the window, its rate per second and, for
+// counters, the number of resets, following Prometheus' increase() and
+// rate().
+package rollup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interval is the length of the windows records are rolled up into
+type Interval struct {
+	Name     string // as configured, e.g. "5m"
+	Duration time.Duration
+}
+
+// DefaultIntervals are the intervals rolled up unless configured otherwise
+var DefaultIntervals = []string{"1m", "5m", "1h", "1d"}
+
+// ParseDuration parses a duration as time.ParseDuration does, and also
+// whole numbers of days or weeks such as "30d" or "2w"
+func ParseDuration(text string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if count, ok := strings.CutSuffix(text, suffix); ok {
+			n, err := strconv.Atoi(count)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", text)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(text)
+}
+
+// ParseInterval parses an interval such as "1m", "5m", "1h" or "1d".
+// Intervals must divide a day evenly or be a whole number of days, so
+// that windows line up with days.
+func ParseInterval(name string) (Interval, error) {
+	duration, err := ParseDuration(name)
+	if err != nil {
+		return Interval{}, fmt.Errorf("invalid rollup interval %q", name)
+	}
+
+	day := 24 * time.Hour
+	if duration < time.Second || (day%duration != 0 && duration%day != 0) {
+		return Interval{}, fmt.Errorf("rollup interval %q must divide a day evenly or be a whole number of days", name)
+	}
+
+	return Interval{Name: name, Duration: duration}, nil
+}
+
+// Start returns the start of the window of t
+func (i Interval) Start(t time.Time) time.Time {
+	nanos := t.UnixNano()
+	offset := nanos % int64(i.Duration)
+	if offset < 0 {
+		offset += int64(i.Duration)
+	}
+	return time.Unix(0, nanos-offset).UTC()
+}
+
+// Aggregate is a statistic computed for every value column
+type Aggregate string
+
+const (
+	Count Aggregate = "count"
+	Sum   Aggregate = "sum"
+	Min   Aggregate = "min"
+	Max   Aggregate = "max"
+	Avg   Aggregate = "avg"
+	First Aggregate = "first" // value with the earliest timestamp
+	Last  Aggregate = "last"  // value with the latest timestamp
+	P50   Aggregate = "p50"
+	P95   Aggregate = "p95"
+	P99   Aggregate = "p99"
+	// Sketch is the serialized quantile sketch, from which any percentile
+	// can be computed and which can be merged into longer windows
+	Sketch Aggregate = "sketch"
+
+	// Aggregates of counter and delta columns
+	Increase Aggregate = "increase" // growth over the window
+	Rate     Aggregate = "rate"     // increase per second of the window
+	Resets   Aggregate = "resets"   // counter resets within the window
+)
+
+// Aggregates lists every aggregate in output order
+var Aggregates = []Aggregate{Count, Sum, Min, Max, Avg, First, Last, P50, P95, P99, Sketch}
+
+// DefaultAggregates are the aggregates computed unless configured otherwise
+var DefaultAggregates = []Aggregate{Count, Sum, Min, Max, Avg, First, Last}
+
+// CounterAggregates are the aggregates of counter columns
+var CounterAggregates = []Aggregate{Count, Increase, Rate, Resets}
+
+// DeltaAggregates are the aggregates of delta columns
+var DeltaAggregates = []Aggregate{Count, Increase, Rate}
+
+// quantiles holds the quantile of each percentile aggregate
+var quantiles = map[Aggregate]float64{P50: 0.5, P95: 0.95, P99: 0.99}
+
+// Kind is how the values of a column behave over time
+type Kind string
+
+const (
+	Gauge   Kind = "gauge"   // a measurement that goes up and down
+	Counter Kind = "counter" // a running total that only decreases when reset
+	Delta   Kind = "delta"   // the change since the previous record
+)
+
+// ParseKind returns the kind with the given name
+func ParseKind(name string) (Kind, error) {
+	switch kind := Kind(strings.ToLower(strings.TrimSpace(name))); kind {
+	case Gauge, Counter, Delta:
+		return kind, nil
+	}
+	return "", fmt.Errorf("unknown metric kind: %q", name)
+}
+
+// ParseAggregate returns the aggregate with the given name. Only the
+// aggregates of gauges can be chosen.
+func ParseAggregate(name string) (Aggregate, error) {
+	for _, aggregate := range Aggregates {
+		if string(aggregate) == strings.ToLower(strings.TrimSpace(name)) {
+			return aggregate, nil
+		}
+	}
+	return "", fmt.Errorf("unknown rollup aggregate: %q", name)
+}
+
+// Spec describes how records are rolled up
+type Spec struct {
+	// Timestamp is the time column the windows are based on
+	Timestamp string
+	// Values are the numeric columns that are aggregated
+	Values []string
+	// Tags are the columns identifying a series
+	Tags []string
+	// MaxSeries caps the number of distinct series; the records of series
+	// seen after the cap is reached are rolled up into OtherSeries. 0 for
+	// no cap.
+	MaxSeries int
+	Intervals []Interval
+	// Aggregates are the aggregates of gauge columns
+	Aggregates []Aggregate
+	// Kinds holds the kind of value columns that are not gauges
+	Kinds map[string]Kind
+	// SketchAccuracy is the relative accuracy of percentiles, 0 for
+	// DefaultSketchAccuracy
+	SketchAccuracy float64
+}
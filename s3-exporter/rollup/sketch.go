@@ -0,0 +1,256 @@
+package rollup
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DefaultSketchAccuracy is the relative accuracy of sketches unless
+// configured otherwise
+const DefaultSketchAccuracy = 0.01
+
+// sketchVersion is the version of the serialized sketch format
+const sketchVersion = 1
+
+// minSketchValue is the smallest magnitude kept in a bin; smaller values
+// are counted as zero
+const minSketchValue = 1e-9
+
+// QuantileSketch is a mergeable quantile sketch in the style of DDSketch.
+// Values are counted in logarithmically sized bins, so every quantile is
+// returned with a relative error of at most the sketch's accuracy, whatever
+// the distribution. Sketches with the same accuracy can be merged exactly.
+type QuantileSketch struct {
+	accuracy float64
+	gamma    float64
+	logGamma float64
+	// positive and negative count the bins of values by the index of their
+	// magnitude
+	positive map[int32]uint64
+	negative map[int32]uint64
+	zero     uint64
+	count    uint64
+}
+
+// NewQuantileSketch creates an empty sketch with the given relative accuracy,
+// between 0 and 1 exclusive
+func NewQuantileSketch(accuracy float64) (*QuantileSketch, error) {
+	if !(accuracy > 0 && accuracy < 1) {
+		return nil, fmt.Errorf("sketch accuracy must be between 0 and 1, got %v", accuracy)
+	}
+
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &QuantileSketch{
+		accuracy: accuracy,
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		positive: make(map[int32]uint64),
+		negative: make(map[int32]uint64),
+	}, nil
+}
+
+// Accuracy returns the relative accuracy of the sketch
+func (s *QuantileSketch) Accuracy() float64 {
+	return s.accuracy
+}
+
+// Count returns the number of values added to the sketch
+func (s *QuantileSketch) Count() uint64 {
+	return s.count
+}
+
+// Add adds a value. NaN and infinite values are ignored.
+func (s *QuantileSketch) Add(value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+
+	switch {
+	case value > minSketchValue:
+		s.positive[s.index(value)]++
+	case value < -minSketchValue:
+		s.negative[s.index(-value)]++
+	default:
+		s.zero++
+	}
+	s.count++
+}
+
+// Merge adds the values of o, which must have the same accuracy
+func (s *QuantileSketch) Merge(o *QuantileSketch) error {
+	if o.accuracy != s.accuracy {
+		return fmt.Errorf("cannot merge a sketch of accuracy %v into one of accuracy %v", o.accuracy, s.accuracy)
+	}
+	s.merge(o)
+	return nil
+}
+
+// merge adds the values of o without checking its accuracy
+func (s *QuantileSketch) merge(o *QuantileSketch) {
+	for index, n := range o.positive {
+		s.positive[index] += n
+	}
+	for index, n := range o.negative {
+		s.negative[index] += n
+	}
+	s.zero += o.zero
+	s.count += o.count
+}
+
+// Quantile returns an estimate of the q-quantile of the values, with q
+// between 0 and 1, or false if the sketch is empty
+func (s *QuantileSketch) Quantile(q float64) (float64, bool) {
+	if s.count == 0 || q < 0 || q > 1 {
+		return 0, false
+	}
+
+	// The rank of the quantile among the values in ascending order
+	rank := uint64(q * float64(s.count-1))
+
+	// Negative values come first, largest magnitude first
+	var seen uint64
+	for _, index := range sortedIndexes(s.negative, true) {
+		seen += s.negative[index]
+		if seen > rank {
+			return -s.value(index), true
+		}
+	}
+
+	seen += s.zero
+	if seen > rank {
+		return 0, true
+	}
+
+	for _, index := range sortedIndexes(s.positive, false) {
+		seen += s.positive[index]
+		if seen > rank {
+			return s.value(index), true
+		}
+	}
+
+	// Not reached, as the bins hold every value
+	return 0, false
+}
+
+// index returns the bin of a positive value
+func (s *QuantileSketch) index(value float64) int32 {
+	return int32(math.Ceil(math.Log(value) / s.logGamma))
+}
+
+// value returns the value representing a bin, within the relative accuracy
+// of every value in it
+func (s *QuantileSketch) value(index int32) float64 {
+	return 2 * math.Pow(s.gamma, float64(index)) / (s.gamma + 1)
+}
+
+// sortedIndexes returns the indexes of bins in ascending order, or
+// descending if reverse is set
+func sortedIndexes(bins map[int32]uint64, reverse bool) []int32 {
+	indexes := make([]int32, 0, len(bins))
+	for index := range bins {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(a, b int) bool {
+		if reverse {
+			return indexes[a] > indexes[b]
+		}
+		return indexes[a] < indexes[b]
+	})
+	return indexes
+}
+
+// Encode serializes the sketch as base64 text, so that it can be stored in
+// any output format
+func (s *QuantileSketch) Encode() string {
+	data := []byte{sketchVersion}
+	data = binary.LittleEndian.AppendUint64(data, math.Float64bits(s.accuracy))
+	data = binary.AppendUvarint(data, s.zero)
+	data = appendBins(data, s.positive)
+	data = appendBins(data, s.negative)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// appendBins serializes bins as their number followed by the delta of each
+// index to the previous one and its count
+func appendBins(data []byte, bins map[int32]uint64) []byte {
+	data = binary.AppendUvarint(data, uint64(len(bins)))
+	previous := int64(0)
+	for _, index := range sortedIndexes(bins, false) {
+		data = binary.AppendVarint(data, int64(index)-previous)
+		data = binary.AppendUvarint(data, bins[index])
+		previous = int64(index)
+	}
+	return data
+}
+
+// errInvalidSketch is returned for malformed serialized sketches
+var errInvalidSketch = errors.New("invalid sketch")
+
+// DecodeQuantileSketch parses a sketch serialized by Encode
+func DecodeQuantileSketch(text string) (*QuantileSketch, error) {
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(data) < 9 || data[0] != sketchVersion {
+		return nil, errInvalidSketch
+	}
+
+	s, err := NewQuantileSketch(math.Float64frombits(binary.LittleEndian.Uint64(data[1:9])))
+	if err != nil {
+		return nil, errInvalidSketch
+	}
+	data = data[9:]
+
+	zero, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errInvalidSketch
+	}
+	s.zero, s.count = zero, zero
+	data = data[n:]
+
+	for _, bins := range []map[int32]uint64{s.positive, s.negative} {
+		data, err = s.readBins(data, bins)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) != 0 {
+		return nil, errInvalidSketch
+	}
+
+	return s, nil
+}
+
+// readBins parses bins serialized by appendBins and returns the rest of data
+func (s *QuantileSketch) readBins(data []byte, bins map[int32]uint64) ([]byte, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > uint64(len(data)) {
+		return nil, errInvalidSketch
+	}
+	data = data[n:]
+
+	index := int64(0)
+	for i := uint64(0); i < length; i++ {
+		delta, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, errInvalidSketch
+		}
+		data = data[n:]
+		count, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errInvalidSketch
+		}
+		data = data[n:]
+
+		index += delta
+		if index < math.MinInt32 || index > math.MaxInt32 {
+			return nil, errInvalidSketch
+		}
+		bins[int32(index)] += count
+		s.count += count
+	}
+
+	return data, nil
+}
@@ -10,6 +10,7 @@ mkdir -p config
 mkdir -p data
 mkdir -p logs
 mkdir -p temp
+mkdir -p state
 
 # Check if Go is installed
 if ! command -v go &> /dev/null
@@ -30,13 +31,70 @@ if [ ! -f config/config.yaml ]; then
 s3:
   region: us-east-1
   bucket: sigmenbucket
+  # Credentials are resolved through the standard AWS chain (environment
+  # variables, ~/.aws/credentials, web identity tokens, EC2/ECS roles).
+  # profile: default
+  # role_arn: arn:aws:iam::123456789012:role/s3-exporter
+  # external_id: ""
 
+# Source Configuration
+source:
+  delimiter: comma  # Field delimiter: comma, tab, pipe or a single character
+
+# Column Types
+types:
+  infer: true       # Infer undeclared column types from a sample of rows
+  sample_rows: 1000 # Rows sampled for inference
+  on_error: null    # Values that do not match their type: null, string, skip or fail
+
+# Column Projection
+columns:
+  include: []       # Columns to export, all if empty
+  exclude: []       # Columns to drop
+  rename: {}        # Output names, e.g. {value: reading}
 
 # Export Configuration
 export:
-  batch_size: 1000  # Number of JSON lines per file
+  batch_size: 1000  # Records per batch, 0 for no limit
+  batch_bytes: 0    # Encoded bytes per batch before compression, 0 for no limit
+  batch_compressed_bytes: 0 # Stored bytes per batch, 0 for no limit
   compression: true # Whether to compress files before upload
+  codec: gzip       # gzip, zlib, zstd, snappy or lz4
+  compression_level: 0 # Codec level, the codec's default if 0
+  gzip_concurrency: 0 # gzip blocks compressed in parallel, one per CPU if 0
+  gzip_block_size_kb: 1024 # Input per gzip block
   temp_dir: ./temp
+  format: ndjson    # ndjson, json_array, csv or parquet
+
+# Rolled-up series of metric segments
+rollup:
+  enabled: false
+  timestamp: timestamp # time column the windows are based on
+  values: [value]   # int or float columns to aggregate
+  tags: []          # columns identifying a series
+  max_series: 0     # series kept before the rest are folded into __other__
+  intervals: [1m, 5m, 1h, 1d]
+  aggregates: []    # count, sum, min, max, avg, first, last, p50, p95, p99, sketch
+  output: alongside # alongside, or instead of the raw rows
+  sketch_accuracy: 0.01 # relative accuracy of percentiles and sketches
+  kinds: {}         # column: gauge, counter or delta
+
+# Tiered rollups of exported segments (autorollup command)
+autorollup:
+  grace: 10m
+  raw_retention: 0s # 0 keeps rolled-up segments
+  tiers:
+    - interval: 1h
+      prefix: rollups/1h
+      retention: 0s
+    - interval: 1d
+      prefix: rollups/1d
+      retention: 0s
+
+# Export state
+state:
+  backend: ledger
+  dir: ./state
 
 # Logging Configuration
 logging:
@@ -44,7 +102,8 @@ logging:
   format: text
 EOF
     echo "Default config created at config/config.yaml"
-    echo "Please update the configuration with your AWS credentials and S3 bucket information."
+    echo "Please update the configuration with your S3 bucket information."
+    echo "AWS credentials are taken from the environment, ~/.aws or the instance role."
 fi
 
 # Create a simple sample.sfm file for testing
@@ -0,0 +1,140 @@
+package sfm
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// metadataLine matches "key:value" metadata lines in the header block
+var metadataLine = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_.-]*)\s*:\s*(.*?)\s*$`)
+
+// Metadata is a key:value line of the header block
+type Metadata struct {
+	Key   string
+	Value string
+	// line is the index of the metadata line in Header.lines
+	line int
+}
+
+// Header is the header block of an SFM file
+type Header struct {
+	Columns []string
+	// Types are the declared column types, "" for columns without one.
+	// Types is nil if the column line declares no types.
+	Types    []Type
+	Metadata []Metadata
+
+	// lines are the header lines as read, including their line endings,
+	// so that a header can be written back unchanged apart from Set
+	lines []string
+	// columnLine is the index of the column line in lines, -1 if missing
+	columnLine int
+}
+
+// NewHeader creates a header with the given columns and no metadata
+func NewHeader(columns []string) *Header {
+	return &Header{Columns: columns, columnLine: -1}
+}
+
+// Get returns the value of a metadata key
+func (h *Header) Get(key string) (string, bool) {
+	for _, metadata := range h.Metadata {
+		if metadata.Key == key {
+			return metadata.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set sets the value of a metadata key. In a header that was read from a
+// file the metadata line is rewritten in place, or added after the column
+// line if the key is new.
+func (h *Header) Set(key, value string) {
+	for i, metadata := range h.Metadata {
+		if metadata.Key == key {
+			h.Metadata[i].Value = value
+			if h.lines != nil {
+				h.lines[metadata.line] = key + ":" + value + lineEnding(h.lines[metadata.line])
+			}
+			return
+		}
+	}
+
+	if h.lines == nil {
+		h.Metadata = append(h.Metadata, Metadata{Key: key, Value: value})
+		return
+	}
+
+	// Add the line after the column line, or at the end of the block
+	at := len(h.lines)
+	if h.columnLine >= 0 {
+		at = h.columnLine + 1
+	}
+	ending := "\n"
+	if at > 0 {
+		previous := h.lines[at-1]
+		if lineEnding(previous) == "" {
+			// The previous line is the last line of a file without a trailing newline
+			h.lines[at-1] = previous + ending
+		} else {
+			ending = lineEnding(previous)
+		}
+	}
+
+	h.lines = append(h.lines[:at], append([]string{key + ":" + value + ending}, h.lines[at:]...)...)
+	for i := range h.Metadata {
+		if h.Metadata[i].line >= at {
+			h.Metadata[i].line++
+		}
+	}
+	h.Metadata = append(h.Metadata, Metadata{Key: key, Value: value, line: at})
+}
+
+// parseLine adds a raw header line to the header. It returns false if the
+// line is not part of the header block.
+func (h *Header) parseLine(raw string, delimiter rune, lineNum int) (bool, error) {
+	trimmed := strings.TrimSpace(raw)
+	switch {
+	case trimmed == "":
+	case strings.HasPrefix(trimmed, "#"):
+		if h.columnLine < 0 && strings.ContainsRune(trimmed, delimiter) {
+			columns, err := ParseLine(strings.TrimPrefix(trimmed, "#"), delimiter)
+			if err != nil {
+				return false, &SyntaxError{Line: lineNum, Msg: fmt.Sprintf("invalid column line: %v", err)}
+			}
+			h.Columns = columns
+			for i, column := range columns {
+				name, t := splitColumnType(column)
+				if t == "" {
+					continue
+				}
+				if h.Types == nil {
+					h.Types = make([]Type, len(columns))
+				}
+				h.Columns[i], h.Types[i] = name, t
+			}
+			h.columnLine = len(h.lines)
+		}
+	default:
+		match := metadataLine.FindStringSubmatch(trimmed)
+		if match == nil || strings.ContainsRune(match[2], delimiter) {
+			return false, nil
+		}
+		h.Metadata = append(h.Metadata, Metadata{Key: match[1], Value: match[2], line: len(h.lines)})
+	}
+
+	h.lines = append(h.lines, raw)
+	return true, nil
+}
+
+// lineEnding returns the line ending of a raw line
+func lineEnding(line string) string {
+	if strings.HasSuffix(line, "\r\n") {
+		return "\r\n"
+	}
+	if strings.HasSuffix(line, "\n") {
+		return "\n"
+	}
+	return ""
+}
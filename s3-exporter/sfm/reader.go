@@ -0,0 +1,254 @@
+package sfm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Record is a data record of an SFM file
+type Record struct {
+	Line   int // line the record starts on
+	Fields []string
+}
+
+// Reader reads an SFM file: first its header block, then its records
+type Reader struct {
+	reader    *bufio.Reader
+	delimiter rune
+
+	header     *Header
+	headerDone bool
+	// pending is the raw first data line, read while looking for the end
+	// of the header block
+	pending    string
+	hasPending bool
+
+	// offset and line count the bytes and lines consumed
+	offset int64
+	line   int
+	// recordLine is the line the last record started on
+	recordLine int
+}
+
+// NewReader creates a reader for an SFM file read from its start
+func NewReader(r io.Reader, delimiter rune) *Reader {
+	return &Reader{
+		reader:    bufio.NewReader(r),
+		delimiter: delimiter,
+	}
+}
+
+// Resume creates a reader for the data section of an SFM file whose header
+// was read earlier, with r positioned at pos
+func Resume(r io.Reader, delimiter rune, header *Header, pos Position) *Reader {
+	return &Reader{
+		reader:     bufio.NewReader(r),
+		delimiter:  delimiter,
+		header:     header,
+		headerDone: true,
+		offset:     pos.Offset,
+		line:       pos.Line,
+	}
+}
+
+// readLine reads the next raw line, including its line ending. It returns
+// io.EOF only when there is nothing left to read.
+func (r *Reader) readLine() (string, error) {
+	line, err := r.reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if line == "" {
+		return "", io.EOF
+	}
+
+	r.offset += int64(len(line))
+	r.line++
+	return line, nil
+}
+
+// ReadHeader reads the header block. It can be called at any time and
+// returns the same header every time.
+func (r *Reader) ReadHeader() (*Header, error) {
+	if r.headerDone {
+		return r.header, nil
+	}
+
+	header := NewHeader(nil)
+	for {
+		raw, err := r.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading SFM header: %w", err)
+		}
+
+		inHeader, err := header.parseLine(raw, r.delimiter, r.line)
+		if err != nil {
+			return nil, err
+		}
+		if !inHeader {
+			// Keep the first data line for Read
+			r.pending = raw
+			r.hasPending = true
+			break
+		}
+	}
+	if header.lines == nil {
+		header.lines = []string{}
+	}
+
+	r.header = header
+	r.headerDone = true
+	return header, nil
+}
+
+// Header returns the header read so far, or nil before ReadHeader
+func (r *Reader) Header() *Header {
+	return r.header
+}
+
+// Position returns the position just after the last record read, or after
+// the header block before the first record
+func (r *Reader) Position() Position {
+	if r.hasPending {
+		return Position{Offset: r.offset - int64(len(r.pending)), Line: r.line - 1}
+	}
+	return Position{Offset: r.offset, Line: r.line}
+}
+
+// Rest returns the unread part of the data section unchanged
+func (r *Reader) Rest() io.Reader {
+	if r.hasPending {
+		pending := r.pending
+		r.pending, r.hasPending = "", false
+		return io.MultiReader(strings.NewReader(pending), r.reader)
+	}
+	return r.reader
+}
+
+// Read returns the next record, or io.EOF at the end of the file. A record
+// with a syntax error, or with a different number of fields than the
+// header has columns, is returned as a *SyntaxError; the reader can still
+// be used to read the records that follow it.
+func (r *Reader) Read() (Record, error) {
+	if !r.headerDone {
+		_, err := r.ReadHeader()
+		if err != nil {
+			return Record{}, err
+		}
+	}
+
+	for {
+		var raw string
+		if r.hasPending {
+			raw = r.pending
+			r.pending, r.hasPending = "", false
+		} else {
+			var err error
+			raw, err = r.readLine()
+			if err != nil {
+				return Record{}, err
+			}
+		}
+
+		// Skip comment lines and blank lines
+		line := strings.TrimRight(raw, "\r\n")
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		r.recordLine = r.line
+		fields, err := r.parseRecord(line)
+		if err != nil {
+			return Record{}, err
+		}
+
+		if r.header != nil && r.header.Columns != nil && len(fields) != len(r.header.Columns) {
+			return Record{}, &SyntaxError{Line: r.recordLine, Msg: fmt.Sprintf("expected %d fields, got %d", len(r.header.Columns), len(fields))}
+		}
+
+		return Record{Line: r.recordLine, Fields: fields}, nil
+	}
+}
+
+// parseRecord splits a record into fields, reading further lines while a
+// quoted field is open
+func (r *Reader) parseRecord(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	delimiterLen := utf8.RuneLen(r.delimiter)
+	i := 0
+
+	for {
+		// Skip whitespace before the field
+		i = r.skipSpace(line, i)
+
+		if i < len(line) && line[i] == '"' {
+			// Quoted field
+			field.Reset()
+			i++
+			for {
+				j := strings.IndexByte(line[i:], '"')
+				if j < 0 {
+					// The field continues on the next line
+					field.WriteString(line[i:])
+					next, err := r.readLine()
+					if err == io.EOF {
+						return nil, &SyntaxError{Line: r.recordLine, Msg: "unterminated quoted field"}
+					}
+					if err != nil {
+						return nil, fmt.Errorf("error reading SFM record: %w", err)
+					}
+					field.WriteByte('\n')
+					line, i = strings.TrimRight(next, "\r\n"), 0
+					continue
+				}
+
+				field.WriteString(line[i : i+j])
+				i += j + 1
+				if i < len(line) && line[i] == '"' {
+					// Escaped quote
+					field.WriteByte('"')
+					i++
+					continue
+				}
+				break
+			}
+			fields = append(fields, field.String())
+
+			// Only whitespace may follow the closing quote
+			i = r.skipSpace(line, i)
+			if i == len(line) {
+				return fields, nil
+			}
+			if !strings.HasPrefix(line[i:], string(r.delimiter)) {
+				return nil, &SyntaxError{Line: r.line, Msg: "unexpected text after quoted field"}
+			}
+			i += delimiterLen
+			continue
+		}
+
+		// Unquoted field
+		j := strings.IndexRune(line[i:], r.delimiter)
+		if j < 0 {
+			fields = append(fields, strings.TrimSpace(line[i:]))
+			return fields, nil
+		}
+		fields = append(fields, strings.TrimSpace(line[i:i+j]))
+		i += j + delimiterLen
+	}
+}
+
+// skipSpace returns the index of the first non-blank byte of line at or
+// after i, never skipping over the delimiter itself
+func (r *Reader) skipSpace(line string, i int) int {
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') && rune(line[i]) != r.delimiter {
+		i++
+	}
+	return i
+}
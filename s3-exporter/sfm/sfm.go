@@ -0,0 +1,81 @@
+// Package sfm reads and writes SFM segment files.
+//
+// An SFM file starts with a header block made of blank lines, '#' comment
+// lines, a column line and key:value metadata lines such as
+// "jsonS3Exported:false". The column line is the first comment line that
+// contains the delimiter, for example "# id,name,value". The header block
+// ends at the first data line.
+//
+// Data records follow RFC 4180: fields may be quoted, a quote inside a
+// quoted field is escaped by doubling it and quoted fields may contain the
+// delimiter or span several lines. Unquoted fields are trimmed. Comment
+// lines and blank lines between records are skipped, and lines may be of
+// any length.
+package sfm
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultDelimiter separates the fields of SFM files unless configured otherwise
+const DefaultDelimiter = ','
+
+// Position is a position in an SFM file
+type Position struct {
+	Offset int64 // bytes before the position
+	Line   int   // lines before the position
+}
+
+// SyntaxError describes a record that does not follow the SFM format
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// ParseDelimiter converts a configured delimiter name (comma, tab, pipe,
+// semicolon) or a single character into the delimiter rune. An empty name
+// means comma.
+func ParseDelimiter(name string) (rune, error) {
+	switch name {
+	case "", "comma", ",":
+		return ',', nil
+	case "tab", "\t", "\\t":
+		return '\t', nil
+	case "pipe", "|":
+		return '|', nil
+	case "semicolon", ";":
+		return ';', nil
+	}
+
+	delimiter, size := utf8.DecodeRuneInString(name)
+	if size != len(name) || !validDelimiter(delimiter) {
+		return 0, fmt.Errorf("invalid delimiter: %q", name)
+	}
+	return delimiter, nil
+}
+
+// validDelimiter reports whether r can separate fields
+func validDelimiter(r rune) bool {
+	switch r {
+	case '"', '#', ':', '\r', '\n', ' ', utf8.RuneError:
+		return false
+	}
+	return true
+}
+
+// ParseLine splits a single line into fields. A quoted field that is not
+// closed on the same line is a syntax error.
+func ParseLine(line string, delimiter rune) ([]string, error) {
+	// There is no next line for a quoted field to continue on
+	reader := NewReader(strings.NewReader(""), delimiter)
+	reader.headerDone = true
+	reader.line = 1
+	reader.recordLine = 1
+	return reader.parseRecord(strings.TrimRight(line, "\r\n"))
+}
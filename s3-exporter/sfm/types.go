@@ -0,0 +1,128 @@
+package sfm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Type is the type of an SFM column. Types can be declared in the column
+// line, as in "# id:int,value:float,timestamp:time".
+type Type string
+
+const (
+	TypeString Type = "string"
+	TypeInt    Type = "int"
+	TypeFloat  Type = "float"
+	TypeBool   Type = "bool"
+	TypeTime   Type = "time" // RFC 3339 timestamp
+)
+
+// ParseType returns the type with the given name
+func ParseType(name string) (Type, error) {
+	switch t := Type(strings.ToLower(strings.TrimSpace(name))); t {
+	case TypeString, TypeInt, TypeFloat, TypeBool, TypeTime:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown column type: %q", name)
+}
+
+// Convert converts a field to a value of type t: int64, float64, bool,
+// time.Time or string. Empty fields of any type but string are nil.
+func (t Type) Convert(field string) (interface{}, error) {
+	if field == "" && t != TypeString && t != "" {
+		return nil, nil
+	}
+
+	switch t {
+	case TypeInt:
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int %q", field)
+		}
+		return value, nil
+	case TypeFloat:
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("invalid float %q", field)
+		}
+		return value, nil
+	case TypeBool:
+		// Only true and false, so that 0/1 columns are not taken for booleans
+		switch strings.ToLower(field) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, fmt.Errorf("invalid bool %q", field)
+	case TypeTime:
+		value, err := time.Parse(time.RFC3339Nano, field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q", field)
+		}
+		return value, nil
+	}
+	return field, nil
+}
+
+// InferType returns the narrowest type that every non-empty value converts
+// to, or TypeString if there are no such values. Zero-padded numbers such as
+// "007" are identifiers rather than quantities, so they make a column a
+// string column.
+func InferType(values []string) Type {
+	candidates := []Type{TypeBool, TypeInt, TypeFloat, TypeTime}
+	seen := false
+
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		seen = true
+
+		padded := zeroPadded(value)
+		remaining := candidates[:0]
+		for _, t := range candidates {
+			if padded && (t == TypeInt || t == TypeFloat) {
+				continue
+			}
+			_, err := t.Convert(value)
+			if err == nil {
+				remaining = append(remaining, t)
+			}
+		}
+		candidates = remaining
+		if len(candidates) == 0 {
+			return TypeString
+		}
+	}
+
+	if !seen {
+		return TypeString
+	}
+	return candidates[0]
+}
+
+// zeroPadded reports whether a number has a leading zero followed by
+// another digit, as in "007" or "-01.5"
+func zeroPadded(value string) bool {
+	value = strings.TrimLeft(value, "+-")
+	return len(value) > 1 && value[0] == '0' && value[1] >= '0' && value[1] <= '9'
+}
+
+// splitColumnType splits a column declaration such as "id:int" into its
+// name and type. Columns without a known type suffix are returned as is.
+func splitColumnType(column string) (string, Type) {
+	i := strings.LastIndexByte(column, ':')
+	if i < 0 {
+		return column, ""
+	}
+
+	t, err := ParseType(column[i+1:])
+	if err != nil {
+		return column, ""
+	}
+	return strings.TrimSpace(column[:i]), t
+}
@@ -0,0 +1,109 @@
+package sfm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Writer writes SFM files that Reader reads back unchanged
+type Writer struct {
+	writer    *bufio.Writer
+	delimiter rune
+}
+
+// NewWriter creates a writer for an SFM file
+func NewWriter(w io.Writer, delimiter rune) *Writer {
+	return &Writer{writer: bufio.NewWriter(w), delimiter: delimiter}
+}
+
+// WriteHeader writes a header block. A header that was read from a file is
+// written back line by line, so comments and line endings are kept.
+func (w *Writer) WriteHeader(header *Header) error {
+	if header.lines != nil {
+		for _, line := range header.lines {
+			_, err := w.writer.WriteString(line)
+			if err != nil {
+				return fmt.Errorf("error writing SFM header: %w", err)
+			}
+		}
+		return nil
+	}
+
+	columns := header.Columns
+	if header.Types != nil {
+		// Declare the column types
+		columns = make([]string, len(header.Columns))
+		for i, column := range header.Columns {
+			columns[i] = column
+			if header.Types[i] != "" {
+				columns[i] += ":" + string(header.Types[i])
+			}
+		}
+	}
+
+	_, err := w.writer.WriteString("# " + w.join(columns) + "\n")
+	if err != nil {
+		return fmt.Errorf("error writing SFM header: %w", err)
+	}
+	for _, metadata := range header.Metadata {
+		_, err = w.writer.WriteString(metadata.Key + ":" + metadata.Value + "\n")
+		if err != nil {
+			return fmt.Errorf("error writing SFM header: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Write writes a record, quoting the fields that need it
+func (w *Writer) Write(fields []string) error {
+	_, err := w.writer.WriteString(w.join(fields) + "\n")
+	if err != nil {
+		return fmt.Errorf("error writing SFM record: %w", err)
+	}
+	return nil
+}
+
+// Flush writes any buffered data to the underlying writer
+func (w *Writer) Flush() error {
+	err := w.writer.Flush()
+	if err != nil {
+		return fmt.Errorf("error flushing SFM output: %w", err)
+	}
+	return nil
+}
+
+// join joins fields with the delimiter, quoting them where needed
+func (w *Writer) join(fields []string) string {
+	var line strings.Builder
+	for i, field := range fields {
+		if i > 0 {
+			line.WriteRune(w.delimiter)
+		}
+		if w.needsQuotes(field, i == 0) {
+			line.WriteByte('"')
+			line.WriteString(strings.ReplaceAll(field, `"`, `""`))
+			line.WriteByte('"')
+		} else {
+			line.WriteString(field)
+		}
+	}
+	return line.String()
+}
+
+// needsQuotes reports whether a field would not be read back as is unquoted
+func (w *Writer) needsQuotes(field string, first bool) bool {
+	if field == "" {
+		return false
+	}
+	if strings.ContainsRune(field, w.delimiter) || strings.ContainsAny(field, "\"\r\n") {
+		return true
+	}
+	if strings.TrimSpace(field) != field {
+		return true
+	}
+	// A record starting with '#' would be read as a comment line
+	return first && strings.HasPrefix(field, "#")
+}
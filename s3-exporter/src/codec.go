@@ -0,0 +1,188 @@
+package src
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codec compresses objects in one compression format
+type Codec interface {
+	// Name is the codec name used in the configuration and manifests
+	Name() string
+	// Extension is appended to the keys of compressed objects
+	Extension() string
+	// ContentType is the media type of compressed objects
+	ContentType() string
+	// ContentEncoding is the HTTP content coding of the codec, or "" if it
+	// has none, in which case objects are stored with ContentType instead
+	ContentEncoding() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// CodecNames lists the available codecs
+var CodecNames = []string{"gzip", "zlib", "zstd", "snappy", "lz4"}
+
+// NewCodec returns the codec with the given name. level is the compression
+// level, 0 for the codec's default; snappy has no levels.
+func NewCodec(name string, level int) (Codec, error) {
+	switch name {
+	case "", "gzip":
+		if level != 0 && (level < gzip.HuffmanOnly || level > gzip.BestCompression) {
+			return nil, fmt.Errorf("invalid gzip level: %d", level)
+		}
+		return gzipCodec{level: defaultLevel(level, gzip.DefaultCompression)}, nil
+	case "zlib":
+		if level != 0 && (level < zlib.HuffmanOnly || level > zlib.BestCompression) {
+			return nil, fmt.Errorf("invalid zlib level: %d", level)
+		}
+		return zlibCodec{level: defaultLevel(level, zlib.DefaultCompression)}, nil
+	case "zstd":
+		if level < 0 || level > 22 {
+			return nil, fmt.Errorf("invalid zstd level: %d", level)
+		}
+		return zstdCodec{level: level}, nil
+	case "snappy":
+		if level != 0 {
+			return nil, fmt.Errorf("snappy does not support compression levels")
+		}
+		return snappyCodec{}, nil
+	case "lz4":
+		if level < 0 || level > 9 {
+			return nil, fmt.Errorf("invalid lz4 level: %d", level)
+		}
+		return lz4Codec{level: level}, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q, expected one of %s", name, strings.Join(CodecNames, ", "))
+}
+
+// CodecFor returns the codec of a compressed file based on its extension,
+// or nil if the file is not compressed
+func CodecFor(filePath string) Codec {
+	for _, name := range CodecNames {
+		codec, _ := NewCodec(name, 0)
+		if strings.HasSuffix(filePath, codec.Extension()) {
+			return codec
+		}
+	}
+	return nil
+}
+
+// defaultLevel returns level, or def if level is 0
+func defaultLevel(level, def int) int {
+	if level == 0 {
+		return def
+	}
+	return level
+}
+
+// gzipCodec compresses with gzip
+type gzipCodec struct {
+	level int
+}
+
+func (gzipCodec) Name() string            { return "gzip" }
+func (gzipCodec) Extension() string       { return ".gz" }
+func (gzipCodec) ContentType() string     { return "application/gzip" }
+func (gzipCodec) ContentEncoding() string { return "gzip" }
+
+func (c gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// zlibCodec compresses with zlib, the "deflate" HTTP content coding
+type zlibCodec struct {
+	level int
+}
+
+func (zlibCodec) Name() string            { return "zlib" }
+func (zlibCodec) Extension() string       { return ".zz" }
+func (zlibCodec) ContentType() string     { return "application/zlib" }
+func (zlibCodec) ContentEncoding() string { return "deflate" }
+
+func (c zlibCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriterLevel(w, c.level)
+}
+
+func (zlibCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+// zstdCodec compresses with Zstandard
+type zstdCodec struct {
+	level int // zstd level, 0 for the default
+}
+
+func (zstdCodec) Name() string            { return "zstd" }
+func (zstdCodec) Extension() string       { return ".zst" }
+func (zstdCodec) ContentType() string     { return "application/zstd" }
+func (zstdCodec) ContentEncoding() string { return "zstd" }
+
+func (c zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	if c.level != 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+	}
+	return zstd.NewWriter(w, opts...)
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// snappyCodec compresses with the snappy framing format
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string            { return "snappy" }
+func (snappyCodec) Extension() string       { return ".sz" }
+func (snappyCodec) ContentType() string     { return "application/x-snappy-framed" }
+func (snappyCodec) ContentEncoding() string { return "" }
+
+func (snappyCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+func (snappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(snappy.NewReader(r)), nil
+}
+
+// lz4Codec compresses with the LZ4 frame format
+type lz4Codec struct {
+	level int // 1 to 9, 0 for the fast default
+}
+
+// lz4Levels maps compression levels to LZ4 levels
+var lz4Levels = []lz4.CompressionLevel{lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9}
+
+func (lz4Codec) Name() string            { return "lz4" }
+func (lz4Codec) Extension() string       { return ".lz4" }
+func (lz4Codec) ContentType() string     { return "application/x-lz4" }
+func (lz4Codec) ContentEncoding() string { return "" }
+
+func (c lz4Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	writer := lz4.NewWriter(w)
+	err := writer.Apply(lz4.CompressionLevelOption(lz4Levels[c.level]))
+	if err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (lz4Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(lz4.NewReader(r)), nil
+}
@@ -1,7 +1,6 @@
 package src
 
 import (
-	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
@@ -9,8 +8,19 @@ import (
 	"path/filepath"
 )
 
-// CompressFile compresses a file using gzip and returns the compressed file path
-func CompressFile(filePath string) (string, error) {
+// CompressFile compresses a file using gzip, compressing blocks in parallel
+// as configured by opts, and returns the compressed file path
+func CompressFile(filePath string, opts ParallelGzipOptions) (string, error) {
+	codec, err := NewParallelGzipCodec(opts)
+	if err != nil {
+		return "", err
+	}
+	return CompressFileWith(filePath, codec)
+}
+
+// CompressFileWith compresses a file with codec and returns the compressed
+// file path, or the original path if compression does not make it smaller
+func CompressFileWith(filePath string, codec Codec) (string, error) {
 	// Open the source file
 	sourceFile, err := os.Open(filePath)
 	if err != nil {
@@ -19,27 +29,33 @@ func CompressFile(filePath string) (string, error) {
 	defer sourceFile.Close()
 
 	// Create the destination file
-	destPath := filePath + ".gz"
+	destPath := filePath + codec.Extension()
 	destFile, err := os.Create(destPath)
 	if err != nil {
 		return "", fmt.Errorf("error creating destination file: %w", err)
 	}
 	defer destFile.Close()
 
-	// Create gzip writer
-	gzipWriter := gzip.NewWriter(destFile)
-	defer gzipWriter.Close()
+	// Create the compressing writer
+	compressWriter, err := codec.NewWriter(destFile)
+	if err != nil {
+		os.Remove(destPath)
+		return "", fmt.Errorf("error creating %s writer: %w", codec.Name(), err)
+	}
 
-	// Copy data from source to gzip writer
-	_, err = io.Copy(gzipWriter, sourceFile)
+	// Copy data from source to the compressing writer
+	_, err = io.Copy(compressWriter, sourceFile)
 	if err != nil {
+		compressWriter.Close()
+		os.Remove(destPath)
 		return "", fmt.Errorf("error compressing file: %w", err)
 	}
 
-	// Flush and close the gzip writer explicitly before returning
-	err = gzipWriter.Close()
+	// Flush and close the compressing writer explicitly before returning
+	err = compressWriter.Close()
 	if err != nil {
-		return "", fmt.Errorf("error closing gzip writer: %w", err)
+		os.Remove(destPath)
+		return "", fmt.Errorf("error closing %s writer: %w", codec.Name(), err)
 	}
 
 	// Check if the compression was successful by comparing file sizes
@@ -62,11 +78,13 @@ func CompressFile(filePath string) (string, error) {
 	return destPath, nil
 }
 
-// DecompressFile decompresses a gzip file and returns the path to the decompressed file
+// DecompressFile decompresses a file compressed by any codec and returns
+// the path to the decompressed file
 func DecompressFile(filePath string) (string, error) {
-	// Check if the file is a gzip file
-	if filepath.Ext(filePath) != ".gz" {
-		return "", fmt.Errorf("file is not a gzip file: %s", filePath)
+	// Pick the codec from the file extension
+	codec := CodecFor(filePath)
+	if codec == nil {
+		return "", fmt.Errorf("file is not a compressed file: %s", filePath)
 	}
 
 	// Open the source file
@@ -76,23 +94,23 @@ func DecompressFile(filePath string) (string, error) {
 	}
 	defer sourceFile.Close()
 
-	// Create gzip reader
-	gzipReader, err := gzip.NewReader(sourceFile)
+	// Create the decompressing reader
+	decompressReader, err := codec.NewReader(sourceFile)
 	if err != nil {
-		return "", fmt.Errorf("error creating gzip reader: %w", err)
+		return "", fmt.Errorf("error creating %s reader: %w", codec.Name(), err)
 	}
-	defer gzipReader.Close()
+	defer decompressReader.Close()
 
-	// Create the destination file (without .gz extension)
-	destPath := strings.TrimSuffix(filePath, ".gz")
+	// Create the destination file (without the codec extension)
+	destPath := strings.TrimSuffix(filePath, codec.Extension())
 	destFile, err := os.Create(destPath)
 	if err != nil {
 		return "", fmt.Errorf("error creating destination file: %w", err)
 	}
 	defer destFile.Close()
 
-	// Copy data from gzip reader to destination file
-	_, err = io.Copy(destFile, gzipReader)
+	// Copy data from the decompressing reader to destination file
+	_, err = io.Copy(destFile, decompressReader)
 	if err != nil {
 		return "", fmt.Errorf("error decompressing file: %w", err)
 	}
@@ -100,8 +118,14 @@ func DecompressFile(filePath string) (string, error) {
 	return destPath, nil
 }
 
-// CompressDirectory compresses all files in a directory
-func CompressDirectory(dirPath string) ([]string, error) {
+// CompressDirectory compresses all files in a directory using parallel gzip
+// as configured by opts
+func CompressDirectory(dirPath string, opts ParallelGzipOptions) ([]string, error) {
+	codec, err := NewParallelGzipCodec(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	// Get a list of all files in the directory
 	files, err := os.ReadDir(dirPath)
 	if err != nil {
@@ -119,12 +143,12 @@ func CompressDirectory(dirPath string) ([]string, error) {
 		filePath := filepath.Join(dirPath, file.Name())
 		
 		// Skip already compressed files
-		if filepath.Ext(filePath) == ".gz" {
+		if CodecFor(filePath) != nil {
 			compressedFiles = append(compressedFiles, filePath)
 			continue
 		}
 
-		compressedPath, err := CompressFile(filePath)
+		compressedPath, err := CompressFileWith(filePath, codec)
 		if err != nil {
 			return compressedFiles, fmt.Errorf("error compressing %s: %w", filePath, err)
 		}
@@ -0,0 +1,196 @@
+package src
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalStore is an ObjectStore that keeps objects as files below a root
+// directory, for air-gapped hosts and tests that must not talk to AWS
+type LocalStore struct {
+	root string
+}
+
+// NewLocalStore creates a LocalStore rooted at dir, creating it if needed
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no local store directory configured")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating local store directory: %w", err)
+	}
+	return &LocalStore{root: dir}, nil
+}
+
+// path maps an object key to a file below the store root
+func (s *LocalStore) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || strings.HasSuffix(key, "/") {
+		return "", fmt.Errorf("invalid object key: %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+// Put writes body to the file for key. The data is written to a temporary
+// file first so readers never observe a partially written object.
+func (s *LocalStore) Put(key string, body io.Reader, opts PutOptions) error {
+	dest, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating object directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".put-*")
+	if err != nil {
+		return fmt.Errorf("error creating object file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, body)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing object file: %w", err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("error closing object file: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), dest)
+	if err != nil {
+		return fmt.Errorf("error storing object file: %w", err)
+	}
+
+	return nil
+}
+
+// Get opens the file for key
+func (s *LocalStore) Get(key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		return nil, fmt.Errorf("error opening object file: %w", err)
+	}
+
+	return file, nil
+}
+
+// List returns every object whose key starts with prefix
+func (s *LocalStore) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".put-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+			ContentType:  ContentTypeFor(key),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing local store: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// ListPrefixes returns the key prefixes one level below prefix, which are
+// the directories in the directory of prefix that start with its last part
+func (s *LocalStore) ListPrefixes(prefix string) ([]string, error) {
+	dir, partial := path.Split(prefix)
+	entries, err := os.ReadDir(filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+dir))))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error listing local store: %w", err)
+	}
+
+	// Entries are sorted by name
+	var prefixes []string
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), partial) {
+			prefixes = append(prefixes, dir+entry.Name()+"/")
+		}
+	}
+	return prefixes, nil
+}
+
+// Delete removes the file for key
+func (s *LocalStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error deleting object file: %w", err)
+	}
+
+	return nil
+}
+
+// Head returns the metadata of the file for key
+func (s *LocalStore) Head(key string) (*ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		return nil, fmt.Errorf("error reading object file info: %w", err)
+	}
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		ContentType:  ContentTypeFor(key),
+	}, nil
+}
@@ -0,0 +1,127 @@
+package src
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryObject is a single object held by a MemoryStore
+type memoryObject struct {
+	data            []byte
+	contentType     string
+	contentEncoding string
+	lastModified    time.Time
+}
+
+// MemoryStore is an ObjectStore that keeps every object in memory. It is
+// safe for concurrent use and intended for tests and dry runs.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: make(map[string]memoryObject)}
+}
+
+// Put reads body fully and stores it under key
+func (s *MemoryStore) Put(key string, body io.Reader, opts PutOptions) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("error reading object body: %w", err)
+	}
+
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = memoryObject{data: data, contentType: contentType, contentEncoding: opts.ContentEncoding, lastModified: time.Now()}
+	return nil
+}
+
+// Get returns a reader over the object stored under key
+func (s *MemoryStore) Get(key string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	object, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return io.NopCloser(bytes.NewReader(object.data)), nil
+}
+
+// List returns every object whose key starts with prefix
+func (s *MemoryStore) List(prefix string) ([]ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var objects []ObjectInfo
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, object.info(key))
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// ListPrefixes returns the key prefixes one level below prefix
+func (s *MemoryStore) ListPrefixes(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var prefixes []string
+	for key := range s.objects {
+		if p, ok := commonPrefix(key, prefix); ok && !seen[p] {
+			seen[p] = true
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
+// Delete removes the object stored under key
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+// Head returns the metadata of the object stored under key
+func (s *MemoryStore) Head(key string) (*ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	object, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	info := object.info(key)
+	return &info, nil
+}
+
+// info builds the ObjectInfo for the object stored under key
+func (o memoryObject) info(key string) ObjectInfo {
+	return ObjectInfo{
+		Key:             key,
+		Size:            int64(len(o.data)),
+		LastModified:    o.lastModified,
+		ContentType:     o.contentType,
+		ContentEncoding: o.contentEncoding,
+	}
+}
@@ -0,0 +1,229 @@
+package src
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// DefaultGzipBlockSize is the amount of input compressed per gzip member
+const DefaultGzipBlockSize = 1024 * 1024
+
+// minGzipBlockSize keeps members large enough for the per-member header and
+// the reset compression window not to hurt the ratio noticeably
+const minGzipBlockSize = 64 * 1024
+
+// ParallelGzipOptions configures block-parallel gzip compression
+type ParallelGzipOptions struct {
+	Level       int // gzip level, 0 for the default
+	Concurrency int // blocks compressed at the same time, 0 for one per CPU
+	BlockSize   int // input bytes per block, 0 for DefaultGzipBlockSize
+}
+
+// NewParallelGzipCodec returns a gzip codec that compresses blocks of its
+// input in parallel. Each block is written as an independent gzip member;
+// concatenated members form a valid gzip stream that any gzip reader
+// decompresses as a whole.
+func NewParallelGzipCodec(opts ParallelGzipOptions) (Codec, error) {
+	if opts.Level != 0 && (opts.Level < gzip.HuffmanOnly || opts.Level > gzip.BestCompression) {
+		return nil, fmt.Errorf("invalid gzip level: %d", opts.Level)
+	}
+	if opts.Concurrency < 0 {
+		return nil, fmt.Errorf("invalid gzip concurrency: %d", opts.Concurrency)
+	}
+	if opts.BlockSize != 0 && opts.BlockSize < minGzipBlockSize {
+		return nil, fmt.Errorf("gzip block size must be at least %d bytes, got %d", minGzipBlockSize, opts.BlockSize)
+	}
+
+	opts.Level = defaultLevel(opts.Level, gzip.DefaultCompression)
+	if opts.Concurrency == 0 {
+		opts.Concurrency = runtime.GOMAXPROCS(0)
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = DefaultGzipBlockSize
+	}
+	return parallelGzipCodec{opts: opts}, nil
+}
+
+// parallelGzipCodec compresses with block-parallel gzip
+type parallelGzipCodec struct {
+	gzipCodec
+	opts ParallelGzipOptions
+}
+
+func (c parallelGzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return NewParallelGzipWriter(w, c.opts), nil
+}
+
+// gzipBlock is the compressed output of one block
+type gzipBlock struct {
+	data *bytes.Buffer
+	err  error
+}
+
+// ParallelGzipWriter compresses blocks of its input concurrently and writes
+// them to the underlying writer as gzip members, in input order
+type ParallelGzipWriter struct {
+	w         io.Writer
+	level     int
+	blockSize int
+
+	block   []byte
+	written bool // whether any block has been dispatched
+
+	// results holds one channel per dispatched block, in input order; its
+	// capacity bounds the number of blocks in flight
+	results chan chan gzipBlock
+	done    chan struct{}
+
+	mu  sync.Mutex
+	err error
+
+	buffers sync.Pool
+	writers sync.Pool
+}
+
+// NewParallelGzipWriter returns a writer that compresses to w. opts are
+// expected to be filled in, as done by NewParallelGzipCodec.
+func NewParallelGzipWriter(w io.Writer, opts ParallelGzipOptions) *ParallelGzipWriter {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = runtime.GOMAXPROCS(0)
+	}
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = DefaultGzipBlockSize
+	}
+	if opts.Level == 0 {
+		opts.Level = gzip.DefaultCompression
+	}
+
+	p := &ParallelGzipWriter{
+		w:         w,
+		level:     opts.Level,
+		blockSize: opts.BlockSize,
+		block:     make([]byte, 0, opts.BlockSize),
+		results:   make(chan chan gzipBlock, opts.Concurrency),
+		done:      make(chan struct{}),
+	}
+	go p.writeBlocks()
+	return p
+}
+
+// Write buffers p and dispatches every full block for compression
+func (p *ParallelGzipWriter) Write(data []byte) (int, error) {
+	err := p.error()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for len(data) > 0 {
+		// Fill the current block
+		free := p.blockSize - len(p.block)
+		if free > len(data) {
+			free = len(data)
+		}
+		p.block = append(p.block, data[:free]...)
+		data = data[free:]
+		n += free
+
+		if len(p.block) == p.blockSize {
+			p.dispatch()
+		}
+	}
+
+	return n, p.error()
+}
+
+// Close compresses the last block and waits for every block to be written
+func (p *ParallelGzipWriter) Close() error {
+	// An empty input still needs one member to be a valid gzip stream
+	if len(p.block) > 0 || !p.written {
+		p.dispatch()
+	}
+	close(p.results)
+	<-p.done
+	return p.error()
+}
+
+// dispatch starts compressing the current block. It blocks while the
+// maximum number of blocks is in flight.
+func (p *ParallelGzipWriter) dispatch() {
+	block := p.block
+	result := make(chan gzipBlock, 1)
+	p.results <- result
+	p.written = true
+
+	go func() {
+		result <- p.compress(block)
+	}()
+
+	p.block = make([]byte, 0, p.blockSize)
+}
+
+// compress compresses one block into a gzip member
+func (p *ParallelGzipWriter) compress(block []byte) gzipBlock {
+	buf, _ := p.buffers.Get().(*bytes.Buffer)
+	if buf == nil {
+		buf = &bytes.Buffer{}
+	}
+	buf.Reset()
+
+	writer, _ := p.writers.Get().(*gzip.Writer)
+	if writer == nil {
+		var err error
+		writer, err = gzip.NewWriterLevel(buf, p.level)
+		if err != nil {
+			return gzipBlock{err: err}
+		}
+	} else {
+		writer.Reset(buf)
+	}
+	defer p.writers.Put(writer)
+
+	_, err := writer.Write(block)
+	if err == nil {
+		err = writer.Close()
+	}
+	return gzipBlock{data: buf, err: err}
+}
+
+// writeBlocks writes compressed blocks to the underlying writer in order.
+// After an error it keeps draining results so that dispatch never blocks.
+func (p *ParallelGzipWriter) writeBlocks() {
+	defer close(p.done)
+
+	for result := range p.results {
+		block := <-result
+		if block.err != nil {
+			p.setError(fmt.Errorf("error compressing gzip block: %w", block.err))
+			continue
+		}
+
+		if p.error() == nil {
+			_, err := p.w.Write(block.data.Bytes())
+			if err != nil {
+				p.setError(err)
+			}
+		}
+		p.buffers.Put(block.data)
+	}
+}
+
+// error returns the first error, if any
+func (p *ParallelGzipWriter) error() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// setError records err unless an error was already recorded
+func (p *ParallelGzipWriter) setError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
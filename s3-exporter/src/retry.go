@@ -0,0 +1,308 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// RetryPolicy controls how failed storage operations are retried
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry; it doubles on every retry
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between two attempts
+	MaxDelay time.Duration
+	// Jitter is the fraction (0-1) of each delay that is randomised, so that
+	// parallel uploads do not retry in lock step
+	Jitter float64
+}
+
+// DefaultRetryPolicy returns the retry policy used when none is configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    30 * time.Second,
+		Jitter:      0.2,
+	}
+}
+
+// maxUncappedDelay bounds the doubling when the policy has no MaxDelay, so
+// that the delay cannot overflow into a negative duration
+const maxUncappedDelay = time.Duration(math.MaxInt64 / 2)
+
+// Delay returns how long to wait before retry number attempt (starting at 1)
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		if delay > maxUncappedDelay/2 {
+			delay = maxUncappedDelay
+			break
+		}
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if p.Jitter > 0 && delay > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		// Spread the delay over [delay*(1-jitter), delay]
+		spread := time.Duration(float64(delay) * jitter)
+		delay -= time.Duration(rand.Int63n(int64(spread) + 1))
+	}
+
+	return delay
+}
+
+// Retry runs fn until it succeeds, fails with an error that is not
+// retryable, or the policy runs out of attempts. Every failed attempt is
+// logged with op as a description of the operation.
+func Retry(policy RetryPolicy, op string, fn func() error) error {
+	attempts := policy.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = fn()
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("%s succeeded on attempt %d/%d", op, attempt, attempts)
+			}
+			return nil
+		}
+
+		if !IsRetryable(err) {
+			if attempt > 1 {
+				log.Printf("%s failed on attempt %d/%d with a permanent error: %v", op, attempt, attempts, err)
+			}
+			return err
+		}
+
+		if attempt == attempts {
+			log.Printf("%s failed on attempt %d/%d, giving up: %v", op, attempt, attempts, err)
+			break
+		}
+
+		delay := policy.Delay(attempt)
+		log.Printf("%s failed on attempt %d/%d, retrying in %v: %v", op, attempt, attempts, delay, err)
+		time.Sleep(delay)
+	}
+
+	return fmt.Errorf("%s failed after %d attempts: %w", op, attempts, err)
+}
+
+// Error codes that will not go away by retrying
+var permanentErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AllAccessDisabled":     true,
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+	"ExpiredToken":          true,
+	"InvalidToken":          true,
+	"NoSuchBucket":          true,
+	"NoSuchKey":             true,
+	"NotFound":              true,
+	"InvalidBucketName":     true,
+	"InvalidObjectState":    true,
+	"EntityTooLarge":        true,
+	"EntityTooSmall":        true,
+	"InvalidArgument":       true,
+	"InvalidRequest":        true,
+	"MalformedXML":          true,
+}
+
+// Error codes for throttling and transient service or network failures
+var retryableErrorCodes = map[string]bool{
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestThrottled":                       true,
+	"RequestThrottledException":              true,
+	"TooManyRequestsException":               true,
+	"ProvisionedThroughputExceededException": true,
+	"SlowDown":                               true,
+	"RequestTimeout":                         true,
+	"RequestTimeoutException":                true,
+	"InternalError":                          true,
+	"ServiceUnavailable":                     true,
+	"RequestLimitExceeded":                   true,
+	"EC2ThrottledException":                  true,
+	request.ErrCodeRequestError:              true,
+	request.ErrCodeRead:                      true,
+	request.ErrCodeResponseTimeout:           true,
+}
+
+// IsRetryable reports whether err is a transient failure (throttling, 5xx
+// responses, timeouts, connection resets) that is worth retrying. Permanent
+// errors such as AccessDenied or NoSuchBucket, and errors that are not
+// recognised, are not retried.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	// Walk the chain of AWS errors, which do not support errors.Unwrap
+	var aerr awserr.Error
+	for errors.As(err, &aerr) {
+		if permanentErrorCodes[aerr.Code()] {
+			return false
+		}
+		if retryableErrorCodes[aerr.Code()] {
+			return true
+		}
+
+		var reqErr awserr.RequestFailure
+		if errors.As(aerr, &reqErr) {
+			status := reqErr.StatusCode()
+			if status == http.StatusTooManyRequests || status >= 500 {
+				return true
+			}
+			if status >= 400 {
+				return false
+			}
+		}
+
+		if aerr.OrigErr() == nil {
+			break
+		}
+		err = aerr.OrigErr()
+	}
+
+	// Network level failures
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return false
+}
+
+// RetryingStore wraps an ObjectStore and retries failed operations
+// according to a RetryPolicy. Backends with retries of their own, such as
+// S3Store, should have them disabled (see S3Options.DisableSDKRetries) so
+// that attempts and delays are not multiplied. Uploads of bodies that cannot
+// be rewound are left to the backend's own retries.
+type RetryingStore struct {
+	store  ObjectStore
+	policy RetryPolicy
+}
+
+// NewRetryingStore wraps store so that every operation is retried with policy
+func NewRetryingStore(store ObjectStore, policy RetryPolicy) *RetryingStore {
+	return &RetryingStore{store: store, policy: policy}
+}
+
+// rewindable returns body as an io.Seeker along with its current offset, or
+// false if body cannot be rewound to be sent again
+func rewindable(body io.Reader) (io.Seeker, int64, bool) {
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return nil, 0, false
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, false
+	}
+	return seeker, start, true
+}
+
+// Put stores body under key. A body can only be sent again if it can be
+// rewound, so bodies that are not an io.Seeker, such as pipes, are attempted
+// only once here.
+func (s *RetryingStore) Put(key string, body io.Reader, opts PutOptions) error {
+	seeker, start, ok := rewindable(body)
+	if !ok {
+		return s.store.Put(key, body, opts)
+	}
+
+	attempt := 0
+	return Retry(s.policy, fmt.Sprintf("upload of %s", key), func() error {
+		attempt++
+		if attempt > 1 {
+			_, err := seeker.Seek(start, io.SeekStart)
+			if err != nil {
+				return fmt.Errorf("error rewinding upload body: %w", err)
+			}
+		}
+		return s.store.Put(key, body, opts)
+	})
+}
+
+// Get opens the object stored under key
+func (s *RetryingStore) Get(key string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := Retry(s.policy, fmt.Sprintf("download of %s", key), func() error {
+		var err error
+		body, err = s.store.Get(key)
+		return err
+	})
+	return body, err
+}
+
+// List returns every object whose key starts with prefix
+func (s *RetryingStore) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := Retry(s.policy, fmt.Sprintf("listing of %s", prefix), func() error {
+		var err error
+		objects, err = s.store.List(prefix)
+		return err
+	})
+	return objects, err
+}
+
+// ListPrefixes returns the key prefixes one level below prefix
+func (s *RetryingStore) ListPrefixes(prefix string) ([]string, error) {
+	var prefixes []string
+	err := Retry(s.policy, fmt.Sprintf("listing of %s", prefix), func() error {
+		var err error
+		prefixes, err = s.store.ListPrefixes(prefix)
+		return err
+	})
+	return prefixes, err
+}
+
+// Delete removes the object stored under key
+func (s *RetryingStore) Delete(key string) error {
+	return Retry(s.policy, fmt.Sprintf("deletion of %s", key), func() error {
+		return s.store.Delete(key)
+	})
+}
+
+// Head returns the metadata of the object stored under key
+func (s *RetryingStore) Head(key string) (*ObjectInfo, error) {
+	var info *ObjectInfo
+	err := Retry(s.policy, fmt.Sprintf("metadata lookup of %s", key), func() error {
+		var err error
+		info, err = s.store.Head(key)
+		return err
+	})
+	return info, err
+}
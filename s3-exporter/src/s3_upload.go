@@ -1,84 +1,411 @@
 package src
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
-	"path/filepath"
+	"sort"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
-// UploadToS3 uploads a file to an S3 bucket
-func UploadToS3(filePath, s3Path, bucket, region, accessKey, secretKey string) error {
+// S3Options holds the settings needed to talk to an S3 bucket
+type S3Options struct {
+	Region string
+	Bucket string
+
+	// AccessKey and SecretKey select static credentials. They are only kept
+	// for backwards compatibility; when either is empty the standard AWS
+	// credential chain is used instead: environment variables, the shared
+	// credentials file, web identity tokens and EC2/ECS instance roles.
+	AccessKey string
+	SecretKey string
+	// Profile selects a named profile from the shared credentials and config files
+	Profile string
+	// RoleARN is a role to assume on top of the base credentials
+	RoleARN string
+	// ExternalID is passed when assuming RoleARN
+	ExternalID string
+	// RoleSessionName names the assumed role session
+	RoleSessionName string
+	// WebIdentityTokenFile is an OIDC token file exchanged for RoleARN
+	// credentials, as used by EKS service accounts
+	WebIdentityTokenFile string
+
+	// Endpoint overrides the AWS endpoint, for S3-compatible services such
+	// as MinIO, Ceph or LocalStack
+	Endpoint string
+	// ForcePathStyle addresses buckets as endpoint/bucket/key instead of
+	// bucket.endpoint/key, which most S3-compatible services require
+	ForcePathStyle bool
+	// DisableSSL talks plain HTTP to the endpoint
+	DisableSSL bool
+	// CABundle is the path to a PEM file with extra certificate authorities
+	// to trust, for endpoints using a private CA
+	CABundle string
+
+	// PartSize is the multipart upload part size in bytes
+	PartSize int64
+	// Concurrency is the number of parts uploaded in parallel per object
+	Concurrency int
+
+	// DisableSDKRetries turns off the retries built into the AWS SDK. Set it
+	// when the store is wrapped in a RetryingStore, which then makes every
+	// attempt itself. Uploads of bodies that cannot be rewound, which a
+	// RetryingStore attempts only once, keep the SDK retries so that their
+	// buffered parts are still sent again.
+	DisableSDKRetries bool
+}
+
+// Upload defaults, used when S3Options leaves them unset
+const (
+	DefaultPartSize    = 5 * 1024 * 1024 // 5MB part size
+	DefaultConcurrency = 5               // 5 concurrent uploads
+)
+
+// newHTTPClient creates the HTTP client shared by every request of a store.
+// The idle connection pool is sized so that all concurrent part uploads can
+// reuse their connections instead of opening new ones for every batch.
+func newHTTPClient(concurrency int) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if transport.MaxIdleConnsPerHost < concurrency*2 {
+		transport.MaxIdleConnsPerHost = concurrency * 2
+	}
+	if transport.MaxIdleConns < transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost
+	}
+	// Objects stored with a Content-Encoding must be read back as stored,
+	// not transparently decompressed
+	transport.DisableCompression = true
+	return &http.Client{Transport: transport}
+}
+
+// defaultRoleSessionName is used when assuming a role without a configured session name
+const defaultRoleSessionName = "s3-exporter"
+
+// newSession creates an AWS session from opts with the credentials resolved.
+// Endpoint settings are not applied here so that STS calls made to assume a
+// role still reach AWS; see s3Config.
+func newSession(opts S3Options) (*session.Session, error) {
+	region := opts.Region
+	if region == "" && opts.Endpoint != "" {
+		// S3-compatible services ignore the region but requests must still be signed with one
+		region = "us-east-1"
+	}
+
+	sessOpts := session.Options{
+		Config: aws.Config{
+			Region:     aws.String(region),
+			HTTPClient: newHTTPClient(opts.Concurrency),
+		},
+		Profile:           opts.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if opts.DisableSDKRetries {
+		sessOpts.Config.MaxRetries = aws.Int(0)
+	}
+	if opts.AccessKey != "" && opts.SecretKey != "" {
+		sessOpts.Config.Credentials = credentials.NewStaticCredentials(opts.AccessKey, opts.SecretKey, "")
+	}
+
+	// Load the custom CA bundle, if any
+	if opts.CABundle != "" {
+		bundle, err := os.Open(opts.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("error opening CA bundle: %w", err)
+		}
+		defer bundle.Close()
+		sessOpts.CustomCABundle = bundle
+	}
+
+	sess, err := session.NewSessionWithOptions(sessOpts)
+	if err != nil {
+		return nil, fmt.Errorf("error creating AWS session: %w", err)
+	}
+
+	if opts.RoleARN == "" {
+		if opts.WebIdentityTokenFile != "" {
+			return nil, fmt.Errorf("a web identity token file requires a role ARN")
+		}
+		return sess, nil
+	}
+
+	// Exchange the base credentials for the configured role
+	sessionName := opts.RoleSessionName
+	if sessionName == "" {
+		sessionName = defaultRoleSessionName
+	}
+
+	var creds *credentials.Credentials
+	if opts.WebIdentityTokenFile != "" {
+		creds = stscreds.NewWebIdentityCredentials(sess, opts.RoleARN, sessionName, opts.WebIdentityTokenFile)
+	} else {
+		creds = stscreds.NewCredentials(sess, opts.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = sessionName
+			if opts.ExternalID != "" {
+				p.ExternalID = aws.String(opts.ExternalID)
+			}
+		})
+	}
+
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
+
+// s3Config returns the client settings that only apply to S3 requests
+func s3Config(opts S3Options) *aws.Config {
+	cfg := &aws.Config{
+		S3ForcePathStyle: aws.Bool(opts.ForcePathStyle),
+		DisableSSL:       aws.Bool(opts.DisableSSL),
+	}
+	if opts.Endpoint != "" {
+		cfg.Endpoint = aws.String(opts.Endpoint)
+	}
+	return cfg
+}
+
+// S3Store is an ObjectStore backed by an S3 bucket
+type S3Store struct {
+	bucket   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	// sdkRetriesDisabled is set when retries are left to a RetryingStore
+	sdkRetriesDisabled bool
+}
+
+// NewS3Store creates an S3Store. The AWS session, HTTP connection pool and
+// uploader are created once and shared by every call made through the
+// store, so a store should live for the whole run.
+func NewS3Store(opts S3Options) (*S3Store, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("no S3 bucket configured")
+	}
+	if opts.PartSize == 0 {
+		opts.PartSize = DefaultPartSize
+	}
+	if opts.PartSize < s3manager.MinUploadPartSize {
+		return nil, fmt.Errorf("upload part size must be at least %d bytes, got %d", s3manager.MinUploadPartSize, opts.PartSize)
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+
 	// Create AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
+	sess, err := newSession(opts)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.New(sess, s3Config(opts))
+
+	// Create an uploader with the client and custom options
+	uploader := s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+		u.PartSize = opts.PartSize
+		u.Concurrency = opts.Concurrency
 	})
+
+	return &S3Store{
+		bucket:   opts.Bucket,
+		client:   client,
+		uploader: uploader,
+
+		sdkRetriesDisabled: opts.DisableSDKRetries,
+	}, nil
+}
+
+// Put uploads body to the bucket under key
+func (s *S3Store) Put(key string, body io.Reader, opts PutOptions) error {
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	}
+	if opts.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(opts.ContentEncoding)
+	}
+
+	// A RetryingStore cannot send a body that does not rewind again, so the
+	// SDK has to retry its parts instead
+	var uploadOpts []func(*s3manager.Uploader)
+	if _, _, ok := rewindable(body); s.sdkRetriesDisabled && !ok {
+		uploadOpts = append(uploadOpts, s3manager.WithUploaderRequestOptions(withSDKRetries))
+	}
+
+	_, err := s.uploader.UploadWithContext(aws.BackgroundContext(), input, uploadOpts...)
 	if err != nil {
-		return fmt.Errorf("error creating AWS session: %w", err)
+		return fmt.Errorf("error uploading file to S3: %w", err)
 	}
 
-	// Open the file for reading
-	file, err := os.Open(filePath)
+	return nil
+}
+
+// withSDKRetries restores the SDK's default retries on a request
+func withSDKRetries(r *request.Request) {
+	r.Retryer = client.DefaultRetryer{NumMaxRetries: client.DefaultRetryerMaxNumRetries}
+}
+
+// Get opens the object stored under key
+func (s *S3Store) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		return fmt.Errorf("error opening file: %w", err)
+		if isS3NotFound(err) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		return nil, fmt.Errorf("error downloading file from S3: %w", err)
 	}
-	defer file.Close()
 
-	// Get file stats
-	// fileInfo, err := file.Stat()
-	// if err != nil {
-	// 	return fmt.Errorf("error getting file stats: %w", err)
-	// }
+	return resp.Body, nil
+}
+
+// List returns every object in the bucket whose key starts with prefix
+func (s *S3Store) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.StringValue(item.Key),
+				Size:         aws.Int64Value(item.Size),
+				LastModified: aws.TimeValue(item.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects in S3 bucket: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
 
-	// Create an uploader with the session and custom options
-	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
-		u.PartSize = 5 * 1024 * 1024 // 5MB part size
-		u.Concurrency = 5            // 5 concurrent uploads
+// ListPrefixes returns the common prefixes one level below prefix
+func (s *S3Store) ListPrefixes(prefix string) ([]string, error) {
+	var prefixes []string
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(item.Prefix))
+		}
+		return true
 	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing prefixes in S3 bucket: %w", err)
+	}
+
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
 
-	// Set content type based on file extension
-	contentType := "application/octet-stream"
-	ext := filepath.Ext(filePath)
-	if ext == ".json" {
-		contentType = "application/json"
-	} else if ext == ".gz" {
-		contentType = "application/gzip"
-	}
-
-	// Upload the file to S3
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket:        aws.String(bucket),
-		Key:           aws.String(s3Path),
-		Body:          file,
-		// ContentLength: aws.Int64(fileInfo.Size()),
-		ContentType:   aws.String(contentType),
+// Delete removes the object stored under key and waits until it is gone
+func (s *S3Store) Delete(key string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
 	})
 	if err != nil {
-		return fmt.Errorf("error uploading file to S3: %w", err)
+		return fmt.Errorf("error deleting object from S3: %w", err)
+	}
+
+	// Wait until the deletion is complete
+	err = s.client.WaitUntilObjectNotExists(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("error waiting for object deletion: %w", err)
 	}
 
 	return nil
 }
 
-// DownloadFromS3 downloads a file from an S3 bucket
-func DownloadFromS3(s3Path, localPath, bucket, region, accessKey, secretKey string) error {
-	// Create AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
+// Head returns the metadata of the object stored under key
+func (s *S3Store) Head(key string) (*ObjectInfo, error) {
+	resp, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
 	})
 	if err != nil {
-		return fmt.Errorf("error creating AWS session: %w", err)
+		if isS3NotFound(err) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		return nil, fmt.Errorf("error reading object metadata from S3: %w", err)
+	}
+
+	return &ObjectInfo{
+		Key:             key,
+		Size:            aws.Int64Value(resp.ContentLength),
+		LastModified:    aws.TimeValue(resp.LastModified),
+		ContentType:     aws.StringValue(resp.ContentType),
+		ContentEncoding: aws.StringValue(resp.ContentEncoding),
+	}, nil
+}
+
+// isS3NotFound reports whether err means the requested object does not exist
+func isS3NotFound(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	switch aerr.Code() {
+	case s3.ErrCodeNoSuchKey, "NotFound":
+		return true
+	}
+	return false
+}
+
+// UploadToS3 uploads a file to an S3 bucket. It creates a new store for
+// every call; long running code should create an S3Store once instead.
+func UploadToS3(filePath, s3Path string, opts S3Options) error {
+	store, err := NewS3Store(opts)
+	if err != nil {
+		return err
+	}
+
+	// Open the file for reading
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	return store.Put(s3Path, file, PutOptions{ContentType: ContentTypeFor(filePath)})
+}
+
+// DownloadFromS3 downloads a file from an S3 bucket
+func DownloadFromS3(s3Path, localPath string, opts S3Options) error {
+	store, err := NewS3Store(opts)
+	if err != nil {
+		return err
 	}
 
-	// Create a downloader
-	downloader := s3manager.NewDownloader(sess)
+	body, err := store.Get(s3Path)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
 
 	// Create a file to write the downloaded content
 	file, err := os.Create(localPath)
@@ -87,11 +414,7 @@ func DownloadFromS3(s3Path, localPath, bucket, region, accessKey, secretKey stri
 	}
 	defer file.Close()
 
-	// Download the file from S3
-	_, err = downloader.Download(file, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(s3Path),
-	})
+	_, err = io.Copy(file, body)
 	if err != nil {
 		return fmt.Errorf("error downloading file from S3: %w", err)
 	}
@@ -100,68 +423,32 @@ func DownloadFromS3(s3Path, localPath, bucket, region, accessKey, secretKey stri
 }
 
 // ListFilesInBucket lists files in an S3 bucket with a specified prefix
-func ListFilesInBucket(bucket, prefix, region, accessKey, secretKey string) ([]string, error) {
-	// Create AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
-	})
+func ListFilesInBucket(prefix string, opts S3Options) ([]string, error) {
+	store, err := NewS3Store(opts)
 	if err != nil {
-		return nil, fmt.Errorf("error creating AWS session: %w", err)
+		return nil, err
 	}
 
-	// Create S3 service client
-	svc := s3.New(sess)
-
-	// List objects in the bucket
-	resp, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(prefix),
-	})
+	objects, err := store.List(prefix)
 	if err != nil {
-		return nil, fmt.Errorf("error listing objects in S3 bucket: %w", err)
+		return nil, err
 	}
 
 	// Extract the keys from the response
 	var keys []string
-	for _, item := range resp.Contents {
-		keys = append(keys, *item.Key)
+	for _, object := range objects {
+		keys = append(keys, object.Key)
 	}
 
 	return keys, nil
 }
 
 // DeleteFileFromS3 deletes a file from an S3 bucket
-func DeleteFileFromS3(s3Path, bucket, region, accessKey, secretKey string) error {
-	// Create AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
-	})
+func DeleteFileFromS3(s3Path string, opts S3Options) error {
+	store, err := NewS3Store(opts)
 	if err != nil {
-		return fmt.Errorf("error creating AWS session: %w", err)
-	}
-
-	// Create S3 service client
-	svc := s3.New(sess)
-
-	// Delete the object
-	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(s3Path),
-	})
-	if err != nil {
-		return fmt.Errorf("error deleting object from S3: %w", err)
+		return err
 	}
 
-	// Wait until the deletion is complete
-	err = svc.WaitUntilObjectNotExists(&s3.HeadObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(s3Path),
-	})
-	if err != nil {
-		return fmt.Errorf("error waiting for object deletion: %w", err)
-	}
-
-	return nil
-}
\ No newline at end of file
+	return store.Delete(s3Path)
+}
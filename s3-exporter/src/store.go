@@ -0,0 +1,77 @@
+package src
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by an ObjectStore when the requested key does not exist
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes an object held in an ObjectStore
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ContentType  string
+	// ContentEncoding is empty for backends that do not keep it
+	ContentEncoding string
+}
+
+// PutOptions holds optional metadata stored alongside an object
+type PutOptions struct {
+	ContentType     string
+	ContentEncoding string // HTTP content coding, such as gzip
+}
+
+// ObjectStore is the storage backend that exported batches are written to.
+// Keys are always slash separated, regardless of the backend.
+type ObjectStore interface {
+	// Put stores the contents of body under key, replacing any existing object
+	Put(key string, body io.Reader, opts PutOptions) error
+	// Get opens the object stored under key. The caller must close the reader.
+	Get(key string) (io.ReadCloser, error)
+	// List returns all objects whose key starts with prefix, sorted by key
+	List(prefix string) ([]ObjectInfo, error)
+	// ListPrefixes returns the distinct key prefixes one level below
+	// prefix, each ending in a slash, sorted. It lists "segment/" for the
+	// key "segment/batch-0.json" and an empty prefix, like the common
+	// prefixes of an S3 listing with a "/" delimiter.
+	ListPrefixes(prefix string) ([]string, error)
+	// Delete removes the object stored under key
+	Delete(key string) error
+	// Head returns the metadata of the object stored under key
+	Head(key string) (*ObjectInfo, error)
+}
+
+// commonPrefix returns the prefix of key one level below prefix, ending in
+// a slash, or false if key is not below such a prefix
+func commonPrefix(key, prefix string) (string, bool) {
+	if !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	end := strings.Index(key[len(prefix):], "/")
+	if end < 0 {
+		return "", false
+	}
+	return key[:len(prefix)+end+1], true
+}
+
+// ContentTypeFor returns the content type to use for a file based on its extension
+func ContentTypeFor(filePath string) string {
+	switch filepath.Ext(filePath) {
+	case ".json":
+		return "application/json"
+	case ".csv":
+		return "text/csv"
+	case ".parquet":
+		return "application/vnd.apache.parquet"
+	}
+	if codec := CodecFor(filePath); codec != nil {
+		return codec.ContentType()
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,436 @@
+package tests
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+
+	"s3-exporter/exporter"
+	"s3-exporter/src"
+)
+
+// autoRollupContent spans two hours of one day and one hour of the next
+const autoRollupContent = "# timestamp:time,host,value:float\n" +
+	"2024-01-01T10:00:10Z,a,1\n" +
+	"2024-01-01T10:30:00Z,a,3\n" +
+	"2024-01-01T11:15:00Z,a,2\n" +
+	"2024-01-01T11:20:00Z,b,10\n" +
+	"2024-01-02T11:30:00Z,a,7\n"
+
+// readGzipObject returns the decompressed content of an object
+func readGzipObject(t *testing.T, store src.ObjectStore, key string) string {
+	body, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get %s failed: %v", key, err)
+	}
+	defer body.Close()
+
+	reader, err := gzip.NewReader(body)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", key, err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to decompress %s: %v", key, err)
+	}
+	return string(data)
+}
+
+// readRollupMarker returns the decoded rollup marker of a segment
+func readRollupMarker(t *testing.T, store src.ObjectStore, prefix string) map[string]interface{} {
+	body, err := store.Get(prefix + "/" + exporter.AutoRollupMarkerName)
+	if err != nil {
+		t.Fatalf("Expected segment %s to be marked: %v", prefix, err)
+	}
+	defer body.Close()
+
+	marker := make(map[string]interface{})
+	err = json.NewDecoder(body).Decode(&marker)
+	if err != nil {
+		t.Fatalf("Failed to parse the marker of %s: %v", prefix, err)
+	}
+	return marker
+}
+
+// TestAutoRollup tests rolling up closed windows into tiers and expiring
+// segments and windows
+func TestAutoRollup(t *testing.T) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+	err := os.WriteFile(sfmFile, []byte(autoRollupContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	config := &exporter.Config{}
+	config.Export.Compression = true
+	config.Export.BatchSize = 2
+	config.Rollup.Timestamp = "timestamp"
+	config.Rollup.Values = []string{"value"}
+	config.Rollup.Tags = []string{"host"}
+	config.AutoRollup.Grace = exporter.Duration(10 * time.Minute)
+	config.AutoRollup.Tiers = []exporter.TierConfig{
+		{Interval: "1h", Prefix: "rollups/1h"},
+		{Interval: "1d", Prefix: "rollups/1d"},
+	}
+
+	store := src.NewMemoryStore()
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+
+	// The last hour is still open: its grace period ends at 12:10
+	now, _ := time.Parse(time.RFC3339, "2024-01-02T12:05:00Z")
+	report, err := exporter.AutoRollup(store, config, now)
+	if err != nil {
+		t.Fatalf("AutoRollup failed: %v", err)
+	}
+	if report.SegmentsRead != 1 || report.Windows["1h"] != 2 || report.Windows["1d"] != 1 {
+		t.Errorf("Unexpected first run %+v", report)
+	}
+	if marker := readRollupMarker(t, store, "segment"); marker["pending"] != true {
+		t.Errorf("Expected the segment to be marked pending while one of its windows is open, got %v", marker)
+	}
+
+	// The daily window is rolled up from the hourly ones, sketches included
+	expected := []string{
+		`{"timestamp":"2024-01-01T00:00:00Z","host":"a","value_count":3,"value_sum":6,"value_min":1,"value_max":3,"value_avg":2,"value_first":1,"value_last":2,`,
+		`{"timestamp":"2024-01-01T00:00:00Z","host":"b","value_count":1,"value_sum":10,"value_min":10,"value_max":10,"value_avg":10,"value_first":10,"value_last":10,`,
+	}
+	lines := strings.Split(strings.TrimSuffix(readGzipObject(t, store, "rollups/1d/20240101T000000Z.json.gz"), "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d daily rows, got %v", len(expected), lines)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, expected[i]) {
+			t.Errorf("Expected a row starting with\n%s\ngot\n%s", expected[i], line)
+		}
+	}
+	var row struct {
+		P50    float64 `json:"value_p50"`
+		Sketch string  `json:"value_sketch"`
+	}
+	err = json.Unmarshal([]byte(lines[0]), &row)
+	if err != nil || math.Abs(row.P50-2) > 0.02 || row.Sketch == "" {
+		t.Errorf("Expected a daily median of 2 and a sketch, got %+v: %v", row, err)
+	}
+
+	// Once the last hour closes only it is written, and the segment is marked
+	now = now.Add(30 * time.Minute)
+	report, err = exporter.AutoRollup(store, config, now)
+	if err != nil {
+		t.Fatalf("AutoRollup failed: %v", err)
+	}
+	if report.SegmentsRead != 1 || report.Windows["1h"] != 1 || report.Windows["1d"] != 0 {
+		t.Errorf("Unexpected second run %+v", report)
+	}
+	if marker := readRollupMarker(t, store, "segment"); marker["pending"] != nil {
+		t.Errorf("Expected the segment to be marked complete, got %v", marker)
+	}
+
+	// Past their retention, the segment and the hourly windows are deleted
+	config.AutoRollup.RawRetention = exporter.Duration(time.Hour)
+	config.AutoRollup.Tiers[0].Retention = exporter.Duration(48 * time.Hour)
+	report, err = exporter.AutoRollup(store, config, time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("AutoRollup failed: %v", err)
+	}
+	if report.SegmentsRead != 0 || report.SegmentsDeleted != 1 || report.Windows["1d"] != 1 || report.WindowsDeleted["1h"] != 3 {
+		t.Errorf("Unexpected third run %+v", report)
+	}
+
+	objects, _ := store.List("")
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	if len(keys) != 2 || keys[0] != "rollups/1d/20240101T000000Z.json.gz" || keys[1] != "rollups/1d/20240102T000000Z.json.gz" {
+		t.Errorf("Expected only the daily windows to be left, got %v", keys)
+	}
+}
+
+// TestRollupTiers tests the validation of the tier settings
+func TestRollupTiers(t *testing.T) {
+	config := &exporter.Config{}
+	config.AutoRollup.Grace = exporter.Duration(10 * time.Minute)
+
+	config.AutoRollup.Tiers = []exporter.TierConfig{{Interval: "1h", Prefix: "hourly"}, {Interval: "90m", Prefix: "other"}}
+	if _, err := config.RollupTiers(); err == nil {
+		t.Errorf("Expected an error for an interval that is not a multiple of the previous one")
+	}
+
+	config.AutoRollup.Tiers = []exporter.TierConfig{{Interval: "1h", Prefix: "rollups"}, {Interval: "1d", Prefix: "rollups/1d"}}
+	if _, err := config.RollupTiers(); err == nil {
+		t.Errorf("Expected an error for overlapping prefixes")
+	}
+
+	config.AutoRollup.Tiers = []exporter.TierConfig{{Interval: "1h", Prefix: "hourly", Retention: exporter.Duration(24 * time.Hour)}, {Interval: "1d", Prefix: "daily"}}
+	if _, err := config.RollupTiers(); err == nil {
+		t.Errorf("Expected an error for hourly windows deleted before the daily tier closes")
+	}
+
+	config.AutoRollup.Tiers[0].Retention = exporter.Duration(25 * time.Hour)
+	tiers, err := config.RollupTiers()
+	if err != nil || len(tiers) != 2 || tiers[1].Interval.Duration != 24*time.Hour {
+		t.Errorf("Unexpected tiers %+v: %v", tiers, err)
+	}
+}
+
+// TestAutoRollupDurations tests that retention can be given in days and weeks
+func TestAutoRollupDurations(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := "autorollup:\n" +
+		"  grace: 10m\n" +
+		"  raw_retention: 30d\n" +
+		"  tiers:\n" +
+		"    - interval: 1h\n" +
+		"      prefix: rollups/1h\n" +
+		"      retention: 2w\n"
+	err := os.WriteFile(configPath, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test config file: %v", err)
+	}
+
+	config, err := exporter.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if time.Duration(config.AutoRollup.Grace) != 10*time.Minute {
+		t.Errorf("Expected a grace of 10m, got %v", time.Duration(config.AutoRollup.Grace))
+	}
+	if time.Duration(config.AutoRollup.RawRetention) != 30*24*time.Hour {
+		t.Errorf("Expected a raw retention of 30 days, got %v", time.Duration(config.AutoRollup.RawRetention))
+	}
+	if time.Duration(config.AutoRollup.Tiers[0].Retention) != 14*24*time.Hour {
+		t.Errorf("Expected a tier retention of 2 weeks, got %v", time.Duration(config.AutoRollup.Tiers[0].Retention))
+	}
+
+	err = os.WriteFile(configPath, []byte("autorollup:\n  raw_retention: 1.5d\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test config file: %v", err)
+	}
+	if _, err := exporter.LoadConfig(configPath); err == nil {
+		t.Errorf("Expected an error for a fractional number of days")
+	}
+}
+
+// TestAutoRollupFormats tests rolling up segments exported as Parquet and
+// CSV under renamed columns, into windows written in the same format
+func TestAutoRollupFormats(t *testing.T) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+	err := os.WriteFile(sfmFile, []byte(autoRollupContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	for _, format := range []string{"parquet", "csv"} {
+		config := &exporter.Config{}
+		config.Export.Format = format
+		config.Export.Compression = true
+		config.Export.BatchSize = 2
+		config.Columns.Rename = map[string]string{"host": "server", "value": "reading"}
+		config.Rollup.Timestamp = "timestamp"
+		config.Rollup.Values = []string{"value"}
+		config.Rollup.Tags = []string{"host"}
+		config.AutoRollup.Tiers = []exporter.TierConfig{
+			{Interval: "1h", Prefix: "rollups/1h"},
+			{Interval: "1d", Prefix: "rollups/1d"},
+		}
+
+		store := src.NewMemoryStore()
+		err = exporter.ConvertAndUpload(sfmFile, config, store)
+		if err != nil {
+			t.Fatalf("%s: ConvertAndUpload failed: %v", format, err)
+		}
+
+		now, _ := time.Parse(time.RFC3339, "2024-01-03T01:00:00Z")
+		report, err := exporter.AutoRollup(store, config, now)
+		if err != nil {
+			t.Fatalf("%s: AutoRollup failed: %v", format, err)
+		}
+		if report.SegmentsRead != 1 || report.Windows["1h"] != 3 || report.Windows["1d"] != 2 {
+			t.Errorf("%s: Unexpected run %+v", format, report)
+		}
+		if _, err := store.Head("segment/" + exporter.AutoRollupMarkerName); err != nil {
+			t.Errorf("%s: Expected the segment to be marked: %v", format, err)
+		}
+
+		objects, _ := store.List("rollups/1d/")
+		if len(objects) != 2 || !strings.HasPrefix(objects[0].Key, "rollups/1d/20240101T000000Z."+format) {
+			t.Fatalf("%s: Expected two daily windows in the output format, got %+v", format, objects)
+		}
+		if format != "parquet" {
+			continue
+		}
+
+		// The daily sums are rolled up from the hourly Parquet windows
+		body, err := store.Get(objects[0].Key)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		parquetReader, err := reader.NewParquetColumnReader(buffer.NewBufferFileFromBytes(data), 1)
+		if err != nil {
+			t.Fatalf("Failed to open parquet window: %v", err)
+		}
+		index := -1
+		for j, info := range parquetReader.SchemaHandler.Infos[1:] {
+			if info.ExName == "value_sum" {
+				index = j
+			}
+		}
+		if index < 0 {
+			t.Fatalf("Expected a value_sum column in the daily window")
+		}
+		sums, _, _, err := parquetReader.ReadColumnByIndex(int64(index), 2)
+		if err != nil || len(sums) != 2 || sums[0] != 6.0 || sums[1] != 10.0 {
+			t.Errorf("Expected daily sums of 6 and 10, got %v: %v", sums, err)
+		}
+	}
+}
+
+// TestAutoRollupLateRecords tests that records exported after their window
+// was written are reported and keep their segment from being deleted
+func TestAutoRollupLateRecords(t *testing.T) {
+	tempDir := t.TempDir()
+	earlyFile := filepath.Join(tempDir, "early.sfm")
+	err := os.WriteFile(earlyFile, []byte(autoRollupContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+	lateFile := filepath.Join(tempDir, "late.sfm")
+	lateContent := "# timestamp:time,host,value:float\n" +
+		"2024-01-01T10:45:00Z,c,5\n" +
+		"2024-01-03T00:30:00Z,c,4\n"
+	err = os.WriteFile(lateFile, []byte(lateContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	config := &exporter.Config{}
+	config.Rollup.Timestamp = "timestamp"
+	config.Rollup.Values = []string{"value"}
+	config.Rollup.Tags = []string{"host"}
+	config.AutoRollup.Grace = exporter.Duration(10 * time.Minute)
+	config.AutoRollup.Tiers = []exporter.TierConfig{
+		{Interval: "1h", Prefix: "rollups/1h"},
+		{Interval: "1d", Prefix: "rollups/1d"},
+	}
+
+	store := src.NewMemoryStore()
+	err = exporter.ConvertAndUpload(earlyFile, config, store)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+	now, _ := time.Parse(time.RFC3339, "2024-01-03T00:15:00Z")
+	_, err = exporter.AutoRollup(store, config, now)
+	if err != nil {
+		t.Fatalf("AutoRollup failed: %v", err)
+	}
+
+	// The first record of the late segment falls in a window that is
+	// already written, the second in a new one
+	err = exporter.ConvertAndUpload(lateFile, config, store)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+	config.AutoRollup.RawRetention = exporter.Duration(time.Hour)
+	report, err := exporter.AutoRollup(store, config, time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("AutoRollup failed: %v", err)
+	}
+	if len(report.LateSegments) != 1 || report.LateSegments[0] != "late" || report.LateRecords != 1 {
+		t.Errorf("Expected 1 late record in segment late, got %+v", report)
+	}
+	if report.Windows["1h"] != 1 || report.Windows["1d"] != 1 || report.SegmentsDeleted != 1 {
+		t.Errorf("Expected the new windows to be written and only the early segment deleted, got %+v", report)
+	}
+	if marker := readRollupMarker(t, store, "late"); marker["late_records"] != 1.0 {
+		t.Errorf("Expected the late record to be counted in the marker, got %v", marker)
+	}
+
+	// The late segment is kept and not read again
+	report, err = exporter.AutoRollup(store, config, time.Now().Add(3*time.Hour))
+	if err != nil {
+		t.Fatalf("AutoRollup failed: %v", err)
+	}
+	if report.SegmentsRead != 0 || report.SegmentsDeleted != 0 || len(report.LateSegments) != 0 {
+		t.Errorf("Unexpected third run %+v", report)
+	}
+	if _, err := exporter.ReadManifest(store, "late"); err != nil {
+		t.Errorf("Expected the late segment to be kept: %v", err)
+	}
+}
+
+// TestAutoRollupSegmentOrder tests that segments are rolled up in time
+// order, so that counter samples of a segment named after a later one are
+// not left out as out of order
+func TestAutoRollupSegmentOrder(t *testing.T) {
+	tempDir := t.TempDir()
+	contents := map[string]string{
+		"b.sfm": "# timestamp:time,host,requests:int\n" +
+			"2024-01-01T10:00:00Z,a,0\n" +
+			"2024-01-01T10:15:00Z,a,10\n",
+		"a.sfm": "# timestamp:time,host,requests:int\n" +
+			"2024-01-01T10:30:00Z,a,20\n" +
+			"2024-01-01T10:45:00Z,a,30\n",
+	}
+
+	config := &exporter.Config{}
+	config.Export.Compression = true
+	config.Rollup.Timestamp = "timestamp"
+	config.Rollup.Values = []string{"requests"}
+	config.Rollup.Tags = []string{"host"}
+	config.Rollup.Kinds = map[string]string{"requests": "counter"}
+	config.AutoRollup.Tiers = []exporter.TierConfig{
+		{Interval: "1h", Prefix: "rollups/1h"},
+	}
+
+	store := src.NewMemoryStore()
+	for name, content := range contents {
+		sfmFile := filepath.Join(tempDir, name)
+		err := os.WriteFile(sfmFile, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("Failed to create test SFM file: %v", err)
+		}
+		err = exporter.ConvertAndUpload(sfmFile, config, store)
+		if err != nil {
+			t.Fatalf("ConvertAndUpload failed: %v", err)
+		}
+	}
+
+	now, _ := time.Parse(time.RFC3339, "2024-01-01T12:00:00Z")
+	report, err := exporter.AutoRollup(store, config, now)
+	if err != nil {
+		t.Fatalf("AutoRollup failed: %v", err)
+	}
+	if report.SegmentsRead != 2 || report.Windows["1h"] != 1 {
+		t.Fatalf("Unexpected run %+v", report)
+	}
+
+	// 30 over 45 minutes, extrapolated to the end of the hour
+	var row struct {
+		Count    int64   `json:"requests_count"`
+		Increase float64 `json:"requests_increase"`
+		Resets   int64   `json:"requests_resets"`
+	}
+	err = json.Unmarshal([]byte(readGzipObject(t, store, "rollups/1h/20240101T100000Z.json.gz")), &row)
+	if err != nil {
+		t.Fatalf("Failed to parse the hourly row: %v", err)
+	}
+	if row.Count != 4 || math.Abs(row.Increase-40) > 1e-9 || row.Resets != 0 {
+		t.Errorf("Expected 4 samples increasing by 40 without resets, got %+v", row)
+	}
+}
@@ -0,0 +1,328 @@
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"s3-exporter/exporter"
+	"s3-exporter/src"
+)
+
+// exportBatches exports rows generated records with config and returns the
+// manifest and the decompressed content of every batch
+func exportBatches(t *testing.T, rows int, config *exporter.Config) (*exporter.Manifest, []string) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+
+	var content strings.Builder
+	content.WriteString("# id,name,value\n")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&content, "%d,item%d,%d\n", i, i*7919%1000, i*i)
+	}
+	err := os.WriteFile(sfmFile, []byte(content.String()), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+	config.Export.TempDir = filepath.Join(tempDir, "temp")
+
+	store := src.NewMemoryStore()
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+
+	manifest, err := exporter.ReadManifest(store, "segment")
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+
+	var batches []string
+	for _, batch := range manifest.Batches {
+		body, err := store.Get(batch.Key)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		if int64(len(data)) != batch.Size {
+			t.Errorf("Expected %s to be %d bytes, got %d", batch.Key, batch.Size, len(data))
+		}
+
+		if batch.Compression == "gzip" {
+			reader, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Failed to open %s: %v", batch.Key, err)
+			}
+			data, err = io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("Failed to decompress %s: %v", batch.Key, err)
+			}
+		}
+		batches = append(batches, string(data))
+	}
+
+	// The batches hold every record, in order
+	var expected strings.Builder
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&expected, `{"id":"%d","name":"item%d","value":"%d"}`+"\n", i, i*7919%1000, i*i)
+	}
+	if strings.Join(batches, "") != expected.String() {
+		t.Errorf("Batches do not hold the records in order")
+	}
+	if manifest.TotalRecords != rows {
+		t.Errorf("Expected %d records, got %d", rows, manifest.TotalRecords)
+	}
+
+	return manifest, batches
+}
+
+// TestBatchRotationByBytes tests closing batches at an encoded size
+func TestBatchRotationByBytes(t *testing.T) {
+	for _, mode := range []string{"stream", "tempfile"} {
+		config := &exporter.Config{}
+		config.Export.Mode = mode
+		config.Export.BatchBytes = 1000
+
+		manifest, batches := exportBatches(t, 300, config)
+		if len(batches) < 2 {
+			t.Fatalf("%s: Expected several batches, got %d", mode, len(batches))
+		}
+
+		for i, batch := range batches {
+			// Every batch but the last reaches the limit with its last record
+			lines := strings.SplitAfter(batch, "\n")
+			lastRecord := len(lines[len(lines)-2])
+			if i < len(batches)-1 && (len(batch) < 1000 || len(batch)-lastRecord >= 1000) {
+				t.Errorf("%s: Batch %d is %d bytes, expected to end at the first record past 1000 bytes", mode, i, len(batch))
+			}
+			if manifest.Batches[i].Records != strings.Count(batch, "\n") {
+				t.Errorf("%s: Batch %d has the wrong record count %d", mode, i, manifest.Batches[i].Records)
+			}
+		}
+	}
+}
+
+// TestBatchRotationByCompressedBytes tests closing batches at a stored size
+func TestBatchRotationByCompressedBytes(t *testing.T) {
+	config := &exporter.Config{}
+	config.Export.Compression = true
+	config.Export.GzipBlockSizeKB = 64
+	config.Export.GzipConcurrency = 1
+	config.Export.BatchCompressedBytes = 16 * 1024
+
+	manifest, batches := exportBatches(t, 20000, config)
+	if len(batches) < 2 {
+		t.Fatalf("Expected several batches, got %d", len(batches))
+	}
+	for i, batch := range manifest.Batches[:len(manifest.Batches)-1] {
+		if batch.Size < 16*1024 || batch.Compression != "gzip" {
+			t.Errorf("Batch %d is %d bytes compressed with %s, expected at least %d gzipped bytes", i, batch.Size, batch.Compression, 16*1024)
+		}
+	}
+}
+
+// TestBatchRotationWhicheverFirst tests that the first limit reached closes a batch
+func TestBatchRotationWhicheverFirst(t *testing.T) {
+	config := &exporter.Config{}
+	config.Export.BatchSize = 10
+	config.Export.BatchBytes = 1000
+
+	manifest, _ := exportBatches(t, 100, config)
+	for i, batch := range manifest.Batches {
+		if batch.Records != 10 {
+			t.Errorf("Expected batch %d to be closed at 10 records, got %d", i, batch.Records)
+		}
+	}
+
+	config = &exporter.Config{}
+	config.Export.BatchSize = 1000
+	config.Export.BatchBytes = 1000
+
+	manifest, _ = exportBatches(t, 100, config)
+	if len(manifest.Batches) < 2 || manifest.Batches[0].Records >= 100 {
+		t.Errorf("Expected the byte limit to close batches first, got %+v", manifest.Batches)
+	}
+}
+
+// bodyRecordingStore records whether the bodies it receives can be rewound,
+// which a batch buffered whole before its upload can be
+type bodyRecordingStore struct {
+	*src.MemoryStore
+	mu       sync.Mutex
+	seekable map[string]bool
+	fail     error
+}
+
+func (s *bodyRecordingStore) Put(key string, body io.Reader, opts src.PutOptions) error {
+	_, seekable := body.(io.Seeker)
+	s.mu.Lock()
+	s.seekable[key] = seekable
+	s.mu.Unlock()
+	if s.fail != nil {
+		return s.fail
+	}
+	return s.MemoryStore.Put(key, body, opts)
+}
+
+// TestStreamModeUploadsWhileWriting tests that stream mode pipes batches
+// into their uploads instead of buffering them, and that a failed upload
+// stops the export
+func TestStreamModeUploadsWhileWriting(t *testing.T) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+
+	var content strings.Builder
+	content.WriteString("# id,name,value\n")
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&content, "%d,item%d,%d\n", i, i, i*100)
+	}
+	err := os.WriteFile(sfmFile, []byte(content.String()), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	config := &exporter.Config{}
+	config.Export.Compression = true
+	config.Export.Mode = "stream"
+
+	store := &bodyRecordingStore{MemoryStore: src.NewMemoryStore(), seekable: make(map[string]bool)}
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+	seekable, ok := store.seekable["segment/batch-0.json.gz"]
+	if !ok || seekable {
+		t.Errorf("Expected the batch to be streamed into its upload, got a buffered body")
+	}
+	manifest, err := exporter.ReadManifest(store, "segment")
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+	if manifest.TotalRecords != 5000 {
+		t.Errorf("Expected 5000 records, got %d", manifest.TotalRecords)
+	}
+
+	// An upload that stops reading must not leave the writer blocked
+	failing := &bodyRecordingStore{MemoryStore: src.NewMemoryStore(), seekable: make(map[string]bool), fail: errors.New("upload refused")}
+	err = exporter.ConvertAndUpload(sfmFile, config, failing)
+	if err == nil || !strings.Contains(err.Error(), "upload refused") {
+		t.Errorf("Expected the export to fail with the upload error, got %v", err)
+	}
+}
+
+// TestStreamModeRetriesFailedUpload tests that a streamed batch whose upload
+// to S3 fails once is sent again
+func TestStreamModeRetriesFailedUpload(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret-key")
+	fake := newFakeS3(t)
+	fake.failPuts = 1
+
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+	var content strings.Builder
+	content.WriteString("# id,name,value\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&content, "%d,item%d,%d\n", i, i, i*100)
+	}
+	err := os.WriteFile(sfmFile, []byte(content.String()), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	config := &exporter.Config{}
+	config.S3.Bucket = "test-bucket"
+	config.S3.Endpoint = fake.URL
+	config.S3.ForcePathStyle = true
+	config.Export.Compression = true
+	config.Export.Mode = "stream"
+
+	store, err := exporter.NewObjectStore(config)
+	if err != nil {
+		t.Fatalf("NewObjectStore failed: %v", err)
+	}
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		t.Fatalf("Expected the failed upload to be retried, got %v", err)
+	}
+
+	manifest, err := exporter.ReadManifest(store, "segment")
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+	if manifest.TotalRecords != 100 {
+		t.Errorf("Expected 100 records, got %d", manifest.TotalRecords)
+	}
+	if fake.failPuts != 0 {
+		t.Errorf("Expected an upload to be refused")
+	}
+}
+
+// overlapStore holds the upload of the first batch open until the upload of
+// the second one has started
+type overlapStore struct {
+	*src.MemoryStore
+	started chan struct{}
+	once    sync.Once
+}
+
+func (s *overlapStore) Put(key string, body io.Reader, opts src.PutOptions) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	switch key {
+	case "segment/batch-0.json":
+		select {
+		case <-s.started:
+		case <-time.After(5 * time.Second):
+			return errors.New("batch 1 was not written while batch 0 uploaded")
+		}
+	case "segment/batch-1.json":
+		s.once.Do(func() { close(s.started) })
+	}
+	return s.MemoryStore.Put(key, bytes.NewReader(data), opts)
+}
+
+// TestStreamModeOverlapsUploads tests that the next batch is written while
+// the upload of a streamed batch completes
+func TestStreamModeOverlapsUploads(t *testing.T) {
+	config := &exporter.Config{}
+	config.Export.BatchSize = 10
+	config.Export.Mode = "stream"
+
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+	var content strings.Builder
+	content.WriteString("# id,name,value\n")
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&content, "%d,item%d,%d\n", i, i, i*100)
+	}
+	err := os.WriteFile(sfmFile, []byte(content.String()), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	store := &overlapStore{MemoryStore: src.NewMemoryStore(), started: make(chan struct{})}
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+
+	manifest, err := exporter.ReadManifest(store, "segment")
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+	if len(manifest.Batches) != 3 || manifest.TotalRecords != 30 {
+		t.Errorf("Expected 3 batches of 30 records, got %d batches of %d records", len(manifest.Batches), manifest.TotalRecords)
+	}
+}
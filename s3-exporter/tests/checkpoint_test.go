@@ -0,0 +1,171 @@
+package tests
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"s3-exporter/exporter"
+	"s3-exporter/src"
+)
+
+// failingStore fails uploads of one key and counts all uploads
+type failingStore struct {
+	*src.MemoryStore
+	failKey string
+	puts    map[string]int
+}
+
+func (s *failingStore) Put(key string, body io.Reader, opts src.PutOptions) error {
+	if key == s.failKey {
+		return errors.New("simulated upload failure")
+	}
+	s.puts[key]++
+	return s.MemoryStore.Put(key, body, opts)
+}
+
+// TestConvertAndUploadResumes tests that a failed export resumes after the
+// last uploaded batch
+func TestConvertAndUploadResumes(t *testing.T) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+
+	sfmContent := `# id,name,value
+jsonS3Exported:false
+1,item1,100
+2,item2,200
+3,item3,300
+4,item4,400
+5,item5,500
+`
+	err := os.WriteFile(sfmFile, []byte(sfmContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	config := &exporter.Config{}
+	config.Export.BatchSize = 2
+	config.Export.TempDir = filepath.Join(tempDir, "temp")
+	config.State.Dir = filepath.Join(tempDir, "state")
+
+	// The first run fails on the second batch
+	store := &failingStore{MemoryStore: src.NewMemoryStore(), failKey: "segment/batch-1.json", puts: map[string]int{}}
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err == nil {
+		t.Fatalf("Expected the first export to fail")
+	}
+
+	checkpoint, err := exporter.LoadCheckpoint(config.State.Dir, sfmFile)
+	if err != nil {
+		t.Fatalf("LoadCheckpoint failed: %v", err)
+	}
+	if checkpoint == nil || checkpoint.NextBatch != 1 {
+		t.Fatalf("Expected a checkpoint at batch 1, got %+v", checkpoint)
+	}
+
+	// The second run resumes at the second batch
+	store.failKey = ""
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+
+	if store.puts["segment/batch-0.json"] != 1 {
+		t.Errorf("Expected the first batch to be uploaded once, got %d", store.puts["segment/batch-0.json"])
+	}
+
+	manifest, err := exporter.ReadManifest(store, "segment")
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+	if len(manifest.Batches) != 3 || manifest.TotalRecords != 5 {
+		t.Errorf("Expected 3 batches with 5 records, got %+v", manifest)
+	}
+	if !manifest.RunTimestamp.Equal(checkpoint.RunTimestamp) {
+		t.Errorf("Expected the resumed run to keep timestamp %v, got %v", checkpoint.RunTimestamp, manifest.RunTimestamp)
+	}
+	for i, key := range []string{"segment/batch-0.json", "segment/batch-1.json", "segment/batch-2.json"} {
+		if manifest.Batches[i].Key != key {
+			t.Errorf("Expected batch %d to be %s, got %s", i, key, manifest.Batches[i].Key)
+		}
+	}
+
+	// The checkpoint is removed once the export is complete
+	checkpoint, err = exporter.LoadCheckpoint(config.State.Dir, sfmFile)
+	if err != nil {
+		t.Fatalf("LoadCheckpoint failed: %v", err)
+	}
+	if checkpoint != nil {
+		t.Errorf("Expected no checkpoint after a complete export, got %+v", checkpoint)
+	}
+}
+
+// TestConvertAndUploadResumeWithChangedSettings tests that an export
+// interrupted under different settings starts over
+func TestConvertAndUploadResumeWithChangedSettings(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(config *exporter.Config)
+		keys   []string
+		// records is the number of records in the first batch
+		records int
+	}{
+		{"batch size", func(config *exporter.Config) { config.Export.BatchSize = 3 }, []string{"segment/batch-0.json", "segment/batch-1.json"}, 3},
+		{"format", func(config *exporter.Config) { config.Export.Format = "parquet" }, []string{"segment/batch-0.parquet", "segment/batch-1.parquet", "segment/batch-2.parquet"}, 2},
+	}
+
+	for _, tc := range cases {
+		tempDir := t.TempDir()
+		sfmFile := filepath.Join(tempDir, "segment.sfm")
+		err := os.WriteFile(sfmFile, []byte("# id,name,value\n1,item1,100\n2,item2,200\n3,item3,300\n4,item4,400\n5,item5,500\n"), 0644)
+		if err != nil {
+			t.Fatalf("Failed to create test SFM file: %v", err)
+		}
+
+		config := &exporter.Config{}
+		config.Export.BatchSize = 2
+		config.Export.TempDir = filepath.Join(tempDir, "temp")
+		config.State.Dir = filepath.Join(tempDir, "state")
+
+		store := &failingStore{MemoryStore: src.NewMemoryStore(), failKey: "segment/batch-1.json", puts: map[string]int{}}
+		err = exporter.ConvertAndUpload(sfmFile, config, store)
+		if err == nil {
+			t.Fatalf("%s: Expected the first export to fail", tc.name)
+		}
+
+		// The second run starts over with the new settings
+		tc.change(config)
+		store.failKey = ""
+		err = exporter.ConvertAndUpload(sfmFile, config, store)
+		if err != nil {
+			t.Fatalf("%s: ConvertAndUpload failed: %v", tc.name, err)
+		}
+
+		manifest, err := exporter.ReadManifest(store, "segment")
+		if err != nil {
+			t.Fatalf("%s: ReadManifest failed: %v", tc.name, err)
+		}
+		if manifest.TotalRecords != 5 || len(manifest.Batches) != len(tc.keys) {
+			t.Fatalf("%s: Expected %d batches with 5 records, got %+v", tc.name, len(tc.keys), manifest)
+		}
+		for i, key := range tc.keys {
+			if manifest.Batches[i].Key != key {
+				t.Errorf("%s: Expected batch %d to be %s, got %s", tc.name, i, key, manifest.Batches[i].Key)
+			}
+		}
+		if manifest.Batches[0].Records != tc.records {
+			t.Errorf("%s: Expected %d records in the first batch, got %d", tc.name, tc.records, manifest.Batches[0].Records)
+		}
+
+		// Only the batches of the new run are left
+		objects, err := store.List("segment/")
+		if err != nil {
+			t.Fatalf("%s: List failed: %v", tc.name, err)
+		}
+		if len(objects) != len(tc.keys)+1 {
+			t.Errorf("%s: Expected only the new batches and the manifest, got %+v", tc.name, objects)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"s3-exporter/exporter"
+	"s3-exporter/src"
+)
+
+// TestCodecsRoundTrip tests that every codec decompresses what it compressed
+func TestCodecsRoundTrip(t *testing.T) {
+	content := strings.Repeat(`{"id":"1","name":"item","value":"100"}`+"\n", 500)
+
+	for _, name := range src.CodecNames {
+		codec, err := src.NewCodec(name, 0)
+		if err != nil {
+			t.Fatalf("NewCodec(%s) failed: %v", name, err)
+		}
+
+		testFile := filepath.Join(t.TempDir(), "batch.json")
+		err = os.WriteFile(testFile, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+
+		compressedFile, err := src.CompressFileWith(testFile, codec)
+		if err != nil {
+			t.Fatalf("%s: CompressFileWith failed: %v", name, err)
+		}
+		if compressedFile != testFile+codec.Extension() {
+			t.Fatalf("%s: Expected %s, got %s", name, testFile+codec.Extension(), compressedFile)
+		}
+
+		os.Remove(testFile)
+		decompressedFile, err := src.DecompressFile(compressedFile)
+		if err != nil {
+			t.Fatalf("%s: DecompressFile failed: %v", name, err)
+		}
+		data, err := os.ReadFile(decompressedFile)
+		if err != nil {
+			t.Fatalf("%s: Failed to read decompressed file: %v", name, err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: Decompressed content does not match", name)
+		}
+	}
+
+	_, err := src.NewCodec("gzip", 12)
+	if err == nil {
+		t.Errorf("Expected an error for an invalid gzip level")
+	}
+	_, err = src.NewCodec("brotli", 0)
+	if err == nil {
+		t.Errorf("Expected an error for an unknown codec")
+	}
+}
+
+// TestExportWithCodec tests the keys and metadata of batches compressed by
+// codecs with and without an HTTP content coding
+func TestExportWithCodec(t *testing.T) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+	sfmContent := "# id,value\n" + strings.Repeat("1,a\n", 200)
+	err := os.WriteFile(sfmFile, []byte(sfmContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	cases := []struct {
+		codec, mode, key, contentType, contentEncoding string
+	}{
+		{"zstd", "stream", "segment/batch-0.json.zst", "application/json", "zstd"},
+		{"lz4", "stream", "segment/batch-0.json.lz4", "application/x-lz4", ""},
+		{"zlib", "tempfile", "segment/batch-0.json.zz", "application/json", "deflate"},
+		{"snappy", "tempfile", "segment/batch-0.json.sz", "application/x-snappy-framed", ""},
+	}
+
+	for _, c := range cases {
+		config := &exporter.Config{}
+		config.Export.Compression = true
+		config.Export.Codec = c.codec
+		config.Export.Mode = c.mode
+		config.Export.TempDir = filepath.Join(tempDir, "temp")
+
+		store := src.NewMemoryStore()
+		err = exporter.ConvertAndUpload(sfmFile, config, store)
+		if err != nil {
+			t.Fatalf("%s: ConvertAndUpload failed: %v", c.codec, err)
+		}
+
+		manifest, err := exporter.ReadManifest(store, "segment")
+		if err != nil {
+			t.Fatalf("%s: ReadManifest failed: %v", c.codec, err)
+		}
+		batch := manifest.Batches[0]
+		if batch.Key != c.key || batch.Compression != c.codec {
+			t.Errorf("%s: Unexpected batch %+v", c.codec, batch)
+		}
+
+		info, err := store.Head(c.key)
+		if err != nil {
+			t.Fatalf("%s: Head failed: %v", c.codec, err)
+		}
+		if info.ContentType != c.contentType || info.ContentEncoding != c.contentEncoding {
+			t.Errorf("%s: Expected %s/%q, got %s/%q", c.codec, c.contentType, c.contentEncoding, info.ContentType, info.ContentEncoding)
+		}
+
+		codec, err := src.NewCodec(c.codec, 0)
+		if err != nil {
+			t.Fatalf("NewCodec failed: %v", err)
+		}
+		body, err := store.Get(c.key)
+		if err != nil {
+			t.Fatalf("%s: Get failed: %v", c.codec, err)
+		}
+		reader, err := codec.NewReader(body)
+		if err != nil {
+			t.Fatalf("%s: Failed to open batch: %v", c.codec, err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		body.Close()
+		if err != nil {
+			t.Fatalf("%s: Failed to decompress batch: %v", c.codec, err)
+		}
+		if string(data) != strings.Repeat(`{"id":"1","value":"a"}`+"\n", 200) {
+			t.Errorf("%s: Unexpected batch content %q", c.codec, data)
+		}
+	}
+}
+
+// TestParallelGzip tests that block-parallel gzip output is a single valid
+// gzip stream made of one member per block
+func TestParallelGzip(t *testing.T) {
+	var content strings.Builder
+	for i := 0; content.Len() < 1024*1024; i++ {
+		fmt.Fprintf(&content, `{"id":"%d","value":"%d"}`+"\n", i, i*i)
+	}
+
+	codec, err := src.NewParallelGzipCodec(src.ParallelGzipOptions{Concurrency: 4, BlockSize: 64 * 1024})
+	if err != nil {
+		t.Fatalf("NewParallelGzipCodec failed: %v", err)
+	}
+
+	var compressed bytes.Buffer
+	writer, err := codec.NewWriter(&compressed)
+	if err != nil {
+		t.Fatalf("NewWriter failed: %v", err)
+	}
+	// Write in uneven pieces so that blocks span several writes
+	data := []byte(content.String())
+	for len(data) > 0 {
+		n := 10000
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err = writer.Write(data[:n])
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		data = data[n:]
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Count the gzip members
+	input := bytes.NewReader(compressed.Bytes())
+	reader, err := gzip.NewReader(input)
+	if err != nil {
+		t.Fatalf("Failed to open gzip stream: %v", err)
+	}
+	var decompressed bytes.Buffer
+	members := 0
+	for {
+		reader.Multistream(false)
+		_, err = io.Copy(&decompressed, reader)
+		if err != nil {
+			t.Fatalf("Failed to decompress member %d: %v", members, err)
+		}
+		members++
+		err = reader.Reset(input)
+		if err == io.EOF {
+			break
+		}
+	}
+	if decompressed.String() != content.String() {
+		t.Errorf("Decompressed content does not match")
+	}
+	expected := (content.Len() + 64*1024 - 1) / (64 * 1024)
+	if members != expected {
+		t.Errorf("Expected %d gzip members, got %d", expected, members)
+	}
+
+	// An empty input is still a valid gzip stream
+	compressed.Reset()
+	writer, _ = codec.NewWriter(&compressed)
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	reader, err = gzip.NewReader(&compressed)
+	if err != nil {
+		t.Fatalf("Failed to open empty gzip stream: %v", err)
+	}
+	empty, err := io.ReadAll(reader)
+	if err != nil || len(empty) != 0 {
+		t.Errorf("Expected an empty stream, got %q (%v)", empty, err)
+	}
+
+	_, err = src.NewParallelGzipCodec(src.ParallelGzipOptions{BlockSize: 1024})
+	if err == nil {
+		t.Errorf("Expected an error for a tiny block size")
+	}
+}
+
+// TestCompressDirectory tests compressing a directory with parallel gzip
+func TestCompressDirectory(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat(`{"id":"1","name":"item","value":"100"}`+"\n", 50000)
+	for _, name := range []string{"a.json", "b.json"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	files, err := src.CompressDirectory(dir, src.ParallelGzipOptions{Concurrency: 2, BlockSize: 64 * 1024})
+	if err != nil {
+		t.Fatalf("CompressDirectory failed: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 compressed files, got %v", files)
+	}
+
+	for _, file := range files {
+		os.Remove(strings.TrimSuffix(file, ".gz"))
+		decompressedFile, err := src.DecompressFile(file)
+		if err != nil {
+			t.Fatalf("DecompressFile failed: %v", err)
+		}
+		data, err := os.ReadFile(decompressedFile)
+		if err != nil {
+			t.Fatalf("Failed to read decompressed file: %v", err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: Decompressed content does not match", file)
+		}
+	}
+}
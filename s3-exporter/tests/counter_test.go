@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"s3-exporter/rollup"
+	"s3-exporter/sfm"
+)
+
+// TestCounterRollups tests the increase, rate and resets of counter and
+// delta columns
+func TestCounterRollups(t *testing.T) {
+	minute, _ := rollup.ParseInterval("1m")
+	spec := rollup.Spec{
+		Timestamp: "timestamp",
+		Values:    []string{"requests", "bytes"},
+		Tags:      []string{"host"},
+		Intervals: []rollup.Interval{minute},
+		Kinds:     map[string]rollup.Kind{"requests": rollup.Counter, "bytes": rollup.Delta},
+	}
+	columns := []string{"timestamp", "host", "requests", "bytes"}
+	types := []sfm.Type{sfm.TypeTime, sfm.TypeString, sfm.TypeInt, sfm.TypeInt}
+
+	engine, err := rollup.NewEngine(spec, columns, types)
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+
+	// Host a scrapes every 15s from zero, host b resets after 110
+	start, _ := time.Parse(time.RFC3339, "2024-01-01T10:00:00Z")
+	samples := []struct {
+		offset   int
+		host     string
+		requests int64
+	}{
+		{0, "a", 0}, {15, "a", 10}, {30, "a", 20}, {45, "a", 30},
+		{0, "b", 100}, {15, "b", 110}, {30, "b", 5}, {45, "b", 15},
+		{20, "b", 50},
+	}
+	for _, sample := range samples {
+		at := start.Add(time.Duration(sample.offset) * time.Second)
+		engine.Add([]interface{}{at, sample.host, sample.requests, int64(6)})
+	}
+	if engine.OutOfOrder() != 1 {
+		t.Errorf("Expected 1 out-of-order sample, got %d", engine.OutOfOrder())
+	}
+
+	expectedColumns := "timestamp host requests_count requests_increase requests_rate requests_resets bytes_count bytes_increase bytes_rate"
+	if got := strings.Join(engine.Columns(), " "); got != expectedColumns {
+		t.Fatalf("Expected columns %s, got %s", expectedColumns, got)
+	}
+
+	// As Prometheus' increase(), 30 over 45s extrapolates to the end of the
+	// minute but not before the counter was zero; b is extrapolated to the
+	// whole minute
+	rows := engine.Rows(0)
+	expected := []struct {
+		increase float64
+		resets   int64
+	}{{40, 0}, {25 * 60 / 45.0, 1}}
+	for i, row := range rows {
+		increase, rate := row[3].(float64), row[4].(float64)
+		if math.Abs(increase-expected[i].increase) > 1e-9 || math.Abs(rate-increase/60) > 1e-9 || row[5] != expected[i].resets {
+			t.Errorf("Row %d: expected an increase of %v with %d resets, got %v", i, expected[i].increase, expected[i].resets, row)
+		}
+	}
+
+	// Deltas add up; the out-of-order sample still counts
+	if rows[1][6] != int64(5) || rows[1][7] != 30.0 || rows[1][8] != 0.5 {
+		t.Errorf("Unexpected delta aggregates %v", rows[1][6:])
+	}
+
+	// Merged into an hour, increases and resets add up
+	hour, _ := rollup.ParseInterval("1h")
+	spec.Intervals = []rollup.Interval{hour}
+	hourly, err := rollup.NewEngine(spec, columns, types)
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+	for _, row := range rows {
+		row[1] = "all"
+		err = hourly.AddRow(row)
+		if err != nil {
+			t.Fatalf("AddRow failed: %v", err)
+		}
+	}
+	row := hourly.Rows(0)[0]
+	increase := 40 + 25*60/45.0
+	if math.Abs(row[3].(float64)-increase) > 1e-9 || math.Abs(row[4].(float64)-increase/3600) > 1e-9 || row[5] != int64(1) || row[7] != 54.0 {
+		t.Errorf("Unexpected merged row %v", row)
+	}
+
+	// Kinds only apply to value columns
+	spec.Kinds = map[string]rollup.Kind{"host": rollup.Counter}
+	_, err = rollup.NewEngine(spec, columns, types)
+	if err == nil {
+		t.Errorf("Expected an error for a kind set on a tag column")
+	}
+}
@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"s3-exporter/exporter"
+	"s3-exporter/src"
+)
+
+// exportRaw exports sfmContent with config and returns the first batch as written
+func exportRaw(t *testing.T, sfmContent string, config *exporter.Config) (string, error) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+	err := os.WriteFile(sfmFile, []byte(sfmContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	store := src.NewMemoryStore()
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		return "", err
+	}
+
+	manifest, err := exporter.ReadManifest(store, "segment")
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+
+	body, err := store.Get(manifest.Batches[0].Key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("Failed to read batch: %v", err)
+	}
+	return string(data), nil
+}
+
+// TestRecordsKeepHeaderOrder tests that keys follow the header order and
+// that values are escaped like encoding/json does
+func TestRecordsKeepHeaderOrder(t *testing.T) {
+	content := "# zeta:int,alpha:float,mid\n" +
+		"1,0.0000001,\"a \"\"quoted\"\" <tag> é\"\n" +
+		"2,1e21,\"tab\there\"\n"
+
+	data, err := exportRaw(t, content, &exporter.Config{})
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+
+	expected := `{"zeta":1,"alpha":1e-7,"mid":"a \"quoted\" \u003ctag\u003e é"}` + "\n" +
+		`{"zeta":2,"alpha":1e+21,"mid":"tab\there"}` + "\n"
+	if data != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, data)
+	}
+}
+
+// TestColumnProjectionAndRename tests dropping and renaming columns
+func TestColumnProjectionAndRename(t *testing.T) {
+	content := "# id,secret,value,debug\n1,x,10,y\n"
+
+	config := &exporter.Config{}
+	config.Columns.Exclude = []string{"secret"}
+	config.Columns.Rename = map[string]string{"value": "reading"}
+	data, err := exportRaw(t, content, config)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+	if data != `{"id":"1","reading":"10","debug":"y"}`+"\n" {
+		t.Errorf("Unexpected output %q", data)
+	}
+
+	// Include keeps header order regardless of the order it lists columns in
+	config = &exporter.Config{}
+	config.Columns.Include = []string{"value", "id"}
+	data, err = exportRaw(t, content, config)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+	if data != `{"id":"1","value":"10"}`+"\n" {
+		t.Errorf("Unexpected output %q", data)
+	}
+
+	// Unknown columns are rejected
+	config = &exporter.Config{}
+	config.Columns.Rename = map[string]string{"vaule": "reading"}
+	_, err = exportRaw(t, content, config)
+	if err == nil {
+		t.Errorf("Expected an error for an unknown column")
+	}
+}
@@ -0,0 +1,54 @@
+package tests
+
+import (
+	"encoding/json"
+	"testing"
+
+	"s3-exporter/exporter"
+)
+
+// TestCSVFormat tests that batches are written as CSV with a header row and quoting
+func TestCSVFormat(t *testing.T) {
+	content := "# id:int,name,value:float\n1,\"a, \"\"b\"\"\",1.5\n2,plain,\n"
+
+	config := &exporter.Config{}
+	config.Export.Format = "csv"
+	config.Columns.Rename = map[string]string{"value": "reading"}
+	data, err := exportRaw(t, content, config)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+
+	expected := "id,name,reading\n1,\"a, \"\"b\"\"\",1.5\n2,plain,\n"
+	if data != expected {
+		t.Errorf("Expected %q, got %q", expected, data)
+	}
+}
+
+// TestJSONArrayFormat tests that batches are written as one JSON array
+func TestJSONArrayFormat(t *testing.T) {
+	content := "# id:int,name\n1,a\n2,b\n3,c\n"
+
+	config := &exporter.Config{}
+	config.Export.Format = "json_array"
+	data, err := exportRaw(t, content, config)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+
+	var records []map[string]interface{}
+	err = json.Unmarshal([]byte(data), &records)
+	if err != nil {
+		t.Fatalf("Expected a valid JSON document, got %v:\n%s", err, data)
+	}
+	if len(records) != 3 || records[2]["id"] != float64(3) || records[2]["name"] != "c" {
+		t.Errorf("Unexpected records: %v", records)
+	}
+
+	// An unknown format is rejected
+	config.Export.Format = "xml"
+	_, err = exportRaw(t, content, config)
+	if err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
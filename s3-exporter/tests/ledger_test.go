@@ -0,0 +1,187 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"s3-exporter/exporter"
+	"s3-exporter/sfm"
+)
+
+// TestLedger tests recording exports in the ledger
+func TestLedger(t *testing.T) {
+	tempDir := t.TempDir()
+	stateDir := filepath.Join(tempDir, "state")
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+
+	content := "# id,name\n1,item1\n"
+	err := os.WriteFile(sfmFile, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	ledger, err := exporter.OpenLedger(stateDir)
+	if err != nil {
+		t.Fatalf("OpenLedger failed: %v", err)
+	}
+
+	exported, err := ledger.IsExported(sfmFile)
+	if err != nil {
+		t.Fatalf("IsExported failed: %v", err)
+	}
+	if exported {
+		t.Errorf("Expected a new segment not to be exported")
+	}
+
+	err = ledger.MarkExported(sfmFile)
+	if err != nil {
+		t.Fatalf("MarkExported failed: %v", err)
+	}
+
+	// The segment file itself is left untouched
+	data, err := os.ReadFile(sfmFile)
+	if err != nil {
+		t.Fatalf("Failed to read SFM file: %v", err)
+	}
+	if string(data) != content {
+		t.Errorf("Expected the segment file to be unchanged, got '%s'", data)
+	}
+
+	// The entry survives reopening the ledger
+	ledger, err = exporter.OpenLedger(stateDir)
+	if err != nil {
+		t.Fatalf("OpenLedger failed: %v", err)
+	}
+	exported, err = ledger.IsExported(sfmFile)
+	if err != nil {
+		t.Fatalf("IsExported failed: %v", err)
+	}
+	if !exported {
+		t.Errorf("Expected the segment to be exported after reopening the ledger")
+	}
+
+	// Changing the content means the segment has to be exported again
+	err = os.WriteFile(sfmFile, []byte(content+"2,item2\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to update test SFM file: %v", err)
+	}
+	exported, err = ledger.IsExported(sfmFile)
+	if err != nil {
+		t.Fatalf("IsExported failed: %v", err)
+	}
+	if exported {
+		t.Errorf("Expected a modified segment not to be exported")
+	}
+}
+
+// TestLedgerMigration tests importing jsonS3Exported flags into the ledger
+func TestLedgerMigration(t *testing.T) {
+	tempDir := t.TempDir()
+	exportedFile := filepath.Join(tempDir, "exported.sfm")
+	pendingFile := filepath.Join(tempDir, "pending.sfm")
+
+	err := os.WriteFile(exportedFile, []byte("# id,name\njsonS3Exported:true\n1,item1\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+	err = os.WriteFile(pendingFile, []byte("# id,name\njsonS3Exported:false\n1,item1\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	ledger, err := exporter.OpenLedger(filepath.Join(tempDir, "state"))
+	if err != nil {
+		t.Fatalf("OpenLedger failed: %v", err)
+	}
+
+	for _, file := range []string{exportedFile, pendingFile} {
+		_, err = ledger.ImportInlineFlag(file, sfm.DefaultDelimiter)
+		if err != nil {
+			t.Fatalf("ImportInlineFlag failed for %s: %v", file, err)
+		}
+	}
+
+	exported, err := ledger.IsExported(exportedFile)
+	if err != nil {
+		t.Fatalf("IsExported failed: %v", err)
+	}
+	if !exported {
+		t.Errorf("Expected the flagged segment to be migrated into the ledger")
+	}
+
+	exported, err = ledger.IsExported(pendingFile)
+	if err != nil {
+		t.Fatalf("IsExported failed: %v", err)
+	}
+	if exported {
+		t.Errorf("Expected the unflagged segment not to be in the ledger")
+	}
+}
+
+// TestLedgerInlineFallback tests that segments flagged by earlier versions
+// are not exported again without a migration
+func TestLedgerInlineFallback(t *testing.T) {
+	tempDir := t.TempDir()
+	stateDir := filepath.Join(tempDir, "state")
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+
+	err := os.WriteFile(sfmFile, []byte("# id,name\njsonS3Exported:true\n1,item1\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	ledger, err := exporter.OpenLedger(stateDir)
+	if err != nil {
+		t.Fatalf("OpenLedger failed: %v", err)
+	}
+	exported, err := ledger.IsExported(sfmFile)
+	if err != nil {
+		t.Fatalf("IsExported failed: %v", err)
+	}
+	if !exported {
+		t.Errorf("Expected the flagged segment to be exported")
+	}
+
+	// The flag is imported into the ledger on first sight
+	data, err := os.ReadFile(filepath.Join(stateDir, exporter.LedgerFileName))
+	if err != nil {
+		t.Fatalf("Failed to read ledger: %v", err)
+	}
+	if !strings.Contains(string(data), `"source":"migration"`) {
+		t.Errorf("Expected the flag to be recorded as a migration, got '%s'", data)
+	}
+}
+
+// TestLedgerMigrationDelimiter tests importing the flag of a semicolon separated segment
+func TestLedgerMigrationDelimiter(t *testing.T) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "exported.sfm")
+
+	err := os.WriteFile(sfmFile, []byte("# id;name\nregions:east,west\njsonS3Exported:true\n1;item1\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	ledger, err := exporter.OpenLedger(filepath.Join(tempDir, "state"))
+	if err != nil {
+		t.Fatalf("OpenLedger failed: %v", err)
+	}
+
+	imported, err := ledger.ImportInlineFlag(sfmFile, ';')
+	if err != nil {
+		t.Fatalf("ImportInlineFlag failed: %v", err)
+	}
+	if !imported {
+		t.Errorf("Expected the flag of the semicolon separated segment to be imported")
+	}
+
+	exported, err := ledger.IsExported(sfmFile)
+	if err != nil {
+		t.Fatalf("IsExported failed: %v", err)
+	}
+	if !exported {
+		t.Errorf("Expected the semicolon separated segment to be migrated into the ledger")
+	}
+}
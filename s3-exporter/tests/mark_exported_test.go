@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"s3-exporter/exporter"
+)
+
+// TestMarkAsExportedAtomic tests that MarkAsExported rewrites only the flag
+// and keeps the file mode
+func TestMarkAsExportedAtomic(t *testing.T) {
+	tempDir := t.TempDir()
+	testFile := filepath.Join(tempDir, "segment.sfm")
+
+	testContent := "# id,name,value\njsonS3Exported:false\n1,item1,jsonS3Exported:false\n2,item2,200\n"
+	err := os.WriteFile(testFile, []byte(testContent), 0640)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	err = exporter.MarkAsExported(testFile)
+	if err != nil {
+		t.Fatalf("MarkAsExported failed: %v", err)
+	}
+
+	data, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+	// Data values that look like the flag are left alone
+	expected := "# id,name,value\njsonS3Exported:true\n1,item1,jsonS3Exported:false\n2,item2,200\n"
+	if string(data) != expected {
+		t.Errorf("Expected content %q, got %q", expected, data)
+	}
+
+	info, err := os.Stat(testFile)
+	if err != nil {
+		t.Fatalf("Failed to stat test file: %v", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode 0640 to be preserved, got %v", info.Mode().Perm())
+	}
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to read temp dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the segment file in the directory, got %d entries", len(entries))
+	}
+}
+
+// TestMarkAsExportedAddsFlag tests that a missing flag is added after the column header
+func TestMarkAsExportedAddsFlag(t *testing.T) {
+	testFile := filepath.Join(t.TempDir(), "segment.sfm")
+
+	err := os.WriteFile(testFile, []byte("# id,name\n1,item1\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	err = exporter.MarkAsExported(testFile)
+	if err != nil {
+		t.Fatalf("MarkAsExported failed: %v", err)
+	}
+
+	data, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+	if string(data) != "# id,name\njsonS3Exported:true\n1,item1\n" {
+		t.Errorf("Unexpected content %q", data)
+	}
+}
+
+// TestMarkAsExportedRefusesBadHeader tests that files without a parsable header are left untouched
+func TestMarkAsExportedRefusesBadHeader(t *testing.T) {
+	testFile := filepath.Join(t.TempDir(), "segment.sfm")
+
+	testContent := "1,item1\njsonS3Exported:false\n"
+	err := os.WriteFile(testFile, []byte(testContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	err = exporter.MarkAsExported(testFile)
+	if err == nil {
+		t.Errorf("Expected MarkAsExported to refuse a file without a column header")
+	}
+
+	data, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+	if string(data) != testContent {
+		t.Errorf("Expected the file to be left untouched, got %q", data)
+	}
+}
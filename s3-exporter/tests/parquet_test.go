@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+
+	"s3-exporter/exporter"
+	"s3-exporter/src"
+)
+
+// TestParquetFormat tests that batches are written as typed Parquet files
+// with one row group per row_group_rows records and column statistics
+func TestParquetFormat(t *testing.T) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+
+	sfmContent := "# id:int,value:float,ok:bool,timestamp:time,name\n" +
+		"1,1.5,true,2024-01-02T03:04:05Z,a\n" +
+		"2,,false,2024-01-02T03:04:06Z,b\n" +
+		"3,3.5,true,2024-01-02T03:04:07Z,c\n"
+	err := os.WriteFile(sfmFile, []byte(sfmContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	for _, mode := range []string{"stream", "tempfile"} {
+		config := &exporter.Config{}
+		config.Export.Format = "parquet"
+		config.Export.Mode = mode
+		config.Export.BatchSize = 10
+		config.Export.RowGroupRows = 2
+		config.Export.Compression = true
+		config.Export.TempDir = filepath.Join(tempDir, "temp")
+
+		store := src.NewMemoryStore()
+		err = exporter.ConvertAndUpload(sfmFile, config, store)
+		if err != nil {
+			t.Fatalf("%s: ConvertAndUpload failed: %v", mode, err)
+		}
+
+		manifest, err := exporter.ReadManifest(store, "segment")
+		if err != nil {
+			t.Fatalf("%s: ReadManifest failed: %v", mode, err)
+		}
+		if manifest.Format != "parquet" || manifest.Batches[0].Key != "segment/batch-0.parquet" || manifest.Batches[0].Compression != "none" {
+			t.Errorf("%s: Unexpected manifest: %+v", mode, manifest)
+		}
+
+		body, err := store.Get("segment/batch-0.parquet")
+		if err != nil {
+			t.Fatalf("%s: Get failed: %v", mode, err)
+		}
+		data, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatalf("%s: Failed to read batch: %v", mode, err)
+		}
+
+		parquetReader, err := reader.NewParquetColumnReader(buffer.NewBufferFileFromBytes(data), 1)
+		if err != nil {
+			t.Fatalf("%s: Failed to open parquet file: %v", mode, err)
+		}
+
+		footer := parquetReader.Footer
+		if footer.NumRows != 3 || len(footer.RowGroups) != 2 {
+			t.Errorf("%s: Expected 3 rows in 2 row groups, got %d rows in %d row groups", mode, footer.NumRows, len(footer.RowGroups))
+		}
+		for _, column := range footer.RowGroups[0].Columns {
+			if column.MetaData.Statistics == nil || column.MetaData.Statistics.NullCount == nil {
+				t.Errorf("%s: Expected statistics for column %v", mode, column.MetaData.PathInSchema)
+			}
+			if column.MetaData.Codec != parquet.CompressionCodec_SNAPPY {
+				t.Errorf("%s: Expected snappy compression, got %v", mode, column.MetaData.Codec)
+			}
+		}
+
+		ids, _, _, err := parquetReader.ReadColumnByIndex(0, 3)
+		if err != nil {
+			t.Fatalf("%s: Failed to read ids: %v", mode, err)
+		}
+		if len(ids) != 3 || ids[0] != int64(1) || ids[2] != int64(3) {
+			t.Errorf("%s: Unexpected ids %v", mode, ids)
+		}
+
+		values, _, definitions, err := parquetReader.ReadColumnByIndex(1, 3)
+		if err != nil {
+			t.Fatalf("%s: Failed to read values: %v", mode, err)
+		}
+		if len(values) != 3 || values[0] != 1.5 || definitions[1] != 0 {
+			t.Errorf("%s: Expected the empty value to be null, got %v (%v)", mode, values, definitions)
+		}
+
+		timestamps, _, _, err := parquetReader.ReadColumnByIndex(3, 1)
+		if err != nil {
+			t.Fatalf("%s: Failed to read timestamps: %v", mode, err)
+		}
+		if timestamps[0] != int64(1704164645000) {
+			t.Errorf("%s: Unexpected timestamp %v", mode, timestamps[0])
+		}
+		parquetReader.ReadStop()
+	}
+}
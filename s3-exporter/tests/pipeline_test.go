@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"s3-exporter/exporter"
+	"s3-exporter/src"
+)
+
+// TestConvertAndUploadPipeline tests that the pipelined export uploads every
+// batch in order
+func TestConvertAndUploadPipeline(t *testing.T) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+
+	var content strings.Builder
+	content.WriteString("# id,name,value\n")
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&content, "%d,item%d,%d\n", i, i, i*100)
+	}
+	err := os.WriteFile(sfmFile, []byte(content.String()), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	config := &exporter.Config{}
+	config.Export.BatchSize = 7
+	config.Export.Compression = true
+	config.Export.PipelineDepth = 3
+	config.Export.TempDir = filepath.Join(tempDir, "temp")
+
+	store := src.NewMemoryStore()
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+
+	manifest, err := exporter.ReadManifest(store, "segment")
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+	if len(manifest.Batches) != 143 || manifest.TotalRecords != 1000 {
+		t.Fatalf("Expected 143 batches with 1000 records, got %d batches with %d records", len(manifest.Batches), manifest.TotalRecords)
+	}
+	for i, batch := range manifest.Batches {
+		if !strings.HasPrefix(batch.Key, fmt.Sprintf("segment/batch-%d.json", i)) {
+			t.Errorf("Expected batch %d in position %d, got %s", i, i, batch.Key)
+		}
+	}
+}
+
+// TestConvertAndUploadModes tests the streaming and temp file export modes
+func TestConvertAndUploadModes(t *testing.T) {
+	for _, mode := range []string{"stream", "tempfile"} {
+		tempDir := t.TempDir()
+		sfmFile := filepath.Join(tempDir, "segment.sfm")
+
+		var content strings.Builder
+		content.WriteString("# id,name,value\n")
+		for i := 0; i < 500; i++ {
+			fmt.Fprintf(&content, "%d,item%d,%d\n", i, i, i*100)
+		}
+		err := os.WriteFile(sfmFile, []byte(content.String()), 0644)
+		if err != nil {
+			t.Fatalf("Failed to create test SFM file: %v", err)
+		}
+
+		config := &exporter.Config{}
+		config.Export.BatchSize = 200
+		config.Export.Compression = true
+		config.Export.Mode = mode
+		config.Export.TempDir = filepath.Join(tempDir, "temp")
+
+		store := src.NewMemoryStore()
+		err = exporter.ConvertAndUpload(sfmFile, config, store)
+		if err != nil {
+			t.Fatalf("%s: ConvertAndUpload failed: %v", mode, err)
+		}
+
+		manifest, err := exporter.ReadManifest(store, "segment")
+		if err != nil {
+			t.Fatalf("%s: ReadManifest failed: %v", mode, err)
+		}
+		if len(manifest.Batches) != 3 || manifest.TotalRecords != 500 {
+			t.Errorf("%s: Expected 3 batches with 500 records, got %+v", mode, manifest)
+		}
+
+		// Every batch is gzipped and matches its manifest entry
+		for _, batch := range manifest.Batches {
+			body, err := store.Get(batch.Key)
+			if err != nil {
+				t.Fatalf("%s: Get failed: %v", mode, err)
+			}
+			data, _ := io.ReadAll(body)
+			body.Close()
+
+			sum := sha256.Sum256(data)
+			if batch.Checksum != "sha256:"+hex.EncodeToString(sum[:]) || batch.Size != int64(len(data)) {
+				t.Errorf("%s: Manifest entry %+v does not match the uploaded object", mode, batch)
+			}
+
+			gz, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("%s: Expected %s to be gzipped: %v", mode, batch.Key, err)
+			}
+			lines, _ := io.ReadAll(gz)
+			if n := strings.Count(string(lines), "\n"); n != batch.Records {
+				t.Errorf("%s: Expected %d records in %s, got %d", mode, batch.Records, batch.Key, n)
+			}
+		}
+
+		// No temporary files are left behind
+		entries, _ := os.ReadDir(config.Export.TempDir)
+		if len(entries) != 0 {
+			t.Errorf("%s: Expected no files left in the temp dir, got %d", mode, len(entries))
+		}
+	}
+}
+
+// TestCheckSegmentPrefixes tests that same-named segments in different
+// directories are skipped rather than exported under the same keys
+func TestCheckSegmentPrefixes(t *testing.T) {
+	files := []string{"data/east/segment-1.sfm", "data/west/segment-2.sfm"}
+	exportable, err := exporter.CheckSegmentPrefixes(files)
+	if err != nil || len(exportable) != 2 {
+		t.Errorf("Expected distinct segment names to be accepted, got %v: %v", exportable, err)
+	}
+
+	// Only the same-named files are skipped
+	files = []string{"data/east/segment-1.sfm", "data/segment-2.sfm", "data/west/segment-1.sfm"}
+	exportable, err = exporter.CheckSegmentPrefixes(files)
+	if err == nil || !strings.Contains(err.Error(), "data/east/segment-1.sfm, data/west/segment-1.sfm") {
+		t.Errorf("Expected an error naming the same-named segments, got %v", err)
+	}
+	if len(exportable) != 1 || exportable[0] != "data/segment-2.sfm" {
+		t.Errorf("Expected only data/segment-2.sfm to be exported, got %v", exportable)
+	}
+}
@@ -0,0 +1,195 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"s3-exporter/src"
+)
+
+// TestIsRetryable tests the classification of storage errors
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"throttling", awserr.New("SlowDown", "reduce your request rate", nil), true},
+		{"server error", awserr.NewRequestFailure(awserr.New("InternalError", "oops", nil), 500, "req"), true},
+		{"unknown 503", awserr.NewRequestFailure(awserr.New("Unknown", "busy", nil), 503, "req"), true},
+		{"access denied", awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "req"), false},
+		{"no such bucket", awserr.New("NoSuchBucket", "missing", nil), false},
+		{"connection reset", awserr.New("RequestError", "send request failed", syscall.ECONNRESET), true},
+		{"wrapped reset", fmt.Errorf("error uploading: %w", syscall.ECONNRESET), true},
+		{"multipart wrapping", awserr.New("MultipartUpload", "upload failed", awserr.New("SlowDown", "slow", nil)), true},
+		{"not found", fmt.Errorf("key: %w", src.ErrNotFound), false},
+		{"local error", errors.New("disk full"), false},
+	}
+
+	for _, c := range cases {
+		if got := src.IsRetryable(c.err); got != c.want {
+			t.Errorf("%s: expected IsRetryable to be %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+// flakyStore fails the first n Puts with a retryable error
+type flakyStore struct {
+	*src.MemoryStore
+	failures int
+	attempts int
+}
+
+func (s *flakyStore) Put(key string, body io.Reader, opts src.PutOptions) error {
+	s.attempts++
+	if s.attempts <= s.failures {
+		// Consume part of the body so the retry has to rewind it
+		io.CopyN(io.Discard, body, 3)
+		return awserr.New("SlowDown", "reduce your request rate", nil)
+	}
+	return s.MemoryStore.Put(key, body, opts)
+}
+
+// TestRetryingStore tests that transient upload failures are retried
+func TestRetryingStore(t *testing.T) {
+	policy := src.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+	flaky := &flakyStore{MemoryStore: src.NewMemoryStore(), failures: 2}
+	store := src.NewRetryingStore(flaky, policy)
+
+	err := store.Put("segment/batch-0.json", strings.NewReader(`{"id":"1"}`), src.PutOptions{})
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if flaky.attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", flaky.attempts)
+	}
+
+	body, err := store.Get("segment/batch-0.json")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer body.Close()
+	data, _ := io.ReadAll(body)
+	if string(data) != `{"id":"1"}` {
+		t.Errorf("Expected the full body after retrying, got '%s'", data)
+	}
+
+	// Running out of attempts returns the last error
+	flaky = &flakyStore{MemoryStore: src.NewMemoryStore(), failures: 5}
+	store = src.NewRetryingStore(flaky, policy)
+	err = store.Put("segment/batch-0.json", strings.NewReader(`{}`), src.PutOptions{})
+	if err == nil {
+		t.Errorf("Expected Put to fail after exhausting the retry policy")
+	}
+	if flaky.attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", flaky.attempts)
+	}
+}
+
+// TestRetryPolicyDelay tests that the backoff doubles and cannot overflow without a cap
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := src.RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	if got := policy.Delay(3); got != 4*time.Second {
+		t.Errorf("Expected a delay of 4s before the third retry, got %v", got)
+	}
+	if got := policy.Delay(10); got != 10*time.Second {
+		t.Errorf("Expected the delay to be capped at 10s, got %v", got)
+	}
+
+	uncapped := src.RetryPolicy{BaseDelay: time.Second, Jitter: 1}
+	for _, attempt := range []int{40, 64, 200} {
+		if got := uncapped.Delay(attempt); got < 0 {
+			t.Errorf("Expected a non-negative delay for attempt %d, got %v", attempt, got)
+		}
+	}
+}
+
+// TestS3StoreSDKRetriesDisabled tests that the SDK makes a single attempt
+// when retries are left to a RetryingStore
+func TestS3StoreSDKRetriesDisabled(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	store, err := src.NewS3Store(src.S3Options{
+		Bucket:            "test-bucket",
+		AccessKey:         "test-access-key",
+		SecretKey:         "test-secret-key",
+		Endpoint:          server.URL,
+		ForcePathStyle:    true,
+		DisableSDKRetries: true,
+	})
+	if err != nil {
+		t.Fatalf("NewS3Store failed: %v", err)
+	}
+
+	_, err = store.Head("segment/manifest.json")
+	if err == nil {
+		t.Fatalf("Expected Head to fail")
+	}
+	if !src.IsRetryable(err) {
+		t.Errorf("Expected a 503 to be retryable, got %v", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("Expected 1 request with SDK retries disabled, got %d", got)
+	}
+}
+
+// TestS3StoreRetriesUnrewindableUpload tests that an upload a RetryingStore
+// cannot send again is still retried by the SDK
+func TestS3StoreRetriesUnrewindableUpload(t *testing.T) {
+	var puts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if r.Method == http.MethodPut && atomic.AddInt32(&puts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	s3Store, err := src.NewS3Store(src.S3Options{
+		Bucket:            "test-bucket",
+		AccessKey:         "test-access-key",
+		SecretKey:         "test-secret-key",
+		Endpoint:          server.URL,
+		ForcePathStyle:    true,
+		DisableSDKRetries: true,
+	})
+	if err != nil {
+		t.Fatalf("NewS3Store failed: %v", err)
+	}
+	store := src.NewRetryingStore(s3Store, src.RetryPolicy{MaxAttempts: 3})
+
+	// A pipe cannot be rewound
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(func() error {
+			_, err := io.WriteString(writer, "data")
+			return err
+		}())
+	}()
+
+	err = store.Put("segment/batch-0.json", reader, src.PutOptions{})
+	if err != nil {
+		t.Fatalf("Expected the upload to be retried, got %v", err)
+	}
+	if got := atomic.LoadInt32(&puts); got != 2 {
+		t.Errorf("Expected 2 upload requests, got %d", got)
+	}
+}
@@ -0,0 +1,308 @@
+package tests
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"s3-exporter/exporter"
+	"s3-exporter/rollup"
+	"s3-exporter/sfm"
+	"s3-exporter/src"
+)
+
+// rollupContent holds two hosts over two minutes, with one record out of order
+const rollupContent = "# timestamp:time,host,value:float,note\n" +
+	"2024-01-01T10:00:10Z,a,1,x\n" +
+	"2024-01-01T10:00:50Z,a,3,x\n" +
+	"2024-01-01T10:00:05Z,a,2,x\n" +
+	"2024-01-01T10:00:20Z,b,10,x\n" +
+	"2024-01-01T10:01:00Z,a,,x\n" +
+	"2024-01-01T10:01:30Z,a,5,x\n"
+
+// TestRollupEngine tests the aggregates of every series and window
+func TestRollupEngine(t *testing.T) {
+	minute, _ := rollup.ParseInterval("1m")
+	hour, _ := rollup.ParseInterval("1h")
+	spec := rollup.Spec{
+		Timestamp: "timestamp",
+		Values:    []string{"value"},
+		Tags:      []string{"host"},
+		Intervals: []rollup.Interval{minute, hour},
+	}
+	columns := []string{"timestamp", "host", "value", "note"}
+	types := []sfm.Type{sfm.TypeTime, sfm.TypeString, sfm.TypeFloat, sfm.TypeString}
+
+	engine, err := rollup.NewEngine(spec, columns, types)
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+
+	at := func(s string) time.Time {
+		ts, _ := time.Parse(time.RFC3339, s)
+		return ts
+	}
+	records := [][]interface{}{
+		{at("2024-01-01T10:00:10Z"), "a", 1.0, "x"},
+		{at("2024-01-01T10:00:50Z"), "a", 3.0, "x"},
+		{at("2024-01-01T10:00:05Z"), "a", 2.0, "x"},
+		{at("2024-01-01T10:00:20Z"), "b", 10.0, "x"},
+		{at("2024-01-01T10:01:00Z"), "a", nil, "x"},
+		{at("2024-01-01T10:01:30Z"), "a", int64(5), "x"},
+	}
+	for _, record := range records {
+		err = engine.Add(record)
+		if err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if engine.Add([]interface{}{nil, "a", 1.0, "x"}) != rollup.ErrNoTimestamp {
+		t.Errorf("Expected ErrNoTimestamp for a record without a timestamp")
+	}
+
+	// Columns: timestamp, host, count, sum, min, max, avg, first, last
+	expected := [][]interface{}{
+		{at("2024-01-01T10:00:00Z"), "a", int64(3), 6.0, 1.0, 3.0, 2.0, 2.0, 3.0},
+		{at("2024-01-01T10:00:00Z"), "b", int64(1), 10.0, 10.0, 10.0, 10.0, 10.0, 10.0},
+		{at("2024-01-01T10:01:00Z"), "a", int64(1), 5.0, 5.0, 5.0, 5.0, 5.0, 5.0},
+	}
+	rows := engine.Rows(0)
+	if len(rows) != len(expected) {
+		t.Fatalf("Expected %d 1m rows, got %v", len(expected), rows)
+	}
+	for i, row := range rows {
+		for j, value := range row {
+			if ts, ok := value.(time.Time); ok {
+				if !ts.Equal(expected[i][j].(time.Time)) {
+					t.Errorf("Row %d: expected window %v, got %v", i, expected[i][j], ts)
+				}
+				continue
+			}
+			if value != expected[i][j] {
+				t.Errorf("Row %d column %s: expected %v, got %v", i, engine.Columns()[j], expected[i][j], value)
+			}
+		}
+	}
+
+	rows = engine.Rows(1)
+	if len(rows) != 2 || rows[0][2] != int64(4) || rows[0][3] != 11.0 || rows[0][8] != 5.0 {
+		t.Errorf("Unexpected 1h rows %v", rows)
+	}
+
+	// Value columns must be numeric
+	spec.Values = []string{"note"}
+	_, err = rollup.NewEngine(spec, columns, types)
+	if err == nil {
+		t.Errorf("Expected an error for a string value column")
+	}
+}
+
+// TestParseInterval tests that intervals line up with days
+func TestParseInterval(t *testing.T) {
+	for _, name := range []string{"1m", "5m", "1h", "1d", "2d", "30s"} {
+		_, err := rollup.ParseInterval(name)
+		if err != nil {
+			t.Errorf("ParseInterval(%s) failed: %v", name, err)
+		}
+	}
+	for _, name := range []string{"7m", "5h", "0s", "1x", "d"} {
+		_, err := rollup.ParseInterval(name)
+		if err == nil {
+			t.Errorf("Expected ParseInterval(%s) to fail", name)
+		}
+	}
+}
+
+// rollupConfig returns a config rolling up rollupContent by host
+func rollupConfig(output string) *exporter.Config {
+	config := &exporter.Config{}
+	config.Rollup.Enabled = true
+	config.Rollup.Timestamp = "timestamp"
+	config.Rollup.Values = []string{"value"}
+	config.Rollup.Tags = []string{"host"}
+	config.Rollup.Intervals = []string{"1m", "1h"}
+	config.Rollup.Aggregates = []string{"count", "sum"}
+	config.Rollup.Output = output
+	return config
+}
+
+// TestExportRollups tests exporting rollups alongside and instead of raw rows
+func TestExportRollups(t *testing.T) {
+	for _, output := range []string{"alongside", "instead"} {
+		tempDir := t.TempDir()
+		sfmFile := filepath.Join(tempDir, "segment.sfm")
+		err := os.WriteFile(sfmFile, []byte(rollupContent), 0644)
+		if err != nil {
+			t.Fatalf("Failed to create test SFM file: %v", err)
+		}
+
+		config := rollupConfig(output)
+		store := src.NewMemoryStore()
+		err = exporter.ConvertAndUpload(sfmFile, config, store)
+		if err != nil {
+			t.Fatalf("%s: ConvertAndUpload failed: %v", output, err)
+		}
+
+		manifest, err := exporter.ReadManifest(store, "segment")
+		if err != nil {
+			t.Fatalf("%s: ReadManifest failed: %v", output, err)
+		}
+		if output == "alongside" && manifest.TotalRecords != 6 {
+			t.Errorf("%s: Expected 6 raw records, got %d", output, manifest.TotalRecords)
+		}
+		if output == "instead" && len(manifest.Batches) != 0 {
+			t.Errorf("%s: Expected no raw batches, got %+v", output, manifest.Batches)
+		}
+
+		if manifest.Rollup == nil || len(manifest.Rollup.Intervals) != 2 {
+			t.Fatalf("%s: Expected rollups for 2 intervals, got %+v", output, manifest.Rollup)
+		}
+		hour := manifest.Rollup.Intervals[1]
+		if hour.Interval != "1h" || hour.Key != "segment/rollup-1h.json" || hour.Records != 2 {
+			t.Errorf("%s: Unexpected 1h rollup entry %+v", output, hour)
+		}
+
+		body, err := store.Get(hour.Key)
+		if err != nil {
+			t.Fatalf("%s: Get failed: %v", output, err)
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		expected := `{"timestamp":"2024-01-01T10:00:00Z","host":"a","value_count":4,"value_sum":11}` + "\n" +
+			`{"timestamp":"2024-01-01T10:00:00Z","host":"b","value_count":1,"value_sum":10}` + "\n"
+		if string(data) != expected {
+			t.Errorf("%s: Expected\n%s\ngot\n%s", output, expected, data)
+		}
+	}
+}
+
+// TestResumedExportRollsUpEveryRecord tests that rollups of a resumed
+// export include the records uploaded before the interruption
+func TestResumedExportRollsUpEveryRecord(t *testing.T) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+	err := os.WriteFile(sfmFile, []byte(rollupContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	config := rollupConfig("alongside")
+	config.Export.BatchSize = 2
+	config.State.Dir = filepath.Join(tempDir, "state")
+
+	store := &failingStore{MemoryStore: src.NewMemoryStore(), failKey: "segment/batch-1.json", puts: map[string]int{}}
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err == nil {
+		t.Fatalf("Expected the first export to fail")
+	}
+
+	store.failKey = ""
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+
+	manifest, err := exporter.ReadManifest(store, "segment")
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+	if manifest.Rollup == nil || manifest.Rollup.Intervals[1].Records != 2 {
+		t.Fatalf("Unexpected rollups %+v", manifest.Rollup)
+	}
+
+	body, err := store.Get("segment/rollup-1h.json")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if !strings.HasPrefix(string(data), `{"timestamp":"2024-01-01T10:00:00Z","host":"a","value_count":4,"value_sum":11}`+"\n") {
+		t.Errorf("Expected the resumed rollup to count every record, got\n%s", data)
+	}
+}
+
+// TestRollupSeriesCap tests folding series beyond the cap into __other__
+func TestRollupSeriesCap(t *testing.T) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+	content := "# timestamp:time,host,value:float\n" +
+		"2024-01-01T10:00:00Z,a,1\n" +
+		"2024-01-01T10:00:10Z,b,2\n" +
+		"2024-01-01T10:00:20Z,c,4\n" +
+		"2024-01-01T10:00:30Z,a,8\n" +
+		"2024-01-01T10:00:40Z,d,16\n" +
+		"2024-01-01T10:00:50Z,c,32\n"
+	err := os.WriteFile(sfmFile, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	config := rollupConfig("instead")
+	config.Rollup.Intervals = []string{"1h"}
+	config.Rollup.MaxSeries = 2
+	store := src.NewMemoryStore()
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+
+	manifest, err := exporter.ReadManifest(store, "segment")
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+	if manifest.Rollup.MaxSeries != 2 || manifest.Rollup.FoldedSeries != 2 {
+		t.Errorf("Expected 2 folded series, got %+v", manifest.Rollup)
+	}
+
+	// The first two series are kept; c and d are rolled up together
+	body, err := store.Get("segment/rollup-1h.json")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	expected := `{"timestamp":"2024-01-01T10:00:00Z","host":"__other__","value_count":3,"value_sum":52}` + "\n" +
+		`{"timestamp":"2024-01-01T10:00:00Z","host":"a","value_count":2,"value_sum":9}` + "\n" +
+		`{"timestamp":"2024-01-01T10:00:00Z","host":"b","value_count":1,"value_sum":2}` + "\n"
+	if string(data) != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, data)
+	}
+
+	// Counters folded into __other__ keep counting per series, so that
+	// interleaved samples of b and c are not taken as resets
+	minute, _ := rollup.ParseInterval("1m")
+	spec := rollup.Spec{
+		Timestamp: "timestamp",
+		Values:    []string{"requests"},
+		Tags:      []string{"host"},
+		Intervals: []rollup.Interval{minute},
+		Kinds:     map[string]rollup.Kind{"requests": rollup.Counter},
+		MaxSeries: 1,
+	}
+	engine, err := rollup.NewEngine(spec, []string{"timestamp", "host", "requests"}, []sfm.Type{sfm.TypeTime, sfm.TypeString, sfm.TypeInt})
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+	start, _ := time.Parse(time.RFC3339, "2024-01-01T10:00:00Z")
+	for i := int64(0); i < 4; i++ {
+		at := start.Add(time.Duration(i*15) * time.Second)
+		engine.Add([]interface{}{at, "a", i * 10})
+		engine.Add([]interface{}{at, "b", 100 + i*10})
+		engine.Add([]interface{}{at, "c", 5 + i*10})
+	}
+
+	// Each host counts 30 over 45s, extrapolated to 40 over the minute
+	rows := engine.Rows(0)
+	if len(rows) != 2 || rows[0][1] != rollup.OtherSeries {
+		t.Fatalf("Expected rows for __other__ and a, got %v", rows)
+	}
+	if rows[0][2] != int64(8) || rows[0][3] != 80.0 || rows[0][5] != int64(0) {
+		t.Errorf("Expected 8 samples increasing by 80 without resets, got %v", rows[0])
+	}
+	if rows[1][2] != int64(4) || rows[1][3] != 40.0 || rows[1][5] != int64(0) {
+		t.Errorf("Expected 4 samples increasing by 40 without resets, got %v", rows[1])
+	}
+}
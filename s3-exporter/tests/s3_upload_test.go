@@ -1,8 +1,14 @@
 package tests
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"s3-exporter/src"
@@ -26,7 +32,7 @@ func TestCompressFile(t *testing.T) {
 	}
 	
 	// Compress the file
-	compressedFile, err := src.CompressFile(testFile)
+	compressedFile, err := src.CompressFile(testFile, src.ParallelGzipOptions{})
 	if err != nil {
 		t.Fatalf("CompressFile failed: %v", err)
 	}
@@ -87,10 +93,12 @@ func TestS3Upload(t *testing.T) {
 	}
 	
 	// Define test parameters
-	bucket := "test-bucket"
-	region := "us-west-2"
-	accessKey := "test-access-key"
-	secretKey := "test-secret-key"
+	opts := src.S3Options{
+		Bucket:    "test-bucket",
+		Region:    "us-west-2",
+		AccessKey: "test-access-key",
+		SecretKey: "test-secret-key",
+	}
 	s3Path := "test/path/test.json"
 	
 	// In a real test, you would:
@@ -102,11 +110,260 @@ func TestS3Upload(t *testing.T) {
 	// mockClient := NewMockS3Client()
 	
 	// This would be the actual test if we had mocking set up
-	err = src.UploadToS3(testFile, s3Path, bucket, region, accessKey, secretKey)
+	err = src.UploadToS3(testFile, s3Path, opts)
 	if err != nil {
 		t.Fatalf("UploadToS3 failed: %v", err)
 	}
 	
 	// Then verify the upload occurred correctly
 	// This would involve checking the mock client or making a GetObject call
-}
\ No newline at end of file
+}
+
+// TestNewS3StoreValidation tests that invalid upload settings are rejected
+func TestNewS3StoreValidation(t *testing.T) {
+	_, err := src.NewS3Store(src.S3Options{Region: "us-east-1"})
+	if err == nil {
+		t.Errorf("Expected an error when no bucket is configured")
+	}
+
+	_, err = src.NewS3Store(src.S3Options{Region: "us-east-1", Bucket: "test-bucket", PartSize: 1024})
+	if err == nil {
+		t.Errorf("Expected an error for a part size below the S3 minimum")
+	}
+
+	store, err := src.NewS3Store(src.S3Options{Region: "us-east-1", Bucket: "test-bucket", PartSize: 8 * 1024 * 1024, Concurrency: 10})
+	if err != nil {
+		t.Fatalf("NewS3Store failed: %v", err)
+	}
+	if store == nil {
+		t.Errorf("Expected a store")
+	}
+}
+
+// fakeS3 is an httptest server standing in for an S3-compatible endpoint.
+// It records the requests it receives and stores uploaded objects by path.
+type fakeS3 struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+	objects  map[string][]byte
+	// failPuts is the number of uploads refused with a 503 before objects
+	// are stored
+	failPuts int
+}
+
+// newFakeS3 starts a fakeS3 server that is closed when the test ends
+func newFakeS3(t *testing.T) *fakeS3 {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		fake.requests = append(fake.requests, r)
+
+		switch r.Method {
+		case http.MethodPut:
+			if fake.failPuts > 0 {
+				fake.failPuts--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fake.objects[r.URL.Path] = body
+			w.Header().Set("ETag", `"etag"`)
+		case http.MethodGet:
+			if r.URL.Query().Get("list-type") == "2" {
+				fake.list(w, r)
+				return
+			}
+			data, ok := fake.objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+				return
+			}
+			w.Write(data)
+		case http.MethodHead:
+			if _, ok := fake.objects[r.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodDelete:
+			delete(fake.objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+// list answers a ListObjectsV2 request with the common prefixes of the
+// stored objects, the only listing the tests need
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimSuffix(r.URL.Path, "/") + "/" + r.URL.Query().Get("prefix")
+	seen := make(map[string]bool)
+	var result strings.Builder
+	result.WriteString(`<ListBucketResult><IsTruncated>false</IsTruncated>`)
+	for p := range f.objects {
+		rest, ok := strings.CutPrefix(p, prefix)
+		end := strings.Index(rest, r.URL.Query().Get("delimiter"))
+		if !ok || end < 0 || seen[rest[:end]] {
+			continue
+		}
+		seen[rest[:end]] = true
+		fmt.Fprintf(&result, "<CommonPrefixes><Prefix>%s%s/</Prefix></CommonPrefixes>", r.URL.Query().Get("prefix"), rest[:end])
+	}
+	result.WriteString(`</ListBucketResult>`)
+	io.WriteString(w, result.String())
+}
+
+// lastRequest returns the last request received by the server
+func (f *fakeS3) lastRequest(t *testing.T) *http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		t.Fatalf("Expected a request to reach the endpoint")
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+// TestS3StoreCustomEndpoint tests that path-style requests reach a custom endpoint
+func TestS3StoreCustomEndpoint(t *testing.T) {
+	fake := newFakeS3(t)
+
+	store, err := src.NewS3Store(src.S3Options{
+		Bucket:         "test-bucket",
+		AccessKey:      "test-access-key",
+		SecretKey:      "test-secret-key",
+		Endpoint:       fake.URL,
+		ForcePathStyle: true,
+		DisableSSL:     true,
+	})
+	if err != nil {
+		t.Fatalf("NewS3Store failed: %v", err)
+	}
+
+	err = store.Put("segment/batch-0.json", strings.NewReader(`{"id":"1"}`), src.PutOptions{ContentType: "application/json"})
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	request := fake.lastRequest(t)
+	if request.URL.Path != "/test-bucket/segment/batch-0.json" {
+		t.Errorf("Expected a path-style request to /test-bucket/segment/batch-0.json, got %s", request.URL.Path)
+	}
+	if request.Host != strings.TrimPrefix(fake.URL, "http://") {
+		t.Errorf("Expected the request to be sent to the endpoint host, got %s", request.Host)
+	}
+
+	body, err := store.Get("segment/batch-0.json")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer body.Close()
+	data, _ := io.ReadAll(body)
+	if string(data) != `{"id":"1"}` {
+		t.Errorf("Expected to read back the uploaded object, got '%s'", data)
+	}
+
+	prefixes, err := store.ListPrefixes("")
+	if err != nil {
+		t.Fatalf("ListPrefixes failed: %v", err)
+	}
+	if query := fake.lastRequest(t).URL.Query(); query.Get("delimiter") != "/" {
+		t.Errorf("Expected the prefixes to be listed with a / delimiter, got %v", query)
+	}
+	if len(prefixes) != 1 || prefixes[0] != "segment/" {
+		t.Errorf("Expected the segment/ prefix, got %v", prefixes)
+	}
+}
+
+// TestS3StoreCABundle tests that an unusable CA bundle is rejected
+func TestS3StoreCABundle(t *testing.T) {
+	tempDir := t.TempDir()
+
+	_, err := src.NewS3Store(src.S3Options{Bucket: "test-bucket", Endpoint: "https://minio.local:9000", CABundle: filepath.Join(tempDir, "missing.pem")})
+	if err == nil {
+		t.Errorf("Expected an error for a CA bundle that does not exist")
+	}
+
+	notPEM := filepath.Join(tempDir, "ca.pem")
+	err = os.WriteFile(notPEM, []byte("not a certificate"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test CA bundle: %v", err)
+	}
+	_, err = src.NewS3Store(src.S3Options{Bucket: "test-bucket", Endpoint: "https://minio.local:9000", CABundle: notPEM})
+	if err == nil {
+		t.Errorf("Expected an error for a CA bundle without certificates")
+	}
+}
+
+// TestS3StoreCredentialChain tests that stores without static keys use the AWS credential chain
+func TestS3StoreCredentialChain(t *testing.T) {
+	tempDir := t.TempDir()
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_PROFILE", "")
+
+	credentialsFile := filepath.Join(tempDir, "credentials")
+	err := os.WriteFile(credentialsFile, []byte("[exporter]\naws_access_key_id = profile-access-key\naws_secret_access_key = profile-secret-key\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to create test credentials file: %v", err)
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(tempDir, "config"))
+
+	fake := newFakeS3(t)
+	opts := src.S3Options{
+		Bucket:         "test-bucket",
+		Endpoint:       fake.URL,
+		ForcePathStyle: true,
+	}
+
+	// Credentials from the environment
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret-key")
+	store, err := src.NewS3Store(opts)
+	if err != nil {
+		t.Fatalf("NewS3Store without static keys failed: %v", err)
+	}
+	err = store.Put("segment/batch-0.json", strings.NewReader(`{}`), src.PutOptions{})
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	auth := fake.lastRequest(t).Header.Get("Authorization")
+	if !strings.Contains(auth, "Credential=env-access-key/") {
+		t.Errorf("Expected the request to be signed with the environment credentials, got %q", auth)
+	}
+
+	// Credentials from a named profile
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	opts.Profile = "exporter"
+	store, err = src.NewS3Store(opts)
+	if err != nil {
+		t.Fatalf("NewS3Store with a profile failed: %v", err)
+	}
+	err = store.Put("segment/batch-0.json", strings.NewReader(`{}`), src.PutOptions{})
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	auth = fake.lastRequest(t).Header.Get("Authorization")
+	if !strings.Contains(auth, "Credential=profile-access-key/") {
+		t.Errorf("Expected the request to be signed with the profile credentials, got %q", auth)
+	}
+
+	// Assuming a role only needs STS once a request is made
+	opts.RoleARN = "arn:aws:iam::123456789012:role/exporter"
+	_, err = src.NewS3Store(opts)
+	if err != nil {
+		t.Errorf("NewS3Store with a role ARN failed: %v", err)
+	}
+
+	// A web identity token cannot be used without a role
+	opts.RoleARN = ""
+	opts.WebIdentityTokenFile = filepath.Join(tempDir, "token")
+	_, err = src.NewS3Store(opts)
+	if err == nil {
+		t.Errorf("Expected an error for a web identity token file without a role ARN")
+	}
+}
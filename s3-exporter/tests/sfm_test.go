@@ -0,0 +1,214 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"s3-exporter/exporter"
+	"s3-exporter/sfm"
+	"s3-exporter/src"
+)
+
+// exportRecords exports sfmContent to a memory store without compression
+// and returns the exported records
+func exportRecords(t *testing.T, sfmContent, delimiter string) []map[string]string {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+	err := os.WriteFile(sfmFile, []byte(sfmContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	config := &exporter.Config{}
+	config.Source.Delimiter = delimiter
+	config.Export.TempDir = filepath.Join(tempDir, "temp")
+
+	store := src.NewMemoryStore()
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+
+	body, err := store.Get("segment/batch-0.json")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer body.Close()
+
+	var records []map[string]string
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		record := map[string]string{}
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			t.Fatalf("Failed to parse exported record: %v", err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Failed to read exported records: %v", err)
+	}
+
+	return records
+}
+
+// TestConvertAndUploadQuotedFields tests that quoted fields keep their
+// delimiters, quotes and newlines
+func TestConvertAndUploadQuotedFields(t *testing.T) {
+	sfmContent := "# id,\"name, full\",note\n" +
+		"jsonS3Exported:false\n" +
+		"1,\"Smith, John\",\"said \"\"hi\"\"\"\n" +
+		"2,plain,\"first line\nsecond line\"\n" +
+		"3,\"unterminated\n"
+
+	records := exportRecords(t, sfmContent, "")
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d: %v", len(records), records)
+	}
+
+	if records[0]["name, full"] != "Smith, John" || records[0]["note"] != `said "hi"` {
+		t.Errorf("Unexpected first record: %v", records[0])
+	}
+	if records[1]["note"] != "first line\nsecond line" {
+		t.Errorf("Expected an embedded newline, got %q", records[1]["note"])
+	}
+}
+
+// TestConvertAndUploadDelimiters tests tab and pipe separated files and lines
+// longer than the default scanner buffer
+func TestConvertAndUploadDelimiters(t *testing.T) {
+	long := strings.Repeat("x", 100*1024)
+
+	records := exportRecords(t, "# id\tvalue\n1\t"+long+"\n2\t\"a\tb\"\n", "tab")
+	if len(records) != 2 || records[0]["value"] != long || records[1]["value"] != "a\tb" {
+		t.Errorf("Unexpected tab separated records")
+	}
+
+	records = exportRecords(t, "# id|value\n1| a,b \n", "pipe")
+	if len(records) != 1 || records[0]["value"] != "a,b" {
+		t.Errorf("Unexpected pipe separated records: %v", records)
+	}
+}
+
+// TestParseSfmLineQuoted tests ParseSfmLine with quoted fields
+func TestParseSfmLineQuoted(t *testing.T) {
+	result, err := exporter.ParseSfmLine(`1, "a, b" ,"c""d"`, []string{"id", "name", "value"})
+	if err != nil {
+		t.Fatalf("ParseSfmLine failed: %v", err)
+	}
+	if result["name"] != "a, b" || result["value"] != `c"d` {
+		t.Errorf("Unexpected result: %v", result)
+	}
+
+	_, err = exporter.ParseSfmLine(`1,"open`, []string{"id", "name"})
+	if err == nil {
+		t.Errorf("Expected an error for an unterminated quoted field")
+	}
+
+	_, err = sfm.ParseDelimiter("ab")
+	if err == nil {
+		t.Errorf("Expected an error for a multi-character delimiter")
+	}
+}
+
+// TestSfmReaderHeader tests that the reader parses the header block and
+// numbers records by the line they start on
+func TestSfmReaderHeader(t *testing.T) {
+	content := "# segment 42\n# id,note\njsonS3Exported: false\nsource:sensor-1\n\n1,\"a\nb\"\n# comment\n2,c\n3\n"
+	reader := sfm.NewReader(strings.NewReader(content), sfm.DefaultDelimiter)
+
+	header, err := reader.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	if strings.Join(header.Columns, "|") != "id|note" {
+		t.Errorf("Unexpected columns: %v", header.Columns)
+	}
+	if value, ok := header.Get("jsonS3Exported"); !ok || value != "false" {
+		t.Errorf("Expected jsonS3Exported to be false, got %q", value)
+	}
+	if value, _ := header.Get("source"); value != "sensor-1" {
+		t.Errorf("Expected source sensor-1, got %q", value)
+	}
+	if pos := reader.Position(); pos.Line != 5 || pos.Offset != int64(strings.Index(content, "1,")) {
+		t.Errorf("Unexpected position after the header: %+v", pos)
+	}
+
+	var lines []int
+	var syntaxErrors int
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var syntaxErr *sfm.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			syntaxErrors++
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		lines = append(lines, record.Line)
+	}
+
+	// The record with a missing field is reported as a syntax error
+	if len(lines) != 2 || lines[0] != 6 || lines[1] != 9 || syntaxErrors != 1 {
+		t.Errorf("Unexpected record lines %v with %d syntax errors", lines, syntaxErrors)
+	}
+}
+
+// TestSfmWriterRoundTrip tests that records written by the writer are read back unchanged
+func TestSfmWriterRoundTrip(t *testing.T) {
+	records := [][]string{
+		{"1", "plain"},
+		{"#2", "comma, quote \" and\nnewline"},
+		{"3", " padded "},
+		{"4", ""},
+	}
+
+	var buf bytes.Buffer
+	writer := sfm.NewWriter(&buf, '|')
+	header := sfm.NewHeader([]string{"id", "value"})
+	header.Set("jsonS3Exported", "false")
+	err := writer.WriteHeader(header)
+	if err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+	for _, record := range records {
+		err = writer.Write(record)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	err = writer.Flush()
+	if err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	reader := sfm.NewReader(&buf, '|')
+	readHeader, err := reader.ReadHeader()
+	if err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	if value, _ := readHeader.Get("jsonS3Exported"); value != "false" || len(readHeader.Columns) != 2 {
+		t.Errorf("Unexpected header: %+v", readHeader)
+	}
+	for i, expected := range records {
+		record, err := reader.Read()
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if strings.Join(record.Fields, "|") != strings.Join(expected, "|") {
+			t.Errorf("Record %d: expected %q, got %q", i, expected, record.Fields)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"s3-exporter/rollup"
+	"s3-exporter/sfm"
+)
+
+// TestQuantileSketch tests the accuracy of merged and serialized sketches
+func TestQuantileSketch(t *testing.T) {
+	// Two halves of 1..10000, interleaved, plus negatives and zeros
+	a, _ := rollup.NewQuantileSketch(0.01)
+	b, _ := rollup.NewQuantileSketch(0.01)
+	for i := 1; i <= 10000; i++ {
+		if i%2 == 0 {
+			a.Add(float64(i))
+		} else {
+			b.Add(float64(i))
+		}
+	}
+	for i := 0; i < 100; i++ {
+		b.Add(-5)
+		b.Add(0)
+	}
+
+	err := a.Merge(b)
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+
+	// The sketch survives serialization unchanged
+	decoded, err := rollup.DecodeQuantileSketch(a.Encode())
+	if err != nil {
+		t.Fatalf("DecodeQuantileSketch failed: %v", err)
+	}
+	if decoded.Count() != 10200 || decoded.Encode() != a.Encode() {
+		t.Errorf("Decoded sketch differs from the original")
+	}
+
+	// Ranks over 10200 values: 100 of -5, 100 of 0, then 1..10000
+	for q, exact := range map[float64]float64{0: -5, 0.01: 0, 0.5: 4900, 0.95: 9490, 0.99: 9898} {
+		value, ok := decoded.Quantile(q)
+		if !ok {
+			t.Fatalf("Quantile(%v) failed", q)
+		}
+		if math.Abs(value-exact) > math.Abs(exact)*0.01+1e-9 {
+			t.Errorf("Quantile(%v): expected %v within 1%%, got %v", q, exact, value)
+		}
+	}
+
+	// Sketches of different accuracy do not merge
+	coarse, _ := rollup.NewQuantileSketch(0.05)
+	if a.Merge(coarse) == nil {
+		t.Errorf("Expected an error merging sketches of different accuracy")
+	}
+	if _, err := rollup.DecodeQuantileSketch("not a sketch"); err == nil {
+		t.Errorf("Expected an error for an invalid sketch")
+	}
+}
+
+// TestRollupPercentiles tests percentile aggregates and merging rolled-up rows
+func TestRollupPercentiles(t *testing.T) {
+	minute, _ := rollup.ParseInterval("1m")
+	hour, _ := rollup.ParseInterval("1h")
+	spec := rollup.Spec{
+		Timestamp:  "timestamp",
+		Values:     []string{"latency"},
+		Intervals:  []rollup.Interval{minute},
+		Aggregates: rollup.Aggregates,
+	}
+	columns := []string{"timestamp", "latency"}
+	types := []sfm.Type{sfm.TypeTime, sfm.TypeFloat}
+
+	engine, err := rollup.NewEngine(spec, columns, types)
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+
+	// One minute of 1..100ms, the next of 101..200ms
+	start, _ := time.Parse(time.RFC3339, "2024-01-01T10:00:00Z")
+	for i := 1; i <= 200; i++ {
+		minute := time.Duration((i-1)/100) * time.Minute
+		engine.Add([]interface{}{start.Add(minute + time.Duration(i)*100*time.Millisecond), float64(i)})
+	}
+
+	// Columns: timestamp, count, sum, min, max, avg, first, last, p50, p95, p99, sketch
+	rows := engine.Rows(0)
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 1m rows, got %v", rows)
+	}
+	if p99 := rows[1][10].(float64); math.Abs(p99-199) > 199*0.01 {
+		t.Errorf("Expected a p99 of 199 within 1%%, got %v", p99)
+	}
+
+	// Merged into an hour, the percentiles cover both minutes
+	spec.Intervals = []rollup.Interval{hour}
+	hourly, err := rollup.NewEngine(spec, columns, types)
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+	for _, row := range rows {
+		err = hourly.AddRow(row)
+		if err != nil {
+			t.Fatalf("AddRow failed: %v", err)
+		}
+	}
+
+	row := hourly.Rows(0)[0]
+	for i, exact := range map[int]float64{8: 100, 9: 190, 10: 198} {
+		if math.Abs(row[i].(float64)-exact) > exact*0.01 {
+			t.Errorf("Column %s: expected %v within 1%%, got %v", hourly.Columns()[i], exact, row[i])
+		}
+	}
+	if row[1] != int64(200) || row[6] != 1.0 || row[7] != 200.0 {
+		t.Errorf("Unexpected merged row %v", row)
+	}
+}
@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"s3-exporter/exporter"
+	"s3-exporter/src"
+)
+
+// testObjectStore runs the same round trip against any ObjectStore
+func testObjectStore(t *testing.T, store src.ObjectStore) {
+	err := store.Put("segment/batch-0.json", strings.NewReader(`{"id":"1"}`), src.PutOptions{ContentType: "application/json"})
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	err = store.Put("segment/batch-1.json", strings.NewReader(`{"id":"2"}`), src.PutOptions{})
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	err = store.Put("other/batch-0.json", strings.NewReader(`{}`), src.PutOptions{})
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// Read an object back
+	body, err := store.Get("segment/batch-0.json")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		t.Fatalf("Failed to read object: %v", err)
+	}
+	if string(data) != `{"id":"1"}` {
+		t.Errorf("Expected object content '{\"id\":\"1\"}', got '%s'", data)
+	}
+
+	// List by prefix
+	objects, err := store.List("segment/")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(objects) != 2 || objects[0].Key != "segment/batch-0.json" || objects[1].Key != "segment/batch-1.json" {
+		t.Errorf("Unexpected listing: %+v", objects)
+	}
+
+	// List the prefixes one level down
+	prefixes, err := store.ListPrefixes("")
+	if err != nil {
+		t.Fatalf("ListPrefixes failed: %v", err)
+	}
+	if len(prefixes) != 2 || prefixes[0] != "other/" || prefixes[1] != "segment/" {
+		t.Errorf("Unexpected prefixes: %v", prefixes)
+	}
+	prefixes, err = store.ListPrefixes("seg")
+	if err != nil || len(prefixes) != 1 || prefixes[0] != "segment/" {
+		t.Errorf("Unexpected prefixes starting with seg: %v, %v", prefixes, err)
+	}
+
+	// Head reports the size
+	info, err := store.Head("segment/batch-1.json")
+	if err != nil {
+		t.Fatalf("Head failed: %v", err)
+	}
+	if info.Size != int64(len(`{"id":"2"}`)) {
+		t.Errorf("Expected size %d, got %d", len(`{"id":"2"}`), info.Size)
+	}
+
+	// Delete and check the object is gone
+	err = store.Delete("segment/batch-0.json")
+	if err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	_, err = store.Head("segment/batch-0.json")
+	if !errors.Is(err, src.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+	_, err = store.Get("segment/batch-0.json")
+	if !errors.Is(err, src.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+// TestMemoryStore tests the in-memory ObjectStore
+func TestMemoryStore(t *testing.T) {
+	testObjectStore(t, src.NewMemoryStore())
+}
+
+// TestLocalStore tests the local filesystem ObjectStore
+func TestLocalStore(t *testing.T) {
+	store, err := src.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStore failed: %v", err)
+	}
+	testObjectStore(t, store)
+}
+
+// TestConvertAndUploadToMemoryStore runs the export pipeline without AWS
+func TestConvertAndUploadToMemoryStore(t *testing.T) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+
+	sfmContent := `# id,name,value,timestamp
+jsonS3Exported:false
+1,item1,100,2023-01-01T12:00:00Z
+2,item2,200,2023-01-02T12:00:00Z
+3,item3,300,2023-01-03T12:00:00Z
+`
+
+	err := os.WriteFile(sfmFile, []byte(sfmContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	config := &exporter.Config{}
+	config.Export.BatchSize = 2
+	config.Export.TempDir = filepath.Join(tempDir, "temp")
+
+	store := src.NewMemoryStore()
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+
+	objects, err := store.List("segment/batch-")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("Expected 2 batch objects, got %d: %+v", len(objects), objects)
+	}
+
+	// The manifest lists both batches
+	manifest, err := exporter.ReadManifest(store, "segment")
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+	if len(manifest.Batches) != 2 || manifest.TotalRecords != 3 {
+		t.Errorf("Expected 2 batches with 3 records in the manifest, got %+v", manifest)
+	}
+	if manifest.Batches[0].Key != "segment/batch-0.json" || manifest.Batches[0].Records != 2 {
+		t.Errorf("Unexpected first manifest entry: %+v", manifest.Batches[0])
+	}
+	if !strings.HasPrefix(manifest.Batches[0].Checksum, "sha256:") {
+		t.Errorf("Expected a sha256 checksum, got '%s'", manifest.Batches[0].Checksum)
+	}
+	if strings.Join(manifest.Columns, ",") != "id,name,value,timestamp" {
+		t.Errorf("Unexpected manifest columns: %v", manifest.Columns)
+	}
+
+	body, err := store.Get("segment/batch-1.json")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("Failed to read batch: %v", err)
+	}
+	if !strings.Contains(string(data), `"name":"item3"`) {
+		t.Errorf("Expected last batch to contain item3, got '%s'", data)
+	}
+}
@@ -0,0 +1,176 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"s3-exporter/exporter"
+	"s3-exporter/sfm"
+	"s3-exporter/src"
+)
+
+// exportTyped exports sfmContent with the given type settings and returns
+// the exported records and the manifest
+func exportTyped(t *testing.T, sfmContent string, infer bool, onError string) ([]map[string]interface{}, *exporter.Manifest, error) {
+	tempDir := t.TempDir()
+	sfmFile := filepath.Join(tempDir, "segment.sfm")
+	err := os.WriteFile(sfmFile, []byte(sfmContent), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create test SFM file: %v", err)
+	}
+
+	config := &exporter.Config{}
+	config.Types.Infer = infer
+	config.Types.SampleRows = 100
+	config.Types.OnError = onError
+
+	store := src.NewMemoryStore()
+	err = exporter.ConvertAndUpload(sfmFile, config, store)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest, err := exporter.ReadManifest(store, "segment")
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+
+	body, err := store.Get("segment/batch-0.json")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer body.Close()
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		record := map[string]interface{}{}
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			t.Fatalf("Failed to parse exported record: %v", err)
+		}
+		records = append(records, record)
+	}
+
+	return records, manifest, nil
+}
+
+// TestDeclaredColumnTypes tests that declared types are written as JSON
+// numbers, booleans and timestamps and that empty values become null
+func TestDeclaredColumnTypes(t *testing.T) {
+	content := "# id:int,value:float,ok:bool,timestamp:time,name\n" +
+		"1,1.5,true,2024-01-02T03:04:05Z,007\n" +
+		"2,,false,2024-01-02T03:04:05.5+01:00,x\n"
+
+	records, manifest, err := exportTyped(t, content, false, "")
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+
+	first := records[0]
+	if first["id"] != float64(1) || first["value"] != 1.5 || first["ok"] != true || first["timestamp"] != "2024-01-02T03:04:05Z" || first["name"] != "007" {
+		t.Errorf("Unexpected first record: %v", first)
+	}
+	if value, ok := records[1]["value"]; !ok || value != nil {
+		t.Errorf("Expected an empty float to be null, got %v", value)
+	}
+
+	expected := []sfm.Type{sfm.TypeInt, sfm.TypeFloat, sfm.TypeBool, sfm.TypeTime, sfm.TypeString}
+	for i, columnType := range expected {
+		if manifest.ColumnTypes[i] != columnType {
+			t.Errorf("Expected column %d to be %s in the manifest, got %s", i, columnType, manifest.ColumnTypes[i])
+		}
+	}
+}
+
+// TestInferredColumnTypes tests type inference from sampled rows
+func TestInferredColumnTypes(t *testing.T) {
+	content := "# id,value,flag,code\n1,2,TRUE,10\n2,2.5,false,0x1\n3,,true,12\n"
+
+	records, manifest, err := exportTyped(t, content, true, "")
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+
+	expected := []sfm.Type{sfm.TypeInt, sfm.TypeFloat, sfm.TypeBool, sfm.TypeString}
+	for i, columnType := range expected {
+		if manifest.ColumnTypes[i] != columnType {
+			t.Errorf("Expected column %d to be inferred as %s, got %s", i, columnType, manifest.ColumnTypes[i])
+		}
+	}
+	if records[1]["value"] != 2.5 || records[0]["flag"] != true || records[1]["code"] != "0x1" {
+		t.Errorf("Unexpected records: %v", records)
+	}
+}
+
+// TestColumnTypeErrorPolicies tests the policies for values that do not
+// convert to their column type
+func TestColumnTypeErrorPolicies(t *testing.T) {
+	content := "# id:int,value:int\n1,10\n2,abc\n"
+
+	records, _, err := exportTyped(t, content, false, "null")
+	if err != nil || len(records) != 2 || records[1]["value"] != nil {
+		t.Errorf("Expected the bad value to be null, got %v (%v)", records, err)
+	}
+
+	records, _, err = exportTyped(t, content, false, "string")
+	if err != nil || len(records) != 2 || records[1]["value"] != "abc" {
+		t.Errorf("Expected the bad value to be kept as a string, got %v (%v)", records, err)
+	}
+
+	records, manifest, err := exportTyped(t, content, false, "skip")
+	if err != nil || len(records) != 1 || manifest.TotalRecords != 1 {
+		t.Errorf("Expected the bad record to be skipped, got %v (%v)", records, err)
+	}
+
+	_, _, err = exportTyped(t, content, false, "fail")
+	if err == nil {
+		t.Errorf("Expected the export to fail on the bad value")
+	}
+}
+
+// TestInferredColumnTypeMismatches tests values after the sampled rows that
+// do not match their inferred type: fractions widen an int column and other
+// values are nulled and counted in the manifest
+func TestInferredColumnTypeMismatches(t *testing.T) {
+	var content strings.Builder
+	content.WriteString("# id,value,code\n")
+	for i := 1; i <= 100; i++ {
+		fmt.Fprintf(&content, "%d,%d,00%d\n", i, i*10, i%10)
+	}
+	content.WriteString("101,30.5,007\n102,abc,008\n")
+
+	records, manifest, err := exportTyped(t, content.String(), true, "")
+	if err != nil {
+		t.Fatalf("ConvertAndUpload failed: %v", err)
+	}
+	if len(records) != 102 {
+		t.Fatalf("Expected 102 records, got %d", len(records))
+	}
+
+	if manifest.ColumnTypes[1] != sfm.TypeInt {
+		t.Errorf("Expected value to be inferred as int, got %s", manifest.ColumnTypes[1])
+	}
+	if records[100]["value"] != 30.5 {
+		t.Errorf("Expected a fraction in an int column to be written as a float, got %v", records[100]["value"])
+	}
+	if value, ok := records[101]["value"]; !ok || value != nil {
+		t.Errorf("Expected a non-numeric value in an int column to be null, got %v", value)
+	}
+	if manifest.NulledValues != 1 || manifest.Batches[0].NulledValues != 1 {
+		t.Errorf("Expected 1 nulled value in the manifest, got %d (batch %d)", manifest.NulledValues, manifest.Batches[0].NulledValues)
+	}
+
+	// Zero-padded identifiers are not numbers
+	if manifest.ColumnTypes[2] != sfm.TypeString || records[100]["code"] != "007" {
+		t.Errorf("Expected zero-padded codes to stay strings, got %s %v", manifest.ColumnTypes[2], records[100]["code"])
+	}
+}